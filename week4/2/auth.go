@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// sessionTTL is how long a session lasts after login.
+const sessionTTL = 12 * time.Hour
+
+var (
+	errInvalidCredentials = requestError{codeUnauthenticated, "Invalid person id or password"}
+	errPasswordTooLong    = invalidRequest("Password must be at most 72 bytes")
+	errOldPasswordNeeded  = invalidRequest("old_password is required to change your own password")
+	errWrongOldPassword   = requestError{codeForbidden, "Old password is incorrect"}
+)
+
+// dummyHash is compared against when a login names a person without a
+// password, so that the answer takes as long as for a wrong password.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// passwordCost is the bcrypt cost of new password hashes. Tests lower it,
+// since hashing is slow on purpose.
+var passwordCost = bcrypt.DefaultCost
+
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if errors.Is(err, bcrypt.ErrPasswordTooLong) {
+		return "", errPasswordTooLong
+	}
+	return string(hash), err
+}
+
+type session struct {
+	personId uint
+	expires  time.Time
+}
+
+// sessionStore holds the sessions of logged in people, by token. Sessions
+// live in memory only, so everyone has to log in again after a restart.
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]session
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{sessions: make(map[string]session)}
+}
+
+func (st *sessionStore) create(personId uint) (string, time.Time, error) {
+	var random [32]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return "", time.Time{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(random[:])
+	expires := time.Now().Add(sessionTTL)
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := time.Now()
+	for t, s := range st.sessions {
+		if now.After(s.expires) {
+			delete(st.sessions, t)
+		}
+	}
+	st.sessions[token] = session{personId: personId, expires: expires}
+	return token, expires, nil
+}
+
+// lookup returns the person a token was issued to, if it has not expired.
+func (st *sessionStore) lookup(token string) (uint, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	s, ok := st.sessions[token]
+	if !ok {
+		return 0, false
+	}
+	if time.Now().After(s.expires) {
+		delete(st.sessions, token)
+		return 0, false
+	}
+	return s.personId, true
+}
+
+func (st *sessionStore) delete(token string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.sessions, token)
+}
+
+// connAuth is the login state of one connection: the token of its session,
+// if it logged in.
+type connAuth struct {
+	token string
+}
+
+// personId returns the person logged in on the connection.
+func (s *server) personId(auth *connAuth) (uint, error) {
+	if auth.token == "" {
+		return 0, errNotLoggedIn
+	}
+	id, ok := s.sessions.lookup(auth.token)
+	if !ok {
+		auth.token = ""
+		return 0, errNotLoggedIn
+	}
+	return id, nil
+}
+
+type loginRequest struct {
+	Id       uint   `json:"id" validate:"required"`
+	Password string `json:"password" validate:"required"`
+}
+
+type loginResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Person    Person    `json:"person"`
+}
+
+// login checks a person's password and starts a session for them, which the
+// connection uses from then on. The token it returns identifies the session
+// on other transports.
+func (s *server) login(auth *connAuth, data interface{}) Response {
+	var req loginRequest
+	if err := s.decodeRequest(data, &req); err != nil {
+		return errorResponse(err)
+	}
+
+	hash, err := s.repo.passwordHash(req.Id)
+	if err != nil && !errors.Is(err, errPersonNotFound) {
+		return errorResponse(err)
+	}
+	if hash == "" {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(req.Password))
+		return errorResponse(errInvalidCredentials)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)) != nil {
+		return errorResponse(errInvalidCredentials)
+	}
+
+	person, err := s.repo.person(req.Id)
+	if err != nil {
+		return errorResponse(err)
+	}
+	token, expires, err := s.sessions.create(req.Id)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if auth.token != "" {
+		s.sessions.delete(auth.token)
+	}
+	auth.token = token
+	return Response{Status: true, Message: "Logged in", Data: loginResponse{Token: token, ExpiresAt: expires, Person: person}}
+}
+
+func (s *server) logout(auth *connAuth) Response {
+	if auth.token == "" {
+		return errorResponse(errNotLoggedIn)
+	}
+	s.sessions.delete(auth.token)
+	auth.token = ""
+	return Response{Status: true, Message: "Logged out"}
+}
+
+// checkOldPassword checks the old password of a person changing their own
+// password, so that a session left open is not enough to take the account
+// over. Platform admins may set anyone's password without it.
+func (s *server) checkOldPassword(auth *connAuth, personId uint, oldPassword *string) error {
+	callerId, err := s.personId(auth)
+	if err != nil {
+		return err
+	}
+	if callerId != personId {
+		return nil
+	}
+	a, err := s.repo.access(callerId)
+	if err != nil {
+		return err
+	}
+	if a.platformAdmin {
+		return nil
+	}
+	if oldPassword == nil || *oldPassword == "" {
+		return errOldPasswordNeeded
+	}
+
+	hash, err := s.repo.passwordHash(personId)
+	if err != nil {
+		return err
+	}
+	if hash == "" || bcrypt.CompareHashAndPassword([]byte(hash), []byte(*oldPassword)) != nil {
+		return errWrongOldPassword
+	}
+	return nil
+}
+
+// whoAmI returns the person logged in on the connection.
+func (s *server) whoAmI(auth *connAuth) Response {
+	id, err := s.personId(auth)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	person, err := s.repo.person(id)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return Response{Status: true, Message: "Person found", Data: person}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"testing"
+)
+
+// loginToken logs c in and returns its session token.
+func loginToken(t *testing.T, c *testClient, id uint, password string) string {
+	t.Helper()
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := c.callOK(LoginMethod, map[string]interface{}{"id": id, "password": password}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Token
+}
+
+func TestLoginRejectsWrongCredentials(t *testing.T) {
+	s := newTestServer()
+	admin, _ := loginAdmin(t, s)
+	person := mustCreate(t, admin, CreatePersonMethod, map[string]interface{}{"name": "p", "age": 20, "password": "secret"})
+	noPassword := mustCreate(t, admin, CreatePersonMethod, map[string]interface{}{"name": "q", "age": 20})
+
+	c := s.testClient()
+	for _, login := range []map[string]interface{}{
+		{"id": person, "password": "wrong"},
+		{"id": noPassword, "password": "anything"},
+		{"id": 999, "password": "secret"},
+	} {
+		resp, err := c.call(LoginMethod, login)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Every failure reads the same, so logins do not reveal who exists.
+		detail, _ := resp.Data.(errorDetail)
+		if resp.Status || detail.Code != codeUnauthenticated || resp.Message != errInvalidCredentials.message {
+			t.Errorf("login %v: status %t, code %q, message %q", login, resp.Status, detail.Code, resp.Message)
+		}
+	}
+	expectCode(t, c, codeInvalidRequest, LoginMethod, map[string]interface{}{"id": person})
+	expectCode(t, c, codeUnauthenticated, WhoAmIMethod, nil)
+}
+
+func TestWhoAmI(t *testing.T) {
+	s := newTestServer()
+	admin, _ := loginAdmin(t, s)
+	person := mustCreate(t, admin, CreatePersonMethod, map[string]interface{}{"name": "p", "age": 20, "password": "secret"})
+
+	c := s.testClient()
+	expectCode(t, c, codeUnauthenticated, WhoAmIMethod, nil)
+	if err := c.login(person, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	var me entity
+	if err := c.callOK(WhoAmIMethod, nil, &me); err != nil {
+		t.Fatal(err)
+	}
+	if me.Id != person {
+		t.Fatalf("logged in as %d, want %d", me.Id, person)
+	}
+}
+
+// Logging out ends the session everywhere its token is used, not only on
+// the connection that logged out.
+func TestLogoutInvalidatesSession(t *testing.T) {
+	s := newTestServer()
+	admin, _ := loginAdmin(t, s)
+	person := mustCreate(t, admin, CreatePersonMethod, map[string]interface{}{"name": "p", "age": 20, "password": "secret"})
+
+	c := s.testClient()
+	token := loginToken(t, c, person, "secret")
+	other := &testClient{s: s, auth: &connAuth{token: token}}
+	expectOK(t, other, WhoAmIMethod, nil)
+
+	expectOK(t, c, LogoutMethod, nil)
+	expectCode(t, c, codeUnauthenticated, WhoAmIMethod, nil)
+	expectCode(t, other, codeUnauthenticated, WhoAmIMethod, nil)
+	expectCode(t, c, codeUnauthenticated, LogoutMethod, nil)
+}
+
+// Logging in again replaces the connection's session.
+func TestLoginReplacesSession(t *testing.T) {
+	s := newTestServer()
+	admin, _ := loginAdmin(t, s)
+	person := mustCreate(t, admin, CreatePersonMethod, map[string]interface{}{"name": "p", "age": 20, "password": "secret"})
+
+	c := s.testClient()
+	first := loginToken(t, c, person, "secret")
+	second := loginToken(t, c, person, "secret")
+	if first == second {
+		t.Fatal("second login reused the token")
+	}
+	expectCode(t, &testClient{s: s, auth: &connAuth{token: first}}, codeUnauthenticated, WhoAmIMethod, nil)
+	expectOK(t, c, WhoAmIMethod, nil)
+}
+
+func TestChangingOwnPasswordNeedsOldPassword(t *testing.T) {
+	s := newTestServer()
+	admin, adminId := loginAdmin(t, s)
+	person := mustCreate(t, admin, CreatePersonMethod, map[string]interface{}{"name": "p", "age": 20, "password": "secret"})
+	c := s.testClient()
+	if err := c.login(person, "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	expectCode(t, c, codeInvalidRequest, UpdatePersonMethod, map[string]interface{}{"id": person, "password": "new"})
+	expectCode(t, c, codeInvalidRequest, UpdatePersonMethod, map[string]interface{}{"id": person, "password": "new", "old_password": ""})
+	expectCode(t, c, codeForbidden, UpdatePersonMethod, map[string]interface{}{"id": person, "password": "new", "old_password": "wrong"})
+	// Other changes need no password.
+	expectOK(t, c, UpdatePersonMethod, map[string]interface{}{"id": person, "name": "renamed"})
+	if err := c.login(person, "secret"); err != nil {
+		t.Fatalf("rejected password changes took effect: %v", err)
+	}
+
+	expectOK(t, c, UpdatePersonMethod, map[string]interface{}{"id": person, "password": "new", "old_password": "secret"})
+	if err := c.login(person, "new"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Platform admins set passwords, their own included, without the old one.
+	expectOK(t, admin, UpdatePersonMethod, map[string]interface{}{"id": person, "password": "reset"})
+	if err := c.login(person, "reset"); err != nil {
+		t.Fatal(err)
+	}
+	expectOK(t, admin, UpdatePersonMethod, map[string]interface{}{"id": adminId, "password": "admin reset"})
+	if err := admin.login(adminId, "admin reset"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Records refer to each other by ID only. Nested views, such as a school
+// with its classes, are assembled from them on read.
+type (
+	schoolRecord struct {
+		Id   uint   `json:"id"`
+		Name string `json:"name"`
+	}
+	personRecord struct {
+		Id   uint   `json:"id"`
+		Name string `json:"name"`
+		Age  int    `json:"age"`
+		// PasswordHash is the bcrypt hash of the person's password, or
+		// empty if they cannot log in.
+		PasswordHash string `json:"password_hash,omitempty"`
+	}
+	classRecord struct {
+		Id         uint   `json:"id"`
+		Name       string `json:"name"`
+		SchoolId   uint   `json:"school_id"`
+		TeacherId  uint   `json:"teacher_id"`
+		StudentIds []uint `json:"student_ids"`
+	}
+	// roleGrant gives a person a role, in one school for school roles.
+	roleGrant struct {
+		PersonId uint `json:"person_id" validate:"required"`
+		Role     role `json:"role" validate:"required"`
+		SchoolId uint `json:"school_id,omitempty"`
+	}
+)
+
+// maxExpand is the deepest nesting of views: a school, its classes and
+// their teachers and students.
+const maxExpand = 2
+
+// data is the whole state of a repository.
+type data struct {
+	SchoolIdCounter uint                  `json:"next_school_id"`
+	PersonIdCounter uint                  `json:"next_person_id"`
+	ClassIdCounter  uint                  `json:"next_class_id"`
+	Schools         map[uint]schoolRecord `json:"schools"`
+	People          map[uint]personRecord `json:"people"`
+	Classes         map[uint]classRecord  `json:"classes"`
+	Roles           []roleGrant           `json:"roles"`
+
+	// The classes of each school, and those each person teaches or
+	// attends, sorted by ID. They are derived from Classes and kept up to
+	// date by link and unlink.
+	schoolClasses map[uint][]uint
+	personClasses map[uint][]uint
+}
+
+func newData() *data {
+	return &data{
+		SchoolIdCounter: 1,
+		PersonIdCounter: 1,
+		ClassIdCounter:  1,
+		Schools:         make(map[uint]schoolRecord),
+		People:          make(map[uint]personRecord),
+		Classes:         make(map[uint]classRecord),
+		schoolClasses:   make(map[uint][]uint),
+		personClasses:   make(map[uint][]uint),
+	}
+}
+
+func (d *data) clone() *data {
+	cloned := *d
+	cloned.Schools = cloneMap(d.Schools)
+	cloned.People = cloneMap(d.People)
+	cloned.Classes = make(map[uint]classRecord, len(d.Classes))
+	for id, class := range d.Classes {
+		class.StudentIds = slices.Clone(class.StudentIds)
+		cloned.Classes[id] = class
+	}
+	cloned.Roles = slices.Clone(d.Roles)
+	cloned.schoolClasses = cloneIndex(d.schoolClasses)
+	cloned.personClasses = cloneIndex(d.personClasses)
+	return &cloned
+}
+
+func cloneMap[V any](m map[uint]V) map[uint]V {
+	cloned := make(map[uint]V, len(m))
+	for id, v := range m {
+		cloned[id] = v
+	}
+	return cloned
+}
+
+func cloneIndex(index map[uint][]uint) map[uint][]uint {
+	cloned := make(map[uint][]uint, len(index))
+	for id, ids := range index {
+		cloned[id] = slices.Clone(ids)
+	}
+	return cloned
+}
+
+// reindex rebuilds the derived indexes from the records.
+func (d *data) reindex() {
+	d.schoolClasses = make(map[uint][]uint)
+	d.personClasses = make(map[uint][]uint)
+	for _, class := range d.Classes {
+		d.link(class)
+	}
+}
+
+// link adds class to the indexes and unlink removes it; a changed class is
+// unlinked in its old state and linked in the new one.
+func (d *data) link(class classRecord) {
+	insertId(d.schoolClasses, class.SchoolId, class.Id)
+	insertId(d.personClasses, class.TeacherId, class.Id)
+	for _, studentId := range class.StudentIds {
+		insertId(d.personClasses, studentId, class.Id)
+	}
+}
+
+func (d *data) unlink(class classRecord) {
+	removeId(d.schoolClasses, class.SchoolId, class.Id)
+	removeId(d.personClasses, class.TeacherId, class.Id)
+	for _, studentId := range class.StudentIds {
+		removeId(d.personClasses, studentId, class.Id)
+	}
+}
+
+func insertId(index map[uint][]uint, key, id uint) {
+	ids := index[key]
+	if i, found := slices.BinarySearch(ids, id); !found {
+		index[key] = slices.Insert(ids, i, id)
+	}
+}
+
+func removeId(index map[uint][]uint, key, id uint) {
+	ids := index[key]
+	if i, found := slices.BinarySearch(ids, id); found {
+		ids = slices.Delete(ids, i, i+1)
+		if len(ids) == 0 {
+			delete(index, key)
+			return
+		}
+		index[key] = ids
+	}
+}
+
+// setClass stores class and updates the indexes.
+func (d *data) setClass(class classRecord) {
+	if old, exists := d.Classes[class.Id]; exists {
+		d.unlink(old)
+	}
+	d.Classes[class.Id] = class
+	d.link(class)
+}
+
+func (d *data) deleteClass(id uint) {
+	d.unlink(d.Classes[id])
+	delete(d.Classes, id)
+}
+
+func (d *data) teaches(personId uint) bool {
+	for _, classId := range d.personClasses[personId] {
+		if d.Classes[classId].TeacherId == personId {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *data) teacherIsStudent(teacherId uint) bool {
+	for _, classId := range d.personClasses[teacherId] {
+		if slices.Contains(d.Classes[classId].StudentIds, teacherId) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *data) isInOtherSchoolClasses(studentId, schoolId uint) bool {
+	for _, classId := range d.personClasses[studentId] {
+		class := d.Classes[classId]
+		if class.SchoolId != schoolId && slices.Contains(class.StudentIds, studentId) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *data) platformAdmins() int {
+	n := 0
+	for _, grant := range d.Roles {
+		if grant.Role == rolePlatformAdmin {
+			n++
+		}
+	}
+	return n
+}
+
+// revokeRoles removes the grants matching drop.
+func (d *data) revokeRoles(drop func(roleGrant) bool) {
+	d.Roles = slices.DeleteFunc(slices.Clone(d.Roles), drop)
+}
+
+func (d *data) access(personId uint) access {
+	a := access{
+		personId:    personId,
+		schoolAdmin: make(map[uint]bool),
+		teaches:     make(map[uint]bool),
+	}
+	for _, grant := range d.Roles {
+		if grant.PersonId != personId {
+			continue
+		}
+		switch grant.Role {
+		case rolePlatformAdmin:
+			a.platformAdmin = true
+		case roleSchoolAdmin:
+			a.schoolAdmin[grant.SchoolId] = true
+		}
+	}
+	for _, classId := range d.personClasses[personId] {
+		if d.Classes[classId].TeacherId == personId {
+			a.teaches[classId] = true
+		}
+	}
+	return a
+}
+
+// roles returns the roles granted to a person followed by those they have
+// as a teacher or student, by school.
+func (d *data) roles(personId uint) []roleGrant {
+	var roles []roleGrant
+	for _, grant := range d.Roles {
+		if grant.PersonId == personId {
+			roles = append(roles, grant)
+		}
+	}
+	for _, classId := range d.personClasses[personId] {
+		class := d.Classes[classId]
+		derived := roleGrant{PersonId: personId, Role: roleStudent, SchoolId: class.SchoolId}
+		if class.TeacherId == personId {
+			derived.Role = roleTeacher
+		}
+		if !slices.Contains(roles, derived) {
+			roles = append(roles, derived)
+		}
+	}
+	return roles
+}
+
+// The views below nest records expand levels deep. Records beyond that
+// carry only their ID, their other fields left zero; trimSchool and
+// trimClass drop those fields from responses.
+
+func (d *data) personView(id uint) Person {
+	person := d.People[id]
+	return Person{
+		Id:      person.Id,
+		Name:    person.Name,
+		Age:     person.Age,
+		Classes: slices.Clone(d.personClasses[id]),
+	}
+}
+
+func (d *data) classView(id uint, expand int) Class {
+	class := d.Classes[id]
+	view := Class{
+		Id:       class.Id,
+		Name:     class.Name,
+		SchoolId: class.SchoolId,
+		Teacher:  Person{Id: class.TeacherId},
+	}
+	if expand > 0 {
+		view.Teacher = d.personView(class.TeacherId)
+	}
+	for _, studentId := range class.StudentIds {
+		student := Person{Id: studentId}
+		if expand > 0 {
+			student = d.personView(studentId)
+		}
+		view.Students = append(view.Students, student)
+	}
+	return view
+}
+
+func (d *data) schoolView(id uint, expand int) School {
+	school := d.Schools[id]
+	view := School{Id: school.Id, Name: school.Name}
+	for _, classId := range d.schoolClasses[id] {
+		class := Class{Id: classId}
+		if expand > 0 {
+			class = d.classView(classId, expand-1)
+		}
+		view.Classes = append(view.Classes, class)
+	}
+	return view
+}
+
+// checkReferences reports the first reference to a missing record.
+func (d *data) checkReferences() error {
+	for id, class := range d.Classes {
+		if _, exists := d.Schools[class.SchoolId]; !exists {
+			return fmt.Errorf("class %d belongs to missing school %d", id, class.SchoolId)
+		}
+		if _, exists := d.People[class.TeacherId]; !exists {
+			return fmt.Errorf("class %d is taught by missing person %d", id, class.TeacherId)
+		}
+		for _, studentId := range class.StudentIds {
+			if _, exists := d.People[studentId]; !exists {
+				return fmt.Errorf("class %d is attended by missing person %d", id, studentId)
+			}
+		}
+	}
+	for _, grant := range d.Roles {
+		if _, exists := d.People[grant.PersonId]; !exists {
+			return fmt.Errorf("role %s is granted to missing person %d", grant.Role, grant.PersonId)
+		}
+		if _, exists := d.Schools[grant.SchoolId]; grant.Role == roleSchoolAdmin && !exists {
+			return fmt.Errorf("role %s is granted in missing school %d", grant.Role, grant.SchoolId)
+		}
+	}
+	return nil
+}
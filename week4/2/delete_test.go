@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+)
+
+// mustCreate creates a record and returns its id.
+func mustCreate(t *testing.T, c *testClient, method string, data map[string]interface{}) uint {
+	t.Helper()
+	var e entity
+	if err := c.callOK(method, data, &e); err != nil {
+		t.Fatal(err)
+	}
+	return e.Id
+}
+
+// expectCode makes a request that must fail with code.
+func expectCode(t *testing.T, c *testClient, code, method string, data map[string]interface{}) {
+	t.Helper()
+	resp, err := c.call(method, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	detail, _ := resp.Data.(errorDetail)
+	if resp.Status || detail.Code != code {
+		t.Fatalf("%s %v: status %t, code %q; want code %q", method, data, resp.Status, detail.Code, code)
+	}
+}
+
+func expectOK(t *testing.T, c *testClient, method string, data map[string]interface{}) {
+	t.Helper()
+	if err := c.callOK(method, data, &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeletesLeaveNoDanglingReferences(t *testing.T) {
+	s := newTestServer()
+	c, _ := loginAdmin(t, s)
+
+	school := mustCreate(t, c, CreateSchoolMethod, map[string]interface{}{"name": "A"})
+	teacher := mustCreate(t, c, CreatePersonMethod, map[string]interface{}{"name": "teacher", "age": 40})
+	otherTeacher := mustCreate(t, c, CreatePersonMethod, map[string]interface{}{"name": "other teacher", "age": 50})
+	leaving := mustCreate(t, c, CreatePersonMethod, map[string]interface{}{"name": "leaving", "age": 12})
+	staying := mustCreate(t, c, CreatePersonMethod, map[string]interface{}{"name": "staying", "age": 13})
+	classA := mustCreate(t, c, CreateClassMethod, map[string]interface{}{"name": "a", "school_id": school, "teacher": map[string]interface{}{"id": teacher}})
+	classB := mustCreate(t, c, CreateClassMethod, map[string]interface{}{"name": "b", "school_id": school, "teacher": map[string]interface{}{"id": otherTeacher}})
+	for _, student := range []uint{leaving, staying} {
+		expectOK(t, c, AddStudentToClassMethod, map[string]interface{}{"class_id": classA, "student_id": student})
+	}
+	expectOK(t, c, AddStudentToClassMethod, map[string]interface{}{"class_id": classB, "student_id": leaving})
+	expectOK(t, c, GrantRoleMethod, map[string]interface{}{"person_id": staying, "role": roleSchoolAdmin, "school_id": school})
+	checkConsistent(t, s, c)
+
+	t.Run("rejected", func(t *testing.T) {
+		expectCode(t, c, codeConflict, DeleteSchoolMethod, map[string]interface{}{"id": school})
+		expectCode(t, c, codeConflict, DeletePersonMethod, map[string]interface{}{"id": teacher})
+		expectCode(t, c, codeNotFound, DeleteClassMethod, map[string]interface{}{"id": 999})
+
+		var class jsonClass
+		if err := c.callOK(GetClassMethod, map[string]interface{}{"id": classA}, &class); err != nil {
+			t.Fatal("rejected deletes changed data:", err)
+		}
+		if class.Teacher.Id != teacher || len(class.Students) != 2 {
+			t.Fatalf("rejected deletes changed class %d: %+v", classA, class)
+		}
+		checkConsistent(t, s, c)
+	})
+
+	t.Run("student", func(t *testing.T) {
+		expectOK(t, c, DeletePersonMethod, map[string]interface{}{"id": leaving})
+		for _, classId := range []uint{classA, classB} {
+			var class jsonClass
+			if err := c.callOK(GetClassMethod, map[string]interface{}{"id": classId}, &class); err != nil {
+				t.Fatal(err)
+			}
+			for _, student := range class.Students {
+				if student.Id == leaving {
+					t.Fatalf("class %d still lists deleted person %d", classId, leaving)
+				}
+			}
+		}
+		checkConsistent(t, s, c)
+	})
+
+	t.Run("class", func(t *testing.T) {
+		expectOK(t, c, DeleteClassMethod, map[string]interface{}{"id": classB})
+		for _, person := range listAll[jsonPerson](t, c, ListPeopleMethod) {
+			if person.Id == otherTeacher && len(person.Classes) != 0 {
+				t.Fatalf("teacher of deleted class still lists classes %v", person.Classes)
+			}
+		}
+		checkConsistent(t, s, c)
+	})
+
+	t.Run("cascade", func(t *testing.T) {
+		expectOK(t, c, DeleteSchoolMethod, map[string]interface{}{"id": school, "cascade": true})
+		expectCode(t, c, codeNotFound, GetClassMethod, map[string]interface{}{"id": classA})
+		roles, err := s.repo.roles(staying)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(roles) != 0 {
+			t.Fatalf("person %d keeps roles %v after their school was deleted", staying, roles)
+		}
+		// Nobody teaches a class any more, so the teacher can go too.
+		expectOK(t, c, DeletePersonMethod, map[string]interface{}{"id": teacher})
+		checkConsistent(t, s, c)
+	})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Codes of error responses, sent in their data so that clients can tell
+// failures apart without parsing messages.
+const (
+	codeInvalidRequest  = "invalid_request"
+	codeNotFound        = "not_found"
+	codeConflict        = "conflict"
+	codeUnauthenticated = "unauthenticated"
+	codeForbidden       = "forbidden"
+	codeUnknownMethod   = "unknown_method"
+	codeInternal        = "internal"
+)
+
+// requestError is an error caused by the request rather than the server,
+// whose message is shown to the client.
+type requestError struct {
+	code    string
+	message string
+}
+
+func (e requestError) Error() string {
+	return e.message
+}
+
+func invalidRequest(message string) requestError {
+	return requestError{codeInvalidRequest, message}
+}
+
+// fieldError is what is wrong with one field of a request. Field is its
+// JSON path, such as teacher.id.
+type fieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// validationError lists every field of a request that is invalid.
+type validationError []fieldError
+
+func (e validationError) Error() string {
+	if len(e) == 1 {
+		return fmt.Sprintf("Invalid request data: %s %s", e[0].Field, e[0].Message)
+	}
+	return fmt.Sprintf("Invalid request data: %d invalid fields", len(e))
+}
+
+// errorDetail is the data of an error response.
+type errorDetail struct {
+	Code        string       `json:"code"`
+	Fields      []fieldError `json:"fields,omitempty"`
+	Suggestions []string     `json:"suggestions,omitempty"`
+}
+
+// errorResponse reports err to the client if the request caused it, and
+// otherwise logs it and hides the details.
+func errorResponse(err error) Response {
+	var invalid validationError
+	if errors.As(err, &invalid) {
+		return Response{Status: false, Message: invalid.Error(), Data: errorDetail{Code: codeInvalidRequest, Fields: invalid}}
+	}
+	var reqErr requestError
+	if errors.As(err, &reqErr) {
+		return Response{Status: false, Message: reqErr.Error(), Data: errorDetail{Code: reqErr.code}}
+	}
+	fmt.Println("Request failed:", err)
+	return internalErrorResponse()
+}
+
+func internalErrorResponse() Response {
+	return Response{Status: false, Message: "Internal server error", Data: errorDetail{Code: codeInternal}}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// schemaVersion is the version of the data file format this server writes.
+// Changing the format means bumping it and appending a migration.
+const schemaVersion = 3
+
+// migrations[i] upgrades a version i+1 document to version i+2, in place.
+var migrations = []func(doc map[string]json.RawMessage) error{
+	migrateToIdReferences,
+	addRoles,
+}
+
+// migrateToIdReferences replaces the copies of classes and people that
+// version 1 embedded in other records with their IDs. Version 2 derives
+// school and person classes from the classes instead of storing them.
+func migrateToIdReferences(doc map[string]json.RawMessage) error {
+	for _, key := range []string{"schools", "people"} {
+		var records map[string]map[string]json.RawMessage
+		if err := json.Unmarshal(doc[key], &records); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		for _, record := range records {
+			delete(record, "classes")
+		}
+		if err := setDocField(doc, key, records); err != nil {
+			return err
+		}
+	}
+
+	type ref struct {
+		Id uint `json:"id"`
+	}
+	var classes map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(doc["classes"], &classes); err != nil {
+		return fmt.Errorf("classes: %w", err)
+	}
+	for id, class := range classes {
+		var teacher ref
+		var students []ref
+		if err := json.Unmarshal(class["teacher"], &teacher); err != nil {
+			return fmt.Errorf("class %s: %w", id, err)
+		}
+		if err := json.Unmarshal(class["students"], &students); err != nil {
+			return fmt.Errorf("class %s: %w", id, err)
+		}
+		studentIds := make([]uint, len(students))
+		for i, student := range students {
+			studentIds[i] = student.Id
+		}
+
+		delete(class, "teacher")
+		delete(class, "students")
+		class["teacher_id"], _ = json.Marshal(teacher.Id)
+		class["student_ids"], _ = json.Marshal(studentIds)
+	}
+	return setDocField(doc, "classes", classes)
+}
+
+// addRoles adds the list of role grants introduced in version 3. Nobody
+// holds a role in migrated data; the platform admin is named with
+// platformAdminEnv when the server starts.
+func addRoles(doc map[string]json.RawMessage) error {
+	if _, ok := doc["roles"]; !ok {
+		doc["roles"] = json.RawMessage("[]")
+	}
+	return nil
+}
+
+func setDocField(doc map[string]json.RawMessage, key string, v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	doc[key] = value
+	return nil
+}
+
+// fileRepository is a memoryRepository that writes all of its data to a
+// JSON file after every change, before the change becomes visible. The file
+// is replaced atomically, so a crash leaves either the old or the new
+// version. Only one server may use a file at a time.
+//
+// Every change clones the whole data set and rewrites the whole file, so a
+// write costs time proportional to the size of the data rather than of the
+// change, and writes are serialized behind it. That suits the small data
+// sets this server keeps; a larger one would need an append-only log.
+type fileRepository struct {
+	*memoryRepository
+	path string
+}
+
+func openFileRepository(path string) (*fileRepository, error) {
+	r := &fileRepository{memoryRepository: newMemoryRepository(), path: path}
+
+	d, err := readDataFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		// Write the empty file right away, so that a path the server cannot
+		// write to fails at startup rather than on the first change.
+		if err := r.write(r.data); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	default:
+		r.data = d
+	}
+
+	r.save = r.write
+	return r, nil
+}
+
+// dataFile is the document stored in the data file.
+type dataFile struct {
+	Version int `json:"version"`
+	*data
+}
+
+func readDataFile(path string) (*data, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(content, &doc); err != nil {
+		return nil, err
+	}
+	var version int
+	if err := json.Unmarshal(doc["version"], &version); err != nil || version < 1 {
+		return nil, errors.New("missing or invalid schema version")
+	}
+	if version > schemaVersion {
+		return nil, fmt.Errorf("schema version %d is newer than the supported version %d", version, schemaVersion)
+	}
+
+	for v := version; v < schemaVersion; v++ {
+		if err := migrations[v-1](doc); err != nil {
+			return nil, fmt.Errorf("migrate schema version %d to %d: %w", v, v+1, err)
+		}
+	}
+	delete(doc, "version")
+
+	migrated, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	d := newData()
+	if err := json.Unmarshal(migrated, d); err != nil {
+		return nil, err
+	}
+	if err := d.checkCounters(); err != nil {
+		return nil, err
+	}
+	if err := d.checkReferences(); err != nil {
+		return nil, err
+	}
+	d.reindex()
+	return d, nil
+}
+
+// checkCounters makes sure no ID counter would hand out an ID in use.
+func (d *data) checkCounters() error {
+	for id := range d.Schools {
+		if id >= d.SchoolIdCounter {
+			return fmt.Errorf("school %d is not below the next school id %d", id, d.SchoolIdCounter)
+		}
+	}
+	for id := range d.People {
+		if id >= d.PersonIdCounter {
+			return fmt.Errorf("person %d is not below the next person id %d", id, d.PersonIdCounter)
+		}
+	}
+	for id := range d.Classes {
+		if id >= d.ClassIdCounter {
+			return fmt.Errorf("class %d is not below the next class id %d", id, d.ClassIdCounter)
+		}
+	}
+	return nil
+}
+
+// write replaces the data file with d: it writes a temporary file next to
+// it, syncs it and renames it over the old one.
+func (r *fileRepository) write(d *data) error {
+	content, err := json.Marshal(dataFile{Version: schemaVersion, data: d})
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(r.path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(r.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), r.path); err != nil {
+		return err
+	}
+
+	// Sync the directory too, or the rename itself may not survive a crash.
+	if f, err := os.Open(dir); err == nil {
+		f.Sync()
+		f.Close()
+	}
+	return nil
+}
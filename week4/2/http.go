@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// httpAddrEnv names the environment variable holding the address the HTTP
+// gateway listens on, such as :8081. Without it, the server speaks only the
+// TCP protocol.
+const httpAddrEnv = "SCHOOL_HTTP_ADDR"
+
+// maxBodySize is the largest request body the gateway reads.
+const maxBodySize = 1 << 20
+
+// httpRoute exposes a method of the TCP protocol over HTTP. Its data is
+// assembled from the wildcards of the path, the query and a JSON object
+// body, in that order of precedence, with the names of the fields of
+// request. Response is the data of a successful response; both only
+// describe the route in the OpenAPI document, and are nil if there is none.
+type httpRoute struct {
+	verb     string
+	path     string
+	method   string
+	summary  string
+	request  interface{}
+	response interface{}
+}
+
+func (route httpRoute) successStatus() int {
+	switch route.method {
+	case CreateSchoolMethod, CreateClassMethod, CreatePersonMethod:
+		return http.StatusCreated
+	}
+	return http.StatusOK
+}
+
+var httpRoutes = []httpRoute{
+	{"POST", "/login", LoginMethod, "Log in", loginRequest{}, loginResponse{}},
+	{"POST", "/logout", LogoutMethod, "Log out", nil, nil},
+	{"GET", "/me", WhoAmIMethod, "Get the person logged in", nil, Person{}},
+
+	{"POST", "/schools", CreateSchoolMethod, "Create a school", createSchoolRequest{}, School{}},
+	{"GET", "/schools", ListSchoolsMethod, "List schools", listRequest{}, pageOf[School]{}},
+	{"GET", "/schools/{id}", GetSchoolMethod, "Get a school", getRequest{}, School{}},
+	{"PATCH", "/schools/{id}", UpdateSchoolMethod, "Update a school", updateSchoolRequest{}, School{}},
+	{"DELETE", "/schools/{id}", DeleteSchoolMethod, "Delete a school", deleteSchoolRequest{}, nil},
+
+	{"POST", "/classes", CreateClassMethod, "Create a class", createClassRequest{}, Class{}},
+	{"GET", "/classes", ListClassesMethod, "List classes", listClassesRequest{}, pageOf[Class]{}},
+	{"GET", "/classes/{id}", GetClassMethod, "Get a class", getRequest{}, Class{}},
+	{"PATCH", "/classes/{id}", UpdateClassMethod, "Update a class", updateClassRequest{}, Class{}},
+	{"DELETE", "/classes/{id}", DeleteClassMethod, "Delete a class", deleteRequest{}, nil},
+	{"POST", "/classes/{class_id}/students", AddStudentToClassMethod, "Add a student to a class", classStudentRequest{}, Person{}},
+	{"DELETE", "/classes/{class_id}/students/{student_id}", RemoveStudentMethod, "Remove a student from a class", classStudentRequest{}, Person{}},
+
+	{"POST", "/people", CreatePersonMethod, "Create a person", createPersonRequest{}, Person{}},
+	{"GET", "/people", ListPeopleMethod, "List people", listRequest{}, pageOf[Person]{}},
+	{"GET", "/people/search", SearchPeopleMethod, "Search people by name", searchPeopleRequest{}, pageOf[Person]{}},
+	{"PATCH", "/people/{id}", UpdatePersonMethod, "Update a person", updatePersonRequest{}, Person{}},
+	{"DELETE", "/people/{id}", DeletePersonMethod, "Delete a person", deleteRequest{}, nil},
+	{"GET", "/people/{person_id}/roles", ListRolesMethod, "List the roles of a person", listRolesRequest{}, []roleGrant{}},
+	{"POST", "/people/{person_id}/roles", GrantRoleMethod, "Grant a role", grantRequest{}, roleGrant{}},
+	{"DELETE", "/people/{person_id}/roles", RevokeRoleMethod, "Revoke a role", grantRequest{}, roleGrant{}},
+}
+
+// startGateway serves the HTTP gateway on addr until Stop.
+func (s *server) startGateway(addr string) error {
+	mux, err := s.gatewayMux()
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.gateway = srv
+	s.mu.Unlock()
+	fmt.Println("HTTP gateway started on", ln.Addr())
+
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Println("HTTP gateway failed:", err)
+		}
+	}()
+	return nil
+}
+
+// gatewayMux routes the HTTP gateway's requests: those of every route, and
+// the OpenAPI document at /openapi.json.
+func (s *server) gatewayMux() (*http.ServeMux, error) {
+	mux := http.NewServeMux()
+	for _, route := range httpRoutes {
+		mux.Handle(route.verb+" "+route.path, s.gatewayHandler(route))
+	}
+	spec, err := json.Marshal(openAPI(httpRoutes))
+	if err != nil {
+		return nil, err
+	}
+	mux.HandleFunc("GET /openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(spec)
+	})
+	return mux, nil
+}
+
+func (s *server) stopGateway() error {
+	if s.gateway == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.gateway.Shutdown(ctx)
+}
+
+// gatewayHandler answers a route by making its request through the router,
+// as a TCP client logged in with the bearer token would.
+func (s *server) gatewayHandler(route httpRoute) http.Handler {
+	var fields map[string]reflect.Type
+	if route.request != nil {
+		fields = fieldTypes(reflect.TypeOf(route.request))
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := requestData(w, r, route, fields)
+		if err != nil {
+			writeResponse(w, errorResponse(err), http.StatusOK)
+			return
+		}
+		auth := &connAuth{}
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			auth.token = token
+		}
+
+		resp := s.router.serve(auth, Request{Method: route.method, Data: data})
+		writeResponse(w, resp, route.successStatus())
+	})
+}
+
+// requestData assembles the data of the request to a route.
+func requestData(w http.ResponseWriter, r *http.Request, route httpRoute, fields map[string]reflect.Type) (map[string]interface{}, error) {
+	data := make(map[string]interface{})
+	if r.Method == "POST" || r.Method == "PATCH" {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+		if err != nil {
+			return nil, invalidRequest("Request body is too large")
+		}
+		if len(strings.TrimSpace(string(body))) > 0 {
+			if err := json.Unmarshal(body, &data); err != nil || data == nil {
+				return nil, invalidRequest("Request body must be a JSON object")
+			}
+		}
+	}
+	for name, values := range r.URL.Query() {
+		data[name] = parseParam(values[len(values)-1], fields[name])
+	}
+	for _, name := range pathParams(route.path) {
+		data[name] = parseParam(r.PathValue(name), fields[name])
+	}
+	return data, nil
+}
+
+// parseParam converts a path or query parameter to the type of the field it
+// sets. What does not parse is passed on as text, for validation to reject.
+func parseParam(value string, t reflect.Type) interface{} {
+	if t == nil {
+		return value
+	}
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if n, err := strconv.ParseUint(value, 10, 64); err == nil {
+			return n
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return n
+		}
+	case reflect.Bool:
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	case reflect.Slice:
+		return strings.Split(value, ",")
+	}
+	return value
+}
+
+// pathParams returns the names of the wildcards of a path pattern.
+func pathParams(path string) []string {
+	var names []string
+	for _, segment := range strings.Split(path, "/") {
+		if name, ok := strings.CutPrefix(segment, "{"); ok {
+			names = append(names, strings.TrimSuffix(name, "}"))
+		}
+	}
+	return names
+}
+
+// fieldTypes returns the types of the fields of a request struct by JSON
+// name, including those of embedded structs.
+func fieldTypes(t reflect.Type) map[string]reflect.Type {
+	types := make(map[string]reflect.Type)
+	for _, field := range jsonFields(t) {
+		types[field.name] = field.Type
+	}
+	return types
+}
+
+type jsonField struct {
+	reflect.StructField
+	name      string
+	omitEmpty bool
+}
+
+// jsonFields returns the fields of struct type t that encoding/json
+// decodes, in order, with those of embedded structs in their place.
+func jsonFields(t reflect.Type) []jsonField {
+	var fields []jsonField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			fields = append(fields, jsonFields(field.Type)...)
+			continue
+		}
+		name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields = append(fields, jsonField{field, name, strings.Contains(opts, "omitempty")})
+	}
+	return fields
+}
+
+// httpStatus is the status of an error response with each code.
+var httpStatus = map[string]int{
+	codeInvalidRequest:  http.StatusBadRequest,
+	codeNotFound:        http.StatusNotFound,
+	codeConflict:        http.StatusConflict,
+	codeUnauthenticated: http.StatusUnauthorized,
+	codeForbidden:       http.StatusForbidden,
+	codeUnknownMethod:   http.StatusNotFound,
+	codeInternal:        http.StatusInternalServerError,
+}
+
+// writeResponse writes resp as the body, the same as on the TCP protocol,
+// with the status of its error code if it failed.
+func writeResponse(w http.ResponseWriter, resp Response, status int) {
+	if !resp.Status {
+		status = http.StatusBadRequest
+		if detail, ok := resp.Data.(errorDetail); ok && httpStatus[detail.Code] != 0 {
+			status = httpStatus[detail.Code]
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		fmt.Println("Failed to encode response:", err)
+	}
+}
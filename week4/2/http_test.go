@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// gatewayClient makes requests to the HTTP gateway of a test server, with
+// the bearer token of its last login.
+type gatewayClient struct {
+	t     *testing.T
+	url   string
+	token string
+}
+
+// gatewayResponse is a response whose data is decoded later, into the type
+// the route returns.
+type gatewayResponse struct {
+	Status  bool            `json:"status"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data"`
+}
+
+func newGateway(t *testing.T) *gatewayClient {
+	t.Helper()
+	s := newTestServer()
+	mux, err := s.gatewayMux()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return &gatewayClient{t: t, url: srv.URL}
+}
+
+// do sends body, if not nil, as JSON and returns the status and response.
+func (c *gatewayClient) do(verb, path string, body interface{}) (int, gatewayResponse) {
+	c.t.Helper()
+	var reader *bytes.Reader
+	switch body := body.(type) {
+	case nil:
+		reader = bytes.NewReader(nil)
+	case string:
+		reader = bytes.NewReader([]byte(body))
+	default:
+		raw, err := json.Marshal(body)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		reader = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequest(verb, c.url+path, reader)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var decoded gatewayResponse
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		c.t.Fatalf("%s %s: %v", verb, path, err)
+	}
+	return resp.StatusCode, decoded
+}
+
+// expect makes a request that must answer with status, and decodes its data
+// into v unless v is nil.
+func (c *gatewayClient) expect(status int, verb, path string, body, v interface{}) {
+	c.t.Helper()
+	got, resp := c.do(verb, path, body)
+	if got != status {
+		c.t.Fatalf("%s %s: status %d (%s), want %d", verb, path, got, resp.Message, status)
+	}
+	if v != nil {
+		if err := json.Unmarshal(resp.Data, v); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+}
+
+// loginAdmin creates the platform admin and logs the client in as them.
+func (c *gatewayClient) loginAdmin() uint {
+	c.t.Helper()
+	var admin entity
+	c.expect(http.StatusCreated, "POST", "/people", map[string]interface{}{"name": "admin", "age": 40, "password": "admin password"}, &admin)
+	var login struct {
+		Token string `json:"token"`
+	}
+	c.expect(http.StatusOK, "POST", "/login", map[string]interface{}{"id": admin.Id, "password": "admin password"}, &login)
+	c.token = login.Token
+	return admin.Id
+}
+
+func TestGatewaySessions(t *testing.T) {
+	c := newGateway(t)
+	c.expect(http.StatusUnauthorized, "GET", "/me", nil, nil)
+	admin := c.loginAdmin()
+
+	var me entity
+	c.expect(http.StatusOK, "GET", "/me", nil, &me)
+	if me.Id != admin {
+		t.Fatalf("GET /me returned %d, want %d", me.Id, admin)
+	}
+	c.expect(http.StatusUnauthorized, "POST", "/login", map[string]interface{}{"id": admin, "password": "wrong"}, nil)
+	c.expect(http.StatusOK, "POST", "/logout", nil, nil)
+	c.expect(http.StatusUnauthorized, "GET", "/me", nil, nil)
+	c.expect(http.StatusUnauthorized, "POST", "/schools", map[string]interface{}{"name": "A"}, nil)
+}
+
+func TestGatewaySchools(t *testing.T) {
+	c := newGateway(t)
+	c.loginAdmin()
+
+	var school entity
+	c.expect(http.StatusCreated, "POST", "/schools", map[string]interface{}{"name": "A"}, &school)
+	c.expect(http.StatusCreated, "POST", "/schools", map[string]interface{}{"name": "B"}, nil)
+	path := fmt.Sprint("/schools/", school.Id)
+
+	c.expect(http.StatusOK, "PATCH", path, map[string]interface{}{"name": "Renamed"}, nil)
+	var got entity
+	c.expect(http.StatusOK, "GET", path+"?fields=name", nil, &got)
+	if got.Name != "Renamed" || got.Id != 0 {
+		t.Fatalf("GET %s?fields=name returned %+v, want only the new name", path, got)
+	}
+
+	// Query parameters are converted to the types of the request's fields.
+	var page pageOf[entity]
+	c.expect(http.StatusOK, "GET", "/schools?limit=1&sort=-name", nil, &page)
+	if len(page.Items) != 1 || page.Items[0].Name != "Renamed" || page.NextCursor == "" {
+		t.Fatalf("first page %+v", page)
+	}
+	var last pageOf[entity]
+	c.expect(http.StatusOK, "GET", "/schools?limit=1&sort=-name&cursor="+page.NextCursor, nil, &last)
+	if len(last.Items) != 1 || last.Items[0].Name != "B" || last.NextCursor != "" {
+		t.Fatalf("second page %+v", last)
+	}
+
+	c.expect(http.StatusOK, "DELETE", path, nil, nil)
+	c.expect(http.StatusNotFound, "GET", path, nil, nil)
+	c.expect(http.StatusBadRequest, "GET", "/schools/first", nil, nil)
+	c.expect(http.StatusBadRequest, "GET", "/schools?limit=many", nil, nil)
+}
+
+func TestGatewayClasses(t *testing.T) {
+	c := newGateway(t)
+	c.loginAdmin()
+	var school, teacher, student, class entity
+	c.expect(http.StatusCreated, "POST", "/schools", map[string]interface{}{"name": "A"}, &school)
+	c.expect(http.StatusCreated, "POST", "/people", map[string]interface{}{"name": "teacher", "age": 40}, &teacher)
+	c.expect(http.StatusCreated, "POST", "/people", map[string]interface{}{"name": "student", "age": 12}, &student)
+	c.expect(http.StatusCreated, "POST", "/classes", map[string]interface{}{"name": "a", "school_id": school.Id, "teacher": map[string]interface{}{"id": teacher.Id}}, &class)
+
+	students := fmt.Sprintf("/classes/%d/students", class.Id)
+	c.expect(http.StatusOK, "POST", students, map[string]interface{}{"student_id": student.Id}, nil)
+	c.expect(http.StatusConflict, "POST", students, map[string]interface{}{"student_id": student.Id}, nil)
+
+	var listed pageOf[jsonClass]
+	c.expect(http.StatusOK, "GET", fmt.Sprint("/classes?school_id=", school.Id), nil, &listed)
+	if len(listed.Items) != 1 || len(listed.Items[0].Students) != 1 || listed.Items[0].Students[0].Id != student.Id {
+		t.Fatalf("classes of the school %+v, want the class with its student", listed.Items)
+	}
+
+	c.expect(http.StatusOK, "DELETE", fmt.Sprintf("%s/%d", students, student.Id), nil, nil)
+	c.expect(http.StatusOK, "PATCH", fmt.Sprint("/classes/", class.Id), map[string]interface{}{"name": "b"}, nil)
+	var got jsonClass
+	c.expect(http.StatusOK, "GET", fmt.Sprint("/classes/", class.Id), nil, &got)
+	if got.Name != "b" || len(got.Students) != 0 || got.Teacher.Id != teacher.Id {
+		t.Fatalf("class %+v, want it renamed and without students", got)
+	}
+	c.expect(http.StatusOK, "DELETE", fmt.Sprint("/classes/", class.Id), nil, nil)
+	c.expect(http.StatusNotFound, "GET", fmt.Sprint("/classes/", class.Id), nil, nil)
+}
+
+func TestGatewayPeopleAndRoles(t *testing.T) {
+	c := newGateway(t)
+	c.loginAdmin()
+	var school, person entity
+	c.expect(http.StatusCreated, "POST", "/schools", map[string]interface{}{"name": "A"}, &school)
+	c.expect(http.StatusCreated, "POST", "/people", map[string]interface{}{"name": "Sara", "age": 30}, &person)
+	path := fmt.Sprint("/people/", person.Id)
+
+	c.expect(http.StatusOK, "PATCH", path, map[string]interface{}{"age": 31}, nil)
+	var found pageOf[jsonPerson]
+	c.expect(http.StatusOK, "GET", "/people/search?name=sar", nil, &found)
+	if len(found.Items) != 1 || found.Items[0].Age != 31 {
+		t.Fatalf("search found %+v, want Sara aged 31", found.Items)
+	}
+	var everyone pageOf[entity]
+	c.expect(http.StatusOK, "GET", "/people", nil, &everyone)
+	if len(everyone.Items) != 2 {
+		t.Fatalf("listed %d people, want 2", len(everyone.Items))
+	}
+
+	roles := path + "/roles"
+	grant := map[string]interface{}{"role": roleSchoolAdmin, "school_id": school.Id}
+	c.expect(http.StatusOK, "POST", roles, grant, nil)
+	var granted []roleGrant
+	c.expect(http.StatusOK, "GET", roles, nil, &granted)
+	if len(granted) != 1 || granted[0].Role != roleSchoolAdmin || granted[0].SchoolId != school.Id {
+		t.Fatalf("roles %+v, want school admin of %d", granted, school.Id)
+	}
+	// DELETE takes its data from the query.
+	c.expect(http.StatusOK, "DELETE", fmt.Sprintf("%s?role=%s&school_id=%d", roles, roleSchoolAdmin, school.Id), nil, nil)
+	c.expect(http.StatusOK, "GET", roles, nil, &granted)
+	if len(granted) != 0 {
+		t.Fatalf("roles %+v after revoking, want none", granted)
+	}
+
+	c.expect(http.StatusOK, "DELETE", path, nil, nil)
+	c.expect(http.StatusNotFound, "PATCH", path, map[string]interface{}{"age": 32}, nil)
+}
+
+func TestGatewayRejectsBadBodies(t *testing.T) {
+	c := newGateway(t)
+	c.loginAdmin()
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"not JSON", "{", http.StatusBadRequest},
+		{"not an object", "[1]", http.StatusBadRequest},
+		{"null", "null", http.StatusBadRequest},
+		{"unknown field", `{"name": "A", "motto": "x"}`, http.StatusBadRequest},
+		{"too large", `{"name": "` + strings.Repeat("a", maxBodySize) + `"}`, http.StatusBadRequest},
+		{"valid", `{"name": "A"}`, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		if status, resp := c.do("POST", "/schools", tt.body); status != tt.want {
+			t.Errorf("%s: status %d (%s), want %d", tt.name, status, resp.Message, tt.want)
+		}
+	}
+}
+
+// The OpenAPI document describes every method of the router, each under the
+// path and verb of its route.
+func TestOpenAPIListsEveryMethod(t *testing.T) {
+	c := newGateway(t)
+	var doc struct {
+		OpenAPI string `json:"openapi"`
+		Paths   map[string]map[string]struct {
+			OperationId string `json:"operationId"`
+		} `json:"paths"`
+	}
+	resp, err := http.Get(c.url + "/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.OpenAPI == "" {
+		t.Fatal("document has no openapi version")
+	}
+
+	documented := make(map[string]string)
+	for path, operations := range doc.Paths {
+		for verb, op := range operations {
+			documented[op.OperationId] = strings.ToUpper(verb) + " " + path
+		}
+	}
+	routes := make(map[string]httpRoute)
+	for _, route := range httpRoutes {
+		routes[route.method] = route
+	}
+	for _, method := range newTestServer().router.methods() {
+		route, ok := routes[method]
+		if !ok {
+			t.Errorf("method %s has no HTTP route", method)
+			continue
+		}
+		if got, want := documented[operationId(method)], route.verb+" "+route.path; got != want {
+			t.Errorf("method %s documented at %q, want %q", method, got, want)
+		}
+	}
+	if len(documented) != len(httpRoutes) {
+		t.Errorf("document has %d operations, want %d", len(documented), len(httpRoutes))
+	}
+}
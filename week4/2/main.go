@@ -4,6 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"net/http"
+	"os"
+	"sync"
 )
 
 const (
@@ -12,6 +15,24 @@ const (
 	CreatePersonMethod      = "/person/create"
 	AddStudentToClassMethod = "/class/add/student"
 	WhoAmIMethod            = "/who/am/i"
+	LoginMethod             = "/login"
+	LogoutMethod            = "/logout"
+	GrantRoleMethod         = "/role/grant"
+	RevokeRoleMethod        = "/role/revoke"
+	ListRolesMethod         = "/role/list"
+	GetSchoolMethod         = "/school/get"
+	ListSchoolsMethod       = "/school/list"
+	GetClassMethod          = "/class/get"
+	ListClassesMethod       = "/class/list"
+	ListPeopleMethod        = "/person/list"
+	SearchPeopleMethod      = "/person/search"
+	UpdateSchoolMethod      = "/school/update"
+	DeleteSchoolMethod      = "/school/delete"
+	UpdatePersonMethod      = "/person/update"
+	DeletePersonMethod      = "/person/delete"
+	UpdateClassMethod       = "/class/update"
+	DeleteClassMethod       = "/class/delete"
+	RemoveStudentMethod     = "/class/remove/student"
 )
 
 type Server interface {
@@ -20,36 +41,49 @@ type Server interface {
 }
 
 type server struct {
-	listener        net.Listener
-	schools         map[uint]School
-	people          map[uint]Person
-	classes         map[uint]Class
-	schoolIdCounter uint
-	personIdCounter uint
-	classIdCounter  uint
+	mu       sync.Mutex
+	listener net.Listener
+	repo     repository
+	sessions *sessionStore
+	router   *router
+	gateway  *http.Server
 }
 
 func NewServer() Server {
-	return &server{
-		schools:         make(map[uint]School),
-		people:          make(map[uint]Person),
-		classes:         make(map[uint]Class),
-		schoolIdCounter: 1,
-		personIdCounter: 1,
-		classIdCounter:  1,
-	}
+	s := &server{sessions: newSessionStore()}
+	s.router = s.routes()
+	return s
 }
 
 func (s *server) Start(port string) error {
+	repo, err := openRepository()
+	if err != nil {
+		return err
+	}
+	if err := bootstrapPlatformAdmin(repo); err != nil {
+		repo.close()
+		return err
+	}
 	ln, err := net.Listen("tcp", ":"+port)
 	if err != nil {
+		repo.close()
 		return err
 	}
+	s.mu.Lock()
 	s.listener = ln
+	s.repo = repo
+	s.mu.Unlock()
 	fmt.Println("Server started on port", port)
 
+	if addr := os.Getenv(httpAddrEnv); addr != "" {
+		if err := s.startGateway(addr); err != nil {
+			s.Stop()
+			return err
+		}
+	}
+
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
 			if opErr, ok := err.(*net.OpError); ok && opErr.Err.Error() == "use of closed network connection" {
 				fmt.Println("Server stopped")
@@ -62,9 +96,19 @@ func (s *server) Start(port string) error {
 }
 
 func (s *server) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	if s.listener != nil {
 		fmt.Println("Stopping server...")
-		return s.listener.Close()
+		err := s.listener.Close()
+		if gatewayErr := s.stopGateway(); err == nil {
+			err = gatewayErr
+		}
+		if closeErr := s.repo.close(); err == nil {
+			err = closeErr
+		}
+		return err
 	}
 	return nil
 }
@@ -73,6 +117,7 @@ func (s *server) handleConnection(conn net.Conn) {
 	defer conn.Close()
 	decoder := json.NewDecoder(conn)
 	encoder := json.NewEncoder(conn)
+	auth := &connAuth{}
 
 	for {
 		var req Request
@@ -81,22 +126,7 @@ func (s *server) handleConnection(conn net.Conn) {
 			return
 		}
 
-		var resp Response
-		switch req.Method {
-		case CreateSchoolMethod:
-			resp = s.createSchool(req.Data)
-		case CreateClassMethod:
-			resp = s.createClass(req.Data)
-		case CreatePersonMethod:
-			resp = s.createPerson(req.Data)
-		case AddStudentToClassMethod:
-			resp = s.addStudentToClass(req.Data)
-		case WhoAmIMethod:
-			resp = s.whoAmI(req.Data)
-		default:
-			resp = Response{Status: false, Message: "Invalid method"}
-		}
-
+		resp := s.router.serve(auth, req)
 		if err := encoder.Encode(&resp); err != nil {
 			fmt.Println("Failed to encode response:", err)
 			return
@@ -104,165 +134,262 @@ func (s *server) handleConnection(conn net.Conn) {
 	}
 }
 
-func (s *server) createSchool(data interface{}) Response {
-	var school School
-	if !s.decodeRequest(data, &school) {
-		return Response{Status: false, Message: "Invalid school data"}
+// routes registers the handler of every method, wrapped in the middleware
+// all requests go through.
+func (s *server) routes() *router {
+	rt := newRouter()
+	rt.use(logRequests, timeRequests, recoverPanics, validateData, s.authorizeRequests)
+
+	rt.handle(CreateSchoolMethod, withData(s.createSchool))
+	rt.handle(CreateClassMethod, withData(s.createClass))
+	rt.handle(CreatePersonMethod, withData(s.createPerson))
+	rt.handle(AddStudentToClassMethod, withData(s.addStudentToClass))
+	rt.handle(WhoAmIMethod, withAuth(s.whoAmI))
+	rt.handle(LoginMethod, s.login)
+	rt.handle(LogoutMethod, withAuth(s.logout))
+	rt.handle(GrantRoleMethod, withData(s.grantRole))
+	rt.handle(RevokeRoleMethod, withData(s.revokeRole))
+	rt.handle(ListRolesMethod, withData(s.listRoles))
+	rt.handle(GetSchoolMethod, withData(s.getSchool))
+	rt.handle(ListSchoolsMethod, withData(s.listSchools))
+	rt.handle(GetClassMethod, withData(s.getClass))
+	rt.handle(ListClassesMethod, withData(s.listClasses))
+	rt.handle(ListPeopleMethod, withData(s.listPeople))
+	rt.handle(SearchPeopleMethod, withData(s.searchPeople))
+	rt.handle(UpdateSchoolMethod, withData(s.updateSchool))
+	rt.handle(DeleteSchoolMethod, withData(s.deleteSchool))
+	rt.handle(UpdatePersonMethod, s.updatePerson)
+	rt.handle(DeletePersonMethod, withData(s.deletePerson))
+	rt.handle(UpdateClassMethod, withData(s.updateClass))
+	rt.handle(DeleteClassMethod, withData(s.deleteClass))
+	rt.handle(RemoveStudentMethod, withData(s.removeStudentFromClass))
+	return rt
+}
+
+// Clients may send a whole school, person or class to create one, so the
+// create requests accept the fields the server sets, and ignore them.
+type (
+	createSchoolRequest struct {
+		Name    string          `json:"name" validate:"required,max=100"`
+		Id      json.RawMessage `json:"id"`
+		Classes json.RawMessage `json:"classes"`
+	}
+	createPersonRequest struct {
+		Name string `json:"name" validate:"required,max=100"`
+		Age  int    `json:"age" validate:"min=0,max=150"`
+		// Password lets the person log in.
+		Password string          `json:"password"`
+		Id       json.RawMessage `json:"id"`
+		Classes  json.RawMessage `json:"classes"`
+	}
+	createClassRequest struct {
+		Name     string          `json:"name" validate:"required,max=100"`
+		SchoolId uint            `json:"school_id" validate:"required"`
+		Teacher  personRef       `json:"teacher"`
+		Id       json.RawMessage `json:"id"`
+		Students json.RawMessage `json:"students"`
+	}
+	// personRef refers to a person by Id.
+	personRef struct {
+		Id      uint            `json:"id" validate:"required"`
+		Name    json.RawMessage `json:"name"`
+		Age     json.RawMessage `json:"age"`
+		Classes json.RawMessage `json:"classes"`
+	}
+	classStudentRequest struct {
+		ClassId   uint `json:"class_id" validate:"required"`
+		StudentId uint `json:"student_id" validate:"required"`
 	}
+)
 
-	school.Id = s.schoolIdCounter
-	s.schoolIdCounter++
-	s.schools[school.Id] = school
+func (s *server) createSchool(data interface{}) Response {
+	var req createSchoolRequest
+	if err := s.decodeRequest(data, &req); err != nil {
+		return errorResponse(err)
+	}
 
+	school, err := s.repo.createSchool(schoolRecord{Name: req.Name})
+	if err != nil {
+		return errorResponse(err)
+	}
 	return Response{Status: true, Message: "School created successfully", Data: school}
 }
 
+// createPerson creates a person, who can log in if a password is given.
 func (s *server) createPerson(data interface{}) Response {
-	var person Person
-	if !s.decodeRequest(data, &person) {
-		return Response{Status: false, Message: "Invalid person data"}
+	var req createPersonRequest
+	if err := s.decodeRequest(data, &req); err != nil {
+		return errorResponse(err)
 	}
 
-	person.Id = s.personIdCounter
-	s.personIdCounter++
-	s.people[person.Id] = person
+	record := personRecord{Name: req.Name, Age: req.Age}
+	if req.Password != "" {
+		hash, err := hashPassword(req.Password)
+		if err != nil {
+			return errorResponse(err)
+		}
+		record.PasswordHash = hash
+	}
 
+	person, err := s.repo.createPerson(record)
+	if err != nil {
+		return errorResponse(err)
+	}
 	return Response{Status: true, Message: "Person created successfully", Data: person}
 }
 
 func (s *server) createClass(data interface{}) Response {
-	var class Class
-	if !s.decodeRequest(data, &class) {
-		return Response{Status: false, Message: "Invalid class data"}
-	}
-
-	if _, exists := s.schools[class.SchoolId]; !exists {
-		return Response{Status: false, Message: "School not found"}
+	var req createClassRequest
+	if err := s.decodeRequest(data, &req); err != nil {
+		return errorResponse(err)
 	}
 
-	teacher, exists := s.people[class.Teacher.Id]
-	if !exists || s.teacherIsStudent(teacher.Id) {
-		return Response{Status: false, Message: "Invalid or conflicting teacher"}
+	class, err := s.repo.createClass(classRecord{Name: req.Name, SchoolId: req.SchoolId, TeacherId: req.Teacher.Id})
+	if err != nil {
+		return errorResponse(err)
 	}
-
-	class.Id = s.classIdCounter
-	s.classIdCounter++
-	teacher.Classes = append(teacher.Classes, class.Id)
-	class.Teacher = teacher
-
-	s.updateTeacherClasses(teacher)
-	s.people[teacher.Id] = teacher
-	s.classes[class.Id] = class
-
-	school := s.schools[class.SchoolId]
-	school.Classes = append(school.Classes, class)
-	s.schools[class.SchoolId] = school
-
-	class.Teacher.Classes = nil
 	return Response{Status: true, Message: "Class created successfully", Data: class}
 }
 
 func (s *server) addStudentToClass(data interface{}) Response {
-	var req AddStudentToClassReq
-	if !s.decodeRequest(data, &req) {
-		return Response{Status: false, Message: "Invalid request data"}
+	var req classStudentRequest
+	if err := s.decodeRequest(data, &req); err != nil {
+		return errorResponse(err)
 	}
 
-	class, classExists := s.classes[req.ClassId]
-	if !classExists {
-		return Response{Status: false, Message: "Class not found"}
+	student, err := s.repo.addStudentToClass(req.ClassId, req.StudentId)
+	if err != nil {
+		return errorResponse(err)
 	}
+	return Response{Status: true, Message: "Student added to class", Data: student}
+}
 
-	student, studentExists := s.people[req.StudentId]
-	if !studentExists || s.isInOtherSchoolClasses(student.Id, class.SchoolId) {
-		return Response{Status: false, Message: "Student conflict or not found"}
+func (s *server) removeStudentFromClass(data interface{}) Response {
+	var req classStudentRequest
+	if err := s.decodeRequest(data, &req); err != nil {
+		return errorResponse(err)
 	}
 
-	if s.isAlreadyInClass(student.Id, class.Id) {
-		return Response{Status: false, Message: "Student already in this class"}
+	student, err := s.repo.removeStudentFromClass(req.ClassId, req.StudentId)
+	if err != nil {
+		return errorResponse(err)
 	}
+	return Response{Status: true, Message: "Student removed from class", Data: student}
+}
 
-	student.Classes = append(student.Classes, class.Id)
-	class.Students = append(class.Students, student)
+type (
+	updateSchoolRequest struct {
+		Id uint `json:"id" validate:"required"`
+		schoolUpdate
+	}
+	updatePersonRequest struct {
+		Id uint `json:"id" validate:"required"`
+		personUpdate
+		Password *string `json:"password"`
+		// OldPassword must be given by people changing their own password,
+		// unless they are platform admins.
+		OldPassword *string `json:"old_password"`
+	}
+	updateClassRequest struct {
+		Id uint `json:"id" validate:"required"`
+		classUpdate
+	}
+	deleteRequest struct {
+		Id uint `json:"id" validate:"required"`
+	}
+	// deleteSchoolRequest deletes a school's classes along with it if
+	// Cascade is set, and fails if it has any otherwise.
+	deleteSchoolRequest struct {
+		Id      uint `json:"id" validate:"required"`
+		Cascade bool `json:"cascade"`
+	}
+)
 
-	s.people[student.Id] = student
-	s.classes[class.Id] = class
-	s.updateClassInSchool(class)
+func (s *server) updateSchool(data interface{}) Response {
+	var req updateSchoolRequest
+	if err := s.decodeRequest(data, &req); err != nil {
+		return errorResponse(err)
+	}
 
-	return Response{Status: true, Message: "Student added to class", Data: student}
+	school, err := s.repo.updateSchool(req.Id, req.schoolUpdate)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return Response{Status: true, Message: "School updated successfully", Data: school}
 }
 
-func (s *server) whoAmI(data interface{}) Response {
-	var person Person
-	if !s.decodeRequest(data, &person) {
-		return Response{Status: false, Message: "Invalid person data"}
+func (s *server) deleteSchool(data interface{}) Response {
+	var req deleteSchoolRequest
+	if err := s.decodeRequest(data, &req); err != nil {
+		return errorResponse(err)
 	}
 
-	actualPerson, exists := s.people[person.Id]
-	if !exists {
-		return Response{Status: false, Message: "Person not found"}
+	if err := s.repo.deleteSchool(req.Id, req.Cascade); err != nil {
+		return errorResponse(err)
 	}
-
-	return Response{Status: true, Message: "Person found", Data: actualPerson}
+	return Response{Status: true, Message: "School deleted successfully"}
 }
 
-func (s *server) teacherIsStudent(teacherId uint) bool {
-	for _, class := range s.classes {
-		for _, student := range class.Students {
-			if student.Id == teacherId {
-				return true
+func (s *server) updatePerson(auth *connAuth, data interface{}) Response {
+	var req updatePersonRequest
+	if err := s.decodeRequest(data, &req); err != nil {
+		return errorResponse(err)
+	}
+	if req.Password != nil {
+		if err := s.checkOldPassword(auth, req.Id, req.OldPassword); err != nil {
+			return errorResponse(err)
+		}
+		// An empty password removes the person's ability to log in.
+		var hash string
+		if *req.Password != "" {
+			var err error
+			if hash, err = hashPassword(*req.Password); err != nil {
+				return errorResponse(err)
 			}
 		}
+		req.PasswordHash = &hash
 	}
-	return false
-}
 
-func (s *server) isInOtherSchoolClasses(studentId, schoolId uint) bool {
-	for _, class := range s.classes {
-		if class.SchoolId != schoolId {
-			for _, student := range class.Students {
-				if student.Id == studentId {
-					return true
-				}
-			}
-		}
+	person, err := s.repo.updatePerson(req.Id, req.personUpdate)
+	if err != nil {
+		return errorResponse(err)
 	}
-	return false
+	return Response{Status: true, Message: "Person updated successfully", Data: person}
 }
 
-func (s *server) isAlreadyInClass(studentId, classId uint) bool {
-	for _, studentClasses := range s.people[studentId].Classes {
-		if studentClasses == classId {
-			return true
-		}
+func (s *server) deletePerson(data interface{}) Response {
+	var req deleteRequest
+	if err := s.decodeRequest(data, &req); err != nil {
+		return errorResponse(err)
 	}
-	return false
-}
 
-func (s *server) updateTeacherClasses(teacher Person) {
-	for id, existingClass := range s.classes {
-		if existingClass.Teacher.Id == teacher.Id {
-			existingClass.Teacher.Classes = teacher.Classes
-			s.classes[id] = existingClass
-		}
+	if err := s.repo.deletePerson(req.Id); err != nil {
+		return errorResponse(err)
 	}
+	return Response{Status: true, Message: "Person deleted successfully"}
 }
 
-func (s *server) updateClassInSchool(class Class) {
-	school := s.schools[class.SchoolId]
-	for i := range school.Classes {
-		if school.Classes[i].Id == class.Id {
-			school.Classes[i] = class
-			break
-		}
+func (s *server) updateClass(data interface{}) Response {
+	var req updateClassRequest
+	if err := s.decodeRequest(data, &req); err != nil {
+		return errorResponse(err)
 	}
-	s.schools[class.SchoolId] = school
-}
 
-func (s *server) decodeRequest(data, v interface{}) bool {
-	reqData, err := json.Marshal(data)
+	class, err := s.repo.updateClass(req.Id, req.classUpdate)
 	if err != nil {
-		return false
+		return errorResponse(err)
+	}
+	return Response{Status: true, Message: "Class updated successfully", Data: class}
+}
+
+func (s *server) deleteClass(data interface{}) Response {
+	var req deleteRequest
+	if err := s.decodeRequest(data, &req); err != nil {
+		return errorResponse(err)
+	}
+
+	if err := s.repo.deleteClass(req.Id); err != nil {
+		return errorResponse(err)
 	}
-	return json.Unmarshal(reqData, v) == nil
+	return Response{Status: true, Message: "Class deleted successfully"}
 }
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pageOf describes the data of a list response of T. Lists are built as
+// listPage, whose items are left untyped so that fields can be selected.
+type pageOf[T any] struct {
+	Items      []T    `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+type schema = map[string]interface{}
+
+// openAPI generates the OpenAPI 3 document of the HTTP gateway from the
+// request and response types of its routes.
+func openAPI(routes []httpRoute) schema {
+	b := &schemaBuilder{components: make(map[string]schema)}
+	errorSchema := envelope(b.schema(reflect.TypeOf(errorDetail{})))
+
+	paths := make(map[string]schema)
+	for _, route := range routes {
+		if paths[route.path] == nil {
+			paths[route.path] = make(schema)
+		}
+		paths[route.path][strings.ToLower(route.verb)] = b.operation(route, errorSchema)
+	}
+
+	return schema{
+		"openapi": "3.0.3",
+		"info": schema{
+			"title":   "School service",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": schema{
+			"schemas": b.components,
+			"securitySchemes": schema{
+				"bearer": schema{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+func (b *schemaBuilder) operation(route httpRoute, errorSchema schema) schema {
+	op := schema{
+		"operationId": operationId(route.method),
+		"summary":     route.summary,
+	}
+	if _, ok := policies[route.method]; ok {
+		op["security"] = []schema{{"bearer": []string{}}}
+	}
+
+	var parameters []schema
+	inPath := make(map[string]bool)
+	for _, name := range pathParams(route.path) {
+		inPath[name] = true
+	}
+	if route.request != nil {
+		t := reflect.TypeOf(route.request)
+		for _, field := range jsonFields(t) {
+			switch {
+			case inPath[field.name]:
+				parameters = append(parameters, schema{"name": field.name, "in": "path", "required": true, "schema": b.fieldSchema(field)})
+			case route.verb == "GET" || route.verb == "DELETE":
+				param := schema{"name": field.name, "in": "query", "schema": b.fieldSchema(field)}
+				if isRequired(field) {
+					param["required"] = true
+				}
+				if field.Type.Kind() == reflect.Slice {
+					param["explode"] = false
+				}
+				parameters = append(parameters, param)
+			}
+		}
+		if route.verb == "POST" || route.verb == "PATCH" {
+			body := b.schema(t)
+			if len(inPath) > 0 {
+				body = b.structSchema(t, inPath)
+			}
+			op["requestBody"] = schema{
+				"required": true,
+				"content":  schema{"application/json": schema{"schema": body}},
+			}
+		}
+	}
+	if parameters != nil {
+		op["parameters"] = parameters
+	}
+
+	var data schema
+	if route.response != nil {
+		data = b.schema(reflect.TypeOf(route.response))
+	}
+	op["responses"] = schema{
+		strconv.Itoa(route.successStatus()): schema{
+			"description": "Success",
+			"content":     schema{"application/json": schema{"schema": envelope(data)}},
+		},
+		"default": schema{
+			"description": "Error, with its code in data",
+			"content":     schema{"application/json": schema{"schema": errorSchema}},
+		},
+	}
+	return op
+}
+
+// operationId turns a method such as /class/add/student into classAddStudent.
+func operationId(method string) string {
+	words := strings.Split(strings.Trim(method, "/"), "/")
+	for i := 1; i < len(words); i++ {
+		words[i] = strings.ToUpper(words[i][:1]) + words[i][1:]
+	}
+	return strings.Join(words, "")
+}
+
+// envelope is the schema of a response with data.
+func envelope(data schema) schema {
+	properties := schema{
+		"status":  schema{"type": "boolean"},
+		"message": schema{"type": "string"},
+	}
+	if data != nil {
+		properties["data"] = data
+	}
+	return schema{"type": "object", "properties": properties, "required": []string{"status", "message"}}
+}
+
+// schemaBuilder generates the schemas of Go types. Named structs become
+// components, referred to by name.
+type schemaBuilder struct {
+	components map[string]schema
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+func (b *schemaBuilder) schema(t reflect.Type) schema {
+	switch {
+	case t == timeType:
+		return schema{"type": "string", "format": "date-time"}
+	case t == rawMessageType:
+		return schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return b.schema(t.Elem())
+	case reflect.String:
+		return schema{"type": "string"}
+	case reflect.Bool:
+		return schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return schema{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return schema{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return schema{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return schema{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return schema{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.structSchema(t, nil)
+		}
+		name := componentName(t)
+		if _, exists := b.components[name]; !exists {
+			// Reserve the name first, in case the type refers to itself.
+			b.components[name] = schema{}
+			b.components[name] = b.structSchema(t, nil)
+		}
+		return schema{"$ref": "#/components/schemas/" + name}
+	default:
+		return schema{}
+	}
+}
+
+// componentName names the component of a type, such as pageOfSchool for
+// pageOf[School].
+func componentName(t reflect.Type) string {
+	name, arg, generic := strings.Cut(t.Name(), "[")
+	if generic {
+		arg = strings.TrimSuffix(arg, "]")
+		name += arg[strings.LastIndex(arg, ".")+1:]
+	}
+	return name
+}
+
+// structSchema generates the schema of a struct, leaving out the fields in
+// omit. Fields a request accepts only to ignore them are left out too.
+func (b *schemaBuilder) structSchema(t reflect.Type, omit map[string]bool) schema {
+	properties := make(schema)
+	var required []string
+	for _, field := range jsonFields(t) {
+		if omit[field.name] || field.Type == rawMessageType {
+			continue
+		}
+		properties[field.name] = b.fieldSchema(field)
+		if isRequired(field) {
+			required = append(required, field.name)
+		}
+	}
+	s := schema{"type": "object", "properties": properties}
+	if required != nil {
+		s["required"] = required
+	}
+	return s
+}
+
+// fieldSchema generates the schema of a field, with the rules of its
+// validate tag.
+func (b *schemaBuilder) fieldSchema(field jsonField) schema {
+	s := b.schema(field.Type)
+	if _, isRef := s["$ref"]; isRef {
+		return s
+	}
+
+	t := field.Type
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	for _, rule := range strings.Split(field.Tag.Get("validate"), ",") {
+		name, arg, _ := strings.Cut(rule, "=")
+		switch name {
+		case "required":
+			if t.Kind() == reflect.String {
+				s["minLength"] = 1
+			}
+		case "min", "max":
+			limit, _ := strconv.Atoi(arg)
+			s[limitKeyword(name, t.Kind())] = limit
+		case "oneof":
+			s["enum"] = strings.Fields(arg)
+		}
+	}
+	return s
+}
+
+func limitKeyword(rule string, kind reflect.Kind) string {
+	switch kind {
+	case reflect.String:
+		return rule + "Length"
+	case reflect.Slice, reflect.Array:
+		return rule + "Items"
+	}
+	return rule + "imum"
+}
+
+// isRequired reports whether a request must set field. Pointer fields are
+// optional whatever their rules.
+func isRequired(field jsonField) bool {
+	if field.Type.Kind() == reflect.Pointer {
+		return false
+	}
+	for _, rule := range strings.Split(field.Tag.Get("validate"), ",") {
+		if rule == "required" {
+			return true
+		}
+	}
+	return false
+}
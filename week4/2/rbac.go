@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+type role string
+
+// Platform and school admins are granted their roles. Teachers and students
+// have theirs in the schools of the classes they teach or attend.
+const (
+	rolePlatformAdmin role = "platform_admin"
+	roleSchoolAdmin   role = "school_admin"
+	roleTeacher       role = "teacher"
+	roleStudent       role = "student"
+)
+
+var (
+	errNotLoggedIn = requestError{codeUnauthenticated, "Not logged in"}
+	errForbidden   = requestError{codeForbidden, "Permission denied"}
+)
+
+// platformAdminEnv names the environment variable holding the ID of a
+// person to make platform admin when the server starts, for stores whose
+// first person was not created by this server.
+const platformAdminEnv = "SCHOOL_PLATFORM_ADMIN"
+
+// bootstrapPlatformAdmin grants the platform admin role to the person
+// platformAdminEnv names, if it is set.
+func bootstrapPlatformAdmin(repo repository) error {
+	value := os.Getenv(platformAdminEnv)
+	if value == "" {
+		return nil
+	}
+	id, err := strconv.ParseUint(value, 10, 0)
+	if err != nil {
+		return fmt.Errorf("%s: invalid person id %q", platformAdminEnv, value)
+	}
+	err = repo.grantRole(roleGrant{PersonId: uint(id), Role: rolePlatformAdmin})
+	switch {
+	case errors.Is(err, errRoleAlreadyGranted):
+		return nil
+	case err != nil:
+		return fmt.Errorf("%s: %w", platformAdminEnv, err)
+	}
+	fmt.Println("Person", id, "is now a platform admin")
+	return nil
+}
+
+// access is what a person may do, from all the roles they have.
+type access struct {
+	personId      uint
+	platformAdmin bool
+	// The schools the person administers, and the classes they teach.
+	schoolAdmin map[uint]bool
+	teaches     map[uint]bool
+}
+
+func (a access) administers(schoolId uint) bool {
+	return a.platformAdmin || a.schoolAdmin[schoolId]
+}
+
+// target is what a request refers to, as far as policies are concerned.
+type target struct {
+	Id       uint `json:"id"`
+	SchoolId uint `json:"school_id"`
+	ClassId  uint `json:"class_id"`
+	Role     role `json:"role"`
+}
+
+// policy decides whether the person with access may make a request about
+// t.
+type policy func(s *server, a access, t target) error
+
+// policies holds the policy of every method that needs a logged in caller.
+// The others are open to everyone: creating a person, so that people can
+// sign up, and the methods that log in and out.
+var policies = map[string]policy{
+	GetSchoolMethod:         anyone,
+	ListSchoolsMethod:       anyone,
+	GetClassMethod:          anyone,
+	ListClassesMethod:       anyone,
+	ListPeopleMethod:        anyone,
+	SearchPeopleMethod:      anyone,
+	ListRolesMethod:         anyone,
+	CreateSchoolMethod:      platformAdmin,
+	DeleteSchoolMethod:      platformAdmin,
+	DeletePersonMethod:      platformAdmin,
+	UpdateSchoolMethod:      schoolAdmin(func(t target) uint { return t.Id }),
+	CreateClassMethod:       schoolAdmin(func(t target) uint { return t.SchoolId }),
+	UpdateClassMethod:       classSchoolAdmin(func(t target) uint { return t.Id }),
+	DeleteClassMethod:       classSchoolAdmin(func(t target) uint { return t.Id }),
+	AddStudentToClassMethod: classTeacher,
+	RemoveStudentMethod:     classTeacher,
+	UpdatePersonMethod:      selfOrPlatformAdmin,
+	GrantRoleMethod:         roleGranter,
+	RevokeRoleMethod:        roleGranter,
+}
+
+// authorize checks that the caller on a connection may call method with
+// data. Malformed data passes, for the method to reject.
+func (s *server) authorize(auth *connAuth, method string, data interface{}) error {
+	check, ok := policies[method]
+	if !ok {
+		return nil
+	}
+	personId, err := s.personId(auth)
+	if err != nil {
+		return err
+	}
+	a, err := s.repo.access(personId)
+	if err != nil {
+		// The person was deleted since logging in.
+		return errNotLoggedIn
+	}
+
+	var t target
+	if reqData, err := json.Marshal(data); err == nil {
+		json.Unmarshal(reqData, &t)
+	}
+	return check(s, a, t)
+}
+
+// authorizeRequests is the middleware that applies the policy of method.
+func (s *server) authorizeRequests(method string, next handlerFunc) handlerFunc {
+	return func(auth *connAuth, data interface{}) Response {
+		if err := s.authorize(auth, method, data); err != nil {
+			return errorResponse(err)
+		}
+		return next(auth, data)
+	}
+}
+
+func anyone(s *server, a access, t target) error {
+	return nil
+}
+
+func platformAdmin(s *server, a access, t target) error {
+	if !a.platformAdmin {
+		return errForbidden
+	}
+	return nil
+}
+
+// schoolAdmin allows the admins of the school schoolId picks.
+func schoolAdmin(schoolId func(target) uint) policy {
+	return func(s *server, a access, t target) error {
+		if !a.administers(schoolId(t)) {
+			return errForbidden
+		}
+		return nil
+	}
+}
+
+// classSchoolAdmin allows the admins of the school of the class classId
+// picks.
+func classSchoolAdmin(classId func(target) uint) policy {
+	return func(s *server, a access, t target) error {
+		class, err := s.repo.class(classId(t), 0)
+		if err != nil {
+			return err
+		}
+		if !a.administers(class.SchoolId) {
+			return errForbidden
+		}
+		return nil
+	}
+}
+
+// classTeacher allows the teacher of a class, besides the admins of its
+// school, to change who attends it.
+func classTeacher(s *server, a access, t target) error {
+	if a.teaches[t.ClassId] {
+		return nil
+	}
+	return classSchoolAdmin(func(t target) uint { return t.ClassId })(s, a, t)
+}
+
+func selfOrPlatformAdmin(s *server, a access, t target) error {
+	if t.Id != a.personId && !a.platformAdmin {
+		return errForbidden
+	}
+	return nil
+}
+
+// roleGranter allows platform admins to grant and revoke any role, and
+// school admins to make others admins of their school.
+func roleGranter(s *server, a access, t target) error {
+	if t.Role == roleSchoolAdmin && a.administers(t.SchoolId) {
+		return nil
+	}
+	return platformAdmin(s, a, t)
+}
+
+// grantRequest grants or revokes one of the roles that are granted, rather
+// than had through classes.
+type grantRequest struct {
+	PersonId uint `json:"person_id" validate:"required"`
+	Role     role `json:"role" validate:"required,oneof=platform_admin school_admin"`
+	SchoolId uint `json:"school_id,omitempty"`
+}
+
+func (s *server) grantRole(data interface{}) Response {
+	grant, err := s.decodeGrant(data)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	if err := s.repo.grantRole(grant); err != nil {
+		return errorResponse(err)
+	}
+	return Response{Status: true, Message: "Role granted", Data: grant}
+}
+
+func (s *server) revokeRole(data interface{}) Response {
+	grant, err := s.decodeGrant(data)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	if err := s.repo.revokeRole(grant); err != nil {
+		return errorResponse(err)
+	}
+	return Response{Status: true, Message: "Role revoked", Data: grant}
+}
+
+type listRolesRequest struct {
+	PersonId uint `json:"person_id" validate:"required"`
+}
+
+func (s *server) listRoles(data interface{}) Response {
+	var req listRolesRequest
+	if err := s.decodeRequest(data, &req); err != nil {
+		return errorResponse(err)
+	}
+
+	roles, err := s.repo.roles(req.PersonId)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return Response{Status: true, Message: "Roles listed", Data: roles}
+}
+
+// decodeGrant decodes a grantRequest and checks that it scopes the role to
+// a school exactly when the role is a school role.
+func (s *server) decodeGrant(data interface{}) (roleGrant, error) {
+	var req grantRequest
+	if err := s.decodeRequest(data, &req); err != nil {
+		return roleGrant{}, err
+	}
+	switch req.Role {
+	case rolePlatformAdmin:
+		if req.SchoolId != 0 {
+			return roleGrant{}, invalidRequest(fmt.Sprintf("Role %s is not scoped to a school", req.Role))
+		}
+	case roleSchoolAdmin:
+		if req.SchoolId == 0 {
+			return roleGrant{}, invalidRequest(fmt.Sprintf("Role %s needs a school_id", req.Role))
+		}
+	}
+	return roleGrant(req), nil
+}
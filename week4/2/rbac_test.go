@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFirstPersonOfEmptyStoreIsPlatformAdmin(t *testing.T) {
+	repo := newMemoryRepository()
+	first, err := repo.createPerson(personRecord{Name: "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := repo.createPerson(personRecord{Name: "second"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a, _ := repo.access(first.Id); !a.platformAdmin {
+		t.Error("first person is not a platform admin")
+	}
+	if a, _ := repo.access(second.Id); a.platformAdmin {
+		t.Error("second person is a platform admin")
+	}
+}
+
+// A migrated store has people but no roles. Whoever signs up next must not
+// become its platform admin; only the person named at startup does.
+func TestMigratedStoreNeedsExplicitPlatformAdmin(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	v2 := `{"version": 2, "next_school_id": 1, "next_person_id": 2, "next_class_id": 1,
+		"schools": {}, "people": {"1": {"id": 1, "name": "owner", "age": 40}}, "classes": {}}`
+	if err := os.WriteFile(path, []byte(v2), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	repo, err := openFileRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.close()
+
+	newcomer, err := repo.createPerson(personRecord{Name: "newcomer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := repo.access(newcomer.Id); a.platformAdmin {
+		t.Fatal("person created after migration became platform admin")
+	}
+
+	t.Setenv(platformAdminEnv, "1")
+	for i := 0; i < 2; i++ {
+		if err := bootstrapPlatformAdmin(repo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a, _ := repo.access(1); !a.platformAdmin {
+		t.Fatal("bootstrapped person is not a platform admin")
+	}
+
+	t.Setenv(platformAdminEnv, "99")
+	if err := bootstrapPlatformAdmin(repo); err == nil {
+		t.Fatal("bootstrapping a missing person succeeded")
+	}
+}
+
+// Only the roles that are granted can be, and the validation error names
+// them.
+func TestGrantRejectsRolesHadThroughClasses(t *testing.T) {
+	s := newTestServer()
+	c, admin := loginAdmin(t, s)
+
+	for _, r := range []role{roleTeacher, roleStudent, "owner"} {
+		resp, err := c.call(GrantRoleMethod, map[string]interface{}{"person_id": admin, "role": r})
+		if err != nil {
+			t.Fatal(err)
+		}
+		detail, _ := resp.Data.(errorDetail)
+		if resp.Status || len(detail.Fields) != 1 || detail.Fields[0].Field != "role" || detail.Fields[0].Code != "oneof" {
+			t.Fatalf("granting %s: status %t, fields %v; want a oneof error on role", r, resp.Status, detail.Fields)
+		}
+	}
+	school := mustCreate(t, c, CreateSchoolMethod, map[string]interface{}{"name": "A"})
+	expectOK(t, c, GrantRoleMethod, map[string]interface{}{"person_id": admin, "role": roleSchoolAdmin, "school_id": school})
+}
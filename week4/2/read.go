@@ -0,0 +1,393 @@
+package main
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// getRequest reads one record. Fields limits the fields returned, and
+// Expand how many levels of related records are nested in a school or
+// class; deeper ones carry only their id. It defaults to nesting fully.
+type getRequest struct {
+	Id     uint     `json:"id" validate:"required"`
+	Fields []string `json:"fields"`
+	Expand *int     `json:"expand" validate:"min=0,max=2"`
+}
+
+// listRequest selects one page of a list. Sort names the field to order by,
+// prefixed with "-" for descending order, and defaults to "id"; ties are
+// broken by id. Cursor is the next_cursor of the previous page. Fields and
+// Expand work as in getRequest.
+type listRequest struct {
+	Cursor string   `json:"cursor"`
+	Limit  int      `json:"limit"`
+	Sort   string   `json:"sort"`
+	Fields []string `json:"fields"`
+	Expand *int     `json:"expand" validate:"min=0,max=2"`
+}
+
+func expandDepth(expand *int) int {
+	if expand == nil {
+		return maxExpand
+	}
+	return *expand
+}
+
+type listClassesRequest struct {
+	listRequest
+	SchoolId uint `json:"school_id"`
+}
+
+type searchPeopleRequest struct {
+	listRequest
+	Name string `json:"name" validate:"required"`
+}
+
+// listPage is the data of a list response. NextCursor is empty on the last
+// page.
+type listPage struct {
+	Items      interface{} `json:"items"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+// sortValue is the value of the field a list is sorted by. Numeric fields
+// set Num and text fields Str.
+type sortValue struct {
+	Num int    `json:"n,omitempty"`
+	Str string `json:"s,omitempty"`
+}
+
+func (v sortValue) compare(other sortValue) int {
+	if c := cmp.Compare(v.Num, other.Num); c != 0 {
+		return c
+	}
+	return strings.Compare(v.Str, other.Str)
+}
+
+// textValue sorts text without regard to case.
+func textValue(s string) sortValue {
+	return sortValue{Str: strings.ToLower(s)}
+}
+
+// cursor marks the last item of a page. Pages continue after it even if
+// items were added or removed in between.
+type cursor struct {
+	Sort  string    `json:"sort"`
+	After sortValue `json:"after"`
+	Id    uint      `json:"id"`
+}
+
+func (c cursor) encode() string {
+	content, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(content)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	var c cursor
+	content, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || json.Unmarshal(content, &c) != nil {
+		return c, invalidRequest("Invalid cursor")
+	}
+	return c, nil
+}
+
+var schoolSortFields = map[string]func(School) sortValue{
+	"id":   func(s School) sortValue { return sortValue{Num: int(s.Id)} },
+	"name": func(s School) sortValue { return textValue(s.Name) },
+}
+
+var classSortFields = map[string]func(Class) sortValue{
+	"id":        func(c Class) sortValue { return sortValue{Num: int(c.Id)} },
+	"name":      func(c Class) sortValue { return textValue(c.Name) },
+	"school_id": func(c Class) sortValue { return sortValue{Num: int(c.SchoolId)} },
+}
+
+var personSortFields = map[string]func(Person) sortValue{
+	"id":   func(p Person) sortValue { return sortValue{Num: int(p.Id)} },
+	"name": func(p Person) sortValue { return textValue(p.Name) },
+	"age":  func(p Person) sortValue { return sortValue{Num: p.Age} },
+}
+
+// paginate sorts items as req asks and returns the page it selects along
+// with the cursor of the next page.
+func paginate[T any](items []T, req listRequest, id func(T) uint, sortFields map[string]func(T) sortValue) ([]T, string, error) {
+	sortBy := req.Sort
+	if sortBy == "" {
+		sortBy = "id"
+	}
+	descending := strings.HasPrefix(sortBy, "-")
+	key, ok := sortFields[strings.TrimPrefix(sortBy, "-")]
+	if !ok {
+		return nil, "", invalidRequest(fmt.Sprintf("Cannot sort by %q", strings.TrimPrefix(sortBy, "-")))
+	}
+
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	limit = min(limit, maxPageSize)
+
+	compare := func(value sortValue, itemId uint, item T) int {
+		c := value.compare(key(item))
+		if c == 0 {
+			c = cmp.Compare(itemId, id(item))
+		}
+		if descending {
+			c = -c
+		}
+		return c
+	}
+	slices.SortFunc(items, func(a, b T) int {
+		return compare(key(a), id(a), b)
+	})
+
+	if req.Cursor != "" {
+		after, err := decodeCursor(req.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		if after.Sort != sortBy {
+			return nil, "", invalidRequest("Cursor belongs to a list with a different sort")
+		}
+		start := sort.Search(len(items), func(i int) bool {
+			return compare(after.After, after.Id, items[i]) < 0
+		})
+		items = items[start:]
+	}
+
+	if len(items) <= limit {
+		return items, "", nil
+	}
+	last := items[limit-1]
+	return items[:limit], cursor{Sort: sortBy, After: key(last), Id: id(last)}.encode(), nil
+}
+
+// trimFunc rewrites an item as decoded by toMap, before its fields are
+// selected.
+type trimFunc func(item map[string]interface{})
+
+// selectFields returns items with only the given fields, or all of them if
+// no fields are given, after trim rewrites them. Without fields or trim,
+// items are returned as they are.
+func selectFields[T any](items []T, fields []string, trim trimFunc) (interface{}, error) {
+	if len(fields) == 0 && trim == nil {
+		return items, nil
+	}
+
+	var zero T
+	known, err := toMap(zero)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range fields {
+		if _, ok := known[field]; !ok {
+			return nil, invalidRequest(fmt.Sprintf("Unknown field %q", field))
+		}
+	}
+
+	selected := make([]map[string]interface{}, len(items))
+	for i, item := range items {
+		all, err := toMap(item)
+		if err != nil {
+			return nil, err
+		}
+		if trim != nil {
+			trim(all)
+		}
+		if len(fields) == 0 {
+			selected[i] = all
+			continue
+		}
+		selected[i] = make(map[string]interface{}, len(fields))
+		for _, field := range fields {
+			selected[i][field] = all[field]
+		}
+	}
+	return selected, nil
+}
+
+// selectItemFields is selectFields for a single item.
+func selectItemFields[T any](item T, fields []string, trim trimFunc) (interface{}, error) {
+	selected, err := selectFields([]T{item}, fields, trim)
+	if err != nil || (len(fields) == 0 && trim == nil) {
+		return item, err
+	}
+	return selected.([]map[string]interface{})[0], nil
+}
+
+// trimSchool and trimClass cut the records nested more than expand levels
+// deep in a school or class down to their id. The views leave the other
+// fields of such records zero, which reads as real data.
+func trimSchool(expand int) trimFunc {
+	if expand >= maxExpand {
+		return nil
+	}
+	return func(school map[string]interface{}) {
+		classes, _ := school["classes"].([]interface{})
+		for i, class := range classes {
+			if expand == 0 {
+				classes[i] = idOnly(class)
+			} else {
+				trimClass(expand - 1)(class.(map[string]interface{}))
+			}
+		}
+	}
+}
+
+func trimClass(expand int) trimFunc {
+	if expand > 0 {
+		return nil
+	}
+	return func(class map[string]interface{}) {
+		class["teacher"] = idOnly(class["teacher"])
+		students, _ := class["students"].([]interface{})
+		for i, student := range students {
+			students[i] = idOnly(student)
+		}
+	}
+}
+
+func idOnly(record interface{}) map[string]interface{} {
+	return map[string]interface{}{"id": record.(map[string]interface{})["id"]}
+}
+
+func toMap(v interface{}) (map[string]interface{}, error) {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	return m, json.Unmarshal(content, &m)
+}
+
+func listResponse[T any](message string, items []T, req listRequest, id func(T) uint, sortFields map[string]func(T) sortValue, trim trimFunc) Response {
+	page, next, err := paginate(items, req, id, sortFields)
+	if err != nil {
+		return errorResponse(err)
+	}
+	selected, err := selectFields(page, req.Fields, trim)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return Response{Status: true, Message: message, Data: listPage{Items: selected, NextCursor: next}}
+}
+
+func getResponse[T any](message string, item T, fields []string, trim trimFunc) Response {
+	selected, err := selectItemFields(item, fields, trim)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return Response{Status: true, Message: message, Data: selected}
+}
+
+func schoolId(s School) uint { return s.Id }
+func classId(c Class) uint   { return c.Id }
+func personId(p Person) uint { return p.Id }
+
+func (s *server) getSchool(data interface{}) Response {
+	var req getRequest
+	if err := s.decodeRequest(data, &req); err != nil {
+		return errorResponse(err)
+	}
+
+	expand := expandDepth(req.Expand)
+	school, err := s.repo.school(req.Id, expand)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return getResponse("School found", school, req.Fields, trimSchool(expand))
+}
+
+func (s *server) listSchools(data interface{}) Response {
+	var req listRequest
+	if err := s.decodeRequest(data, &req); err != nil {
+		return errorResponse(err)
+	}
+
+	expand := expandDepth(req.Expand)
+	schools, err := s.repo.schools(expand)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return listResponse("Schools listed", schools, req, schoolId, schoolSortFields, trimSchool(expand))
+}
+
+func (s *server) getClass(data interface{}) Response {
+	var req getRequest
+	if err := s.decodeRequest(data, &req); err != nil {
+		return errorResponse(err)
+	}
+
+	expand := expandDepth(req.Expand)
+	class, err := s.repo.class(req.Id, expand)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return getResponse("Class found", class, req.Fields, trimClass(expand))
+}
+
+// listClasses lists every class, or those of one school if school_id is
+// given.
+func (s *server) listClasses(data interface{}) Response {
+	var req listClassesRequest
+	if err := s.decodeRequest(data, &req); err != nil {
+		return errorResponse(err)
+	}
+
+	expand := expandDepth(req.Expand)
+	if req.SchoolId != 0 {
+		if _, err := s.repo.school(req.SchoolId, 0); err != nil {
+			return errorResponse(err)
+		}
+	}
+	classes, err := s.repo.classes(expand)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if req.SchoolId != 0 {
+		classes = slices.DeleteFunc(classes, func(c Class) bool { return c.SchoolId != req.SchoolId })
+	}
+	return listResponse("Classes listed", classes, req.listRequest, classId, classSortFields, trimClass(expand))
+}
+
+func (s *server) listPeople(data interface{}) Response {
+	var req listRequest
+	if err := s.decodeRequest(data, &req); err != nil {
+		return errorResponse(err)
+	}
+
+	people, err := s.repo.people()
+	if err != nil {
+		return errorResponse(err)
+	}
+	return listResponse("People listed", people, req, personId, personSortFields, nil)
+}
+
+// searchPeople lists the people whose name contains the given text,
+// ignoring case.
+func (s *server) searchPeople(data interface{}) Response {
+	var req searchPeopleRequest
+	if err := s.decodeRequest(data, &req); err != nil {
+		return errorResponse(err)
+	}
+
+	people, err := s.repo.people()
+	if err != nil {
+		return errorResponse(err)
+	}
+	name := strings.ToLower(req.Name)
+	people = slices.DeleteFunc(people, func(p Person) bool {
+		return !strings.Contains(strings.ToLower(p.Name), name)
+	})
+	return listResponse("People found", people, req.listRequest, personId, personSortFields, nil)
+}
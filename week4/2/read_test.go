@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// Records nested deeper than expand carry their id and nothing else, rather
+// than zero values that read as real data.
+func TestUnexpandedRecordsCarryOnlyTheirId(t *testing.T) {
+	s := newTestServer()
+	c, _ := loginAdmin(t, s)
+
+	school := mustCreate(t, c, CreateSchoolMethod, map[string]interface{}{"name": "A"})
+	teacher := mustCreate(t, c, CreatePersonMethod, map[string]interface{}{"name": "teacher", "age": 40})
+	student := mustCreate(t, c, CreatePersonMethod, map[string]interface{}{"name": "student", "age": 12})
+	class := mustCreate(t, c, CreateClassMethod, map[string]interface{}{"name": "a", "school_id": school, "teacher": map[string]interface{}{"id": teacher}})
+	expectOK(t, c, AddStudentToClassMethod, map[string]interface{}{"class_id": class, "student_id": student})
+
+	type nested = map[string]interface{}
+	tests := []struct {
+		method string
+		expand int
+		path   func(nested) interface{}
+		want   string
+	}{
+		{GetSchoolMethod, 0, func(v nested) interface{} { return v["classes"] }, fmt.Sprintf(`[{"id":%d}]`, class)},
+		{GetSchoolMethod, 1, func(v nested) interface{} { return v["classes"].([]interface{})[0].(nested)["teacher"] }, fmt.Sprintf(`{"id":%d}`, teacher)},
+		{GetSchoolMethod, 2, func(v nested) interface{} { return v["classes"].([]interface{})[0].(nested)["teacher"] }, fmt.Sprintf(`{"age":40,"classes":[%d],"id":%d,"name":"teacher"}`, class, teacher)},
+		{GetClassMethod, 0, func(v nested) interface{} { return v["students"] }, fmt.Sprintf(`[{"id":%d}]`, student)},
+		{GetClassMethod, 1, func(v nested) interface{} { return v["students"] }, fmt.Sprintf(`[{"age":12,"classes":[%d],"id":%d,"name":"student"}]`, class, student)},
+	}
+	ids := map[string]uint{GetSchoolMethod: school, GetClassMethod: class}
+	for _, tt := range tests {
+		var view nested
+		if err := c.callOK(tt.method, map[string]interface{}{"id": ids[tt.method], "expand": tt.expand}, &view); err != nil {
+			t.Fatal(err)
+		}
+		got, err := json.Marshal(tt.path(view))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s with expand %d: got %s, want %s", tt.method, tt.expand, got, tt.want)
+		}
+	}
+}
+
+func people(ages ...int) []Person {
+	people := make([]Person, len(ages))
+	for i, age := range ages {
+		people[i] = Person{Id: uint(i + 1), Name: fmt.Sprint("person ", i+1), Age: age}
+	}
+	return people
+}
+
+func ids(people []Person) []uint {
+	ids := make([]uint, len(people))
+	for i, p := range people {
+		ids[i] = p.Id
+	}
+	return ids
+}
+
+// pageAll pages through items with req and returns the ids in page order.
+func pageAll(t *testing.T, items []Person, req listRequest) []uint {
+	t.Helper()
+	var all []uint
+	for {
+		page, next, err := paginate(slices.Clone(items), req, personId, personSortFields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, ids(page)...)
+		if next == "" {
+			return all
+		}
+		req.Cursor = next
+	}
+}
+
+func TestPaginateSortsAndBreaksTiesById(t *testing.T) {
+	items := people(30, 20, 30, 10, 20, 30)
+	tests := []struct {
+		sort string
+		want []uint
+	}{
+		{"", []uint{1, 2, 3, 4, 5, 6}},
+		{"age", []uint{4, 2, 5, 1, 3, 6}},
+		// Descending order reverses ties too, so it is the exact reverse.
+		{"-age", []uint{6, 3, 1, 5, 2, 4}},
+		{"-id", []uint{6, 5, 4, 3, 2, 1}},
+	}
+	for _, tt := range tests {
+		for _, limit := range []int{1, 2, 4, 6} {
+			got := pageAll(t, items, listRequest{Sort: tt.sort, Limit: limit})
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("sort %q with limit %d: got %v, want %v", tt.sort, limit, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestPaginateClampsLimit(t *testing.T) {
+	items := people(make([]int, maxPageSize+5)...)
+	tests := []struct {
+		limit int
+		want  int
+	}{
+		{0, defaultPageSize},
+		{-1, defaultPageSize},
+		{3, 3},
+		{maxPageSize, maxPageSize},
+		{maxPageSize + 1, maxPageSize},
+	}
+	for _, tt := range tests {
+		page, next, err := paginate(slices.Clone(items), listRequest{Limit: tt.limit}, personId, personSortFields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) != tt.want || next == "" {
+			t.Errorf("limit %d: got %d items and cursor %q, want %d and a next page", tt.limit, len(page), next, tt.want)
+		}
+	}
+
+	page, next, _ := paginate(slices.Clone(items), listRequest{Limit: len(items)}, personId, personSortFields)
+	if len(page) != maxPageSize || next == "" {
+		t.Fatalf("got %d items and cursor %q, want %d and a next page", len(page), next, maxPageSize)
+	}
+}
+
+func TestPaginateRejectsBadRequests(t *testing.T) {
+	items := people(1, 2, 3)
+	_, byName, _ := paginate(slices.Clone(items), listRequest{Sort: "name", Limit: 1}, personId, personSortFields)
+
+	tests := []struct {
+		name string
+		req  listRequest
+		want string
+	}{
+		{"unknown sort field", listRequest{Sort: "height"}, `Cannot sort by "height"`},
+		{"unknown descending sort field", listRequest{Sort: "-height"}, `Cannot sort by "height"`},
+		{"cursor of another sort", listRequest{Sort: "-name", Cursor: byName}, "Cursor belongs to a list with a different sort"},
+		{"cursor of the default sort", listRequest{Cursor: byName}, "Cursor belongs to a list with a different sort"},
+		{"garbled cursor", listRequest{Cursor: "not a cursor"}, "Invalid cursor"},
+		{"cursor that is not JSON", listRequest{Cursor: "bm90IGpzb24"}, "Invalid cursor"},
+	}
+	for _, tt := range tests {
+		_, _, err := paginate(slices.Clone(items), tt.req, personId, personSortFields)
+		var reqErr requestError
+		if !errors.As(err, &reqErr) || reqErr.code != codeInvalidRequest || reqErr.message != tt.want {
+			t.Errorf("%s: got %v, want invalid request %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+// A cursor marks where a page ended rather than an offset, so records added
+// or removed between pages neither repeat nor skip the ones after it.
+func TestCursorContinuesAcrossInsertsAndDeletes(t *testing.T) {
+	s := newTestServer()
+	c, admin := loginAdmin(t, s)
+	created := map[string]uint{"admin": admin}
+	for _, name := range []string{"b", "d", "f", "h", "j"} {
+		created[name] = mustCreate(t, c, CreatePersonMethod, map[string]interface{}{"name": name, "age": 20})
+	}
+
+	var first pageOf[entity]
+	if err := c.callOK(ListPeopleMethod, map[string]interface{}{"sort": "name", "limit": 3}, &first); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(first.Items); !slices.Equal(got, []string{"admin", "b", "d"}) || first.NextCursor == "" {
+		t.Fatalf("first page %v with cursor %q", got, first.NextCursor)
+	}
+
+	// Remove a record already listed and one not listed yet, and add records
+	// on both sides of the cursor.
+	expectOK(t, c, DeletePersonMethod, map[string]interface{}{"id": created["b"]})
+	expectOK(t, c, DeletePersonMethod, map[string]interface{}{"id": created["f"]})
+	for _, name := range []string{"c", "e", "D"} {
+		mustCreate(t, c, CreatePersonMethod, map[string]interface{}{"name": name, "age": 20})
+	}
+
+	var rest []string
+	cursor := first.NextCursor
+	for cursor != "" {
+		var page pageOf[entity]
+		if err := c.callOK(ListPeopleMethod, map[string]interface{}{"sort": "name", "limit": 3, "cursor": cursor}, &page); err != nil {
+			t.Fatal(err)
+		}
+		rest = append(rest, names(page.Items)...)
+		cursor = page.NextCursor
+	}
+	// "D" sorts with "d" regardless of case and after it by id, so it comes
+	// after the cursor; "c" sorts before it and is not listed.
+	if want := []string{"D", "e", "h", "j"}; !slices.Equal(rest, want) {
+		t.Fatalf("later pages %v, want %v", rest, want)
+	}
+}
+
+func names(items []entity) []string {
+	names := make([]string, len(items))
+	for i, item := range items {
+		names[i] = item.Name
+	}
+	return names
+}
+
+func TestListRejectsUnknownFields(t *testing.T) {
+	s := newTestServer()
+	c, _ := loginAdmin(t, s)
+
+	var page pageOf[map[string]interface{}]
+	if err := c.callOK(ListPeopleMethod, map[string]interface{}{"fields": []string{"name"}}, &page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 1 || len(page.Items[0]) != 1 || page.Items[0]["name"] != "admin" {
+		t.Fatalf("items %v, want only the name of the admin", page.Items)
+	}
+
+	expectCode(t, c, codeInvalidRequest, ListPeopleMethod, map[string]interface{}{"fields": []string{"name", "password"}})
+	expectCode(t, c, codeInvalidRequest, ListPeopleMethod, map[string]interface{}{"sort": "password"})
+	expectCode(t, c, codeInvalidRequest, ListPeopleMethod, map[string]interface{}{"page": 2})
+}
@@ -0,0 +1,94 @@
+package main
+
+import "os"
+
+var (
+	errSchoolNotFound      = requestError{codeNotFound, "School not found"}
+	errClassNotFound       = requestError{codeNotFound, "Class not found"}
+	errPersonNotFound      = requestError{codeNotFound, "Person not found"}
+	errInvalidTeacher      = requestError{codeConflict, "Invalid or conflicting teacher"}
+	errStudentConflict     = requestError{codeConflict, "Student conflict or not found"}
+	errStudentAlreadyAdded = requestError{codeConflict, "Student already in this class"}
+	errStudentNotInClass   = requestError{codeConflict, "Student not in this class"}
+	errSchoolHasClasses    = requestError{codeConflict, "School still has classes"}
+	errPersonTeaches       = requestError{codeConflict, "Person still teaches classes"}
+	errRoleAlreadyGranted  = requestError{codeConflict, "Role already granted"}
+	errRoleNotGranted      = requestError{codeConflict, "Role not granted"}
+	errLastPlatformAdmin   = requestError{codeConflict, "The last platform admin cannot be removed"}
+)
+
+// Fields of an update that are nil stay as they are.
+type (
+	schoolUpdate struct {
+		Name *string `json:"name" validate:"required,max=100"`
+	}
+	personUpdate struct {
+		Name         *string `json:"name" validate:"required,max=100"`
+		Age          *int    `json:"age" validate:"min=0,max=150"`
+		PasswordHash *string `json:"-"`
+	}
+	classUpdate struct {
+		Name *string `json:"name" validate:"required,max=100"`
+	}
+)
+
+// repository stores schools, people and classes. Implementations must be
+// safe for concurrent use, and each method must check and apply its change
+// atomically.
+//
+// No record may refer to one that does not exist. Deletes follow this
+// policy:
+//   - a school with classes is only deleted with cascade, which deletes
+//     its classes too;
+//   - a person teaching a class cannot be deleted; a student is removed
+//     from their classes;
+//   - a class is removed from its school and from its members' classes.
+//
+// The first person created in a new, empty store becomes the platform
+// admin; stores with data, such as migrated ones, get one only through
+// bootstrapPlatformAdmin. The last platform admin cannot be deleted or lose
+// the role.
+//
+// Methods returning a school or class nest the records it refers to expand
+// levels deep; the write methods nest them fully.
+type repository interface {
+	createSchool(school schoolRecord) (School, error)
+	createPerson(person personRecord) (Person, error)
+	createClass(class classRecord) (Class, error)
+	addStudentToClass(classId, studentId uint) (Person, error)
+	removeStudentFromClass(classId, studentId uint) (Person, error)
+	updateSchool(id uint, update schoolUpdate) (School, error)
+	updatePerson(id uint, update personUpdate) (Person, error)
+	updateClass(id uint, update classUpdate) (Class, error)
+	deleteSchool(id uint, cascade bool) error
+	deletePerson(id uint) error
+	deleteClass(id uint) error
+	grantRole(grant roleGrant) error
+	revokeRole(grant roleGrant) error
+	// roles includes the teacher and student roles people have through
+	// their classes; access sums up all roles of a person.
+	roles(personId uint) ([]roleGrant, error)
+	access(personId uint) (access, error)
+	person(id uint) (Person, error)
+	passwordHash(personId uint) (string, error)
+	school(id uint, expand int) (School, error)
+	class(id uint, expand int) (Class, error)
+	// schools, classes and people return everything in no particular
+	// order.
+	schools(expand int) ([]School, error)
+	classes(expand int) ([]Class, error)
+	people() ([]Person, error)
+	close() error
+}
+
+// dataFileEnv names the environment variable holding the path of the data
+// file. Without it, the server keeps its data in memory only.
+const dataFileEnv = "SCHOOL_DATA_FILE"
+
+func openRepository() (repository, error) {
+	path := os.Getenv(dataFileEnv)
+	if path == "" {
+		return newMemoryRepository(), nil
+	}
+	return openFileRepository(path)
+}
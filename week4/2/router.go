@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+	"slices"
+	"time"
+)
+
+// handlerFunc answers a request made on a connection.
+type handlerFunc func(auth *connAuth, data interface{}) Response
+
+// middleware wraps the handler of method with behaviour common to many
+// methods.
+type middleware func(method string, next handlerFunc) handlerFunc
+
+// withData adapts a handler that only needs the request data.
+func withData(h func(data interface{}) Response) handlerFunc {
+	return func(auth *connAuth, data interface{}) Response {
+		return h(data)
+	}
+}
+
+// withAuth adapts a handler that only needs the login state of the
+// connection.
+func withAuth(h func(auth *connAuth) Response) handlerFunc {
+	return func(auth *connAuth, data interface{}) Response {
+		return h(auth)
+	}
+}
+
+// router dispatches requests to the handlers registered for their methods.
+// Middleware added with use wraps the handlers registered after it, the
+// first added outermost.
+type router struct {
+	handlers   map[string]handlerFunc
+	middleware []middleware
+}
+
+func newRouter() *router {
+	return &router{handlers: make(map[string]handlerFunc)}
+}
+
+func (rt *router) use(mw ...middleware) {
+	rt.middleware = append(rt.middleware, mw...)
+}
+
+func (rt *router) handle(method string, h handlerFunc) {
+	if _, exists := rt.handlers[method]; exists {
+		panic("method registered twice: " + method)
+	}
+	for i := len(rt.middleware) - 1; i >= 0; i-- {
+		h = rt.middleware[i](method, h)
+	}
+	rt.handlers[method] = h
+}
+
+func (rt *router) methods() []string {
+	methods := make([]string, 0, len(rt.handlers))
+	for method := range rt.handlers {
+		methods = append(methods, method)
+	}
+	slices.Sort(methods)
+	return methods
+}
+
+func (rt *router) serve(auth *connAuth, req Request) Response {
+	h, ok := rt.handlers[req.Method]
+	if !ok {
+		return Response{Status: false, Message: "Invalid method", Data: errorDetail{Code: codeUnknownMethod, Suggestions: rt.suggest(req.Method)}}
+	}
+	return h(auth, req.Data)
+}
+
+// maxSuggestions is how many methods are suggested for an unknown one.
+const maxSuggestions = 3
+
+// suggest returns the methods closest to an unknown one, by edit distance.
+// Methods that need more edits than a third of their length are too far off
+// to be what the caller meant.
+func (rt *router) suggest(method string) []string {
+	type candidate struct {
+		method   string
+		distance int
+	}
+	var candidates []candidate
+	for _, m := range rt.methods() {
+		d := editDistance(method, m)
+		if d <= max(2, len(m)/3) {
+			candidates = append(candidates, candidate{m, d})
+		}
+	}
+	slices.SortStableFunc(candidates, func(a, b candidate) int {
+		return a.distance - b.distance
+	})
+
+	var suggestions []string
+	for _, c := range candidates[:min(len(candidates), maxSuggestions)] {
+		suggestions = append(suggestions, c.method)
+	}
+	return suggestions
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func logRequests(method string, next handlerFunc) handlerFunc {
+	return func(auth *connAuth, data interface{}) Response {
+		resp := next(auth, data)
+		if !resp.Status {
+			fmt.Println("Request", method, "failed:", resp.Message)
+		}
+		return resp
+	}
+}
+
+// slowRequest is how long a request may take before it is logged as slow.
+const slowRequest = time.Second
+
+func timeRequests(method string, next handlerFunc) handlerFunc {
+	return func(auth *connAuth, data interface{}) Response {
+		start := time.Now()
+		resp := next(auth, data)
+		if elapsed := time.Since(start); elapsed >= slowRequest {
+			fmt.Println("Slow request", method, "took", elapsed.Round(time.Millisecond))
+		}
+		return resp
+	}
+}
+
+// recoverPanics turns a panic in a handler into an error response, so that
+// the connection stays usable and the panic is logged.
+func recoverPanics(method string, next handlerFunc) handlerFunc {
+	return func(auth *connAuth, data interface{}) (resp Response) {
+		defer func() {
+			if r := recover(); r != nil {
+				fmt.Printf("Panic in %s: %v\n%s", method, r, debug.Stack())
+				resp = internalErrorResponse()
+			}
+		}()
+		return next(auth, data)
+	}
+}
+
+// validateData rejects request data that is not an object. Every method
+// takes an object, or nothing.
+func validateData(method string, next handlerFunc) handlerFunc {
+	return func(auth *connAuth, data interface{}) Response {
+		if _, ok := data.(map[string]interface{}); !ok && data != nil {
+			return errorResponse(invalidRequest("Request data must be an object"))
+		}
+		return next(auth, data)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"", "abc", 3},
+		{"abc", "abc", 0},
+		{"kitten", "sitting", 3},
+		{"create", "craete", 2},
+		{"/login", "/logout", 3},
+		{"école", "ecole", 1},
+	}
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := editDistance(tt.b, tt.a); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestUnknownMethodSuggestsClosestMethods(t *testing.T) {
+	s := newTestServer()
+	c := s.testClient()
+	tests := []struct {
+		method string
+		// first is the best suggestion, or empty if there should be none.
+		first string
+	}{
+		{"/school/craete", CreateSchoolMethod},
+		{"/person/lst", ListPeopleMethod},
+		{"/whoami", WhoAmIMethod},
+		{"/Login", LoginMethod},
+		{"/class/remove/students", RemoveStudentMethod},
+		{"/completely/different", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		resp, err := c.call(tt.method, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		detail, _ := resp.Data.(errorDetail)
+		if resp.Status || detail.Code != codeUnknownMethod {
+			t.Errorf("%q: status %t, code %q, want %q", tt.method, resp.Status, detail.Code, codeUnknownMethod)
+			continue
+		}
+		if len(detail.Suggestions) > maxSuggestions {
+			t.Errorf("%q: %d suggestions, want at most %d", tt.method, len(detail.Suggestions), maxSuggestions)
+		}
+		switch {
+		case tt.first == "" && len(detail.Suggestions) != 0:
+			t.Errorf("%q: suggested %v, want nothing", tt.method, detail.Suggestions)
+		case tt.first != "" && (len(detail.Suggestions) == 0 || detail.Suggestions[0] != tt.first):
+			t.Errorf("%q: suggested %v, want %q first", tt.method, detail.Suggestions, tt.first)
+		}
+	}
+}
+
+// Middleware runs in the order it was added, the first outermost, and only
+// wraps the handlers registered after it.
+func TestMiddlewareOrder(t *testing.T) {
+	var calls []string
+	trace := func(name string) middleware {
+		return func(method string, next handlerFunc) handlerFunc {
+			return func(auth *connAuth, data interface{}) Response {
+				calls = append(calls, name+" before "+method)
+				resp := next(auth, data)
+				calls = append(calls, name+" after "+method)
+				return resp
+			}
+		}
+	}
+	handler := func(auth *connAuth, data interface{}) Response {
+		calls = append(calls, "handler")
+		return Response{Status: true}
+	}
+
+	rt := newRouter()
+	rt.use(trace("a"), trace("b"))
+	rt.handle("/early", handler)
+	rt.use(trace("c"))
+	rt.handle("/late", handler)
+
+	rt.serve(&connAuth{}, Request{Method: "/early"})
+	want := []string{"a before /early", "b before /early", "handler", "b after /early", "a after /early"}
+	if !slices.Equal(calls, want) {
+		t.Fatalf("calls %q, want %q", calls, want)
+	}
+
+	calls = nil
+	rt.serve(&connAuth{}, Request{Method: "/late"})
+	want = []string{"a before /late", "b before /late", "c before /late", "handler", "c after /late", "b after /late", "a after /late"}
+	if !slices.Equal(calls, want) {
+		t.Fatalf("calls %q, want %q", calls, want)
+	}
+}
+
+func TestRecoverPanicsAnswersWithInternalError(t *testing.T) {
+	rt := newRouter()
+	rt.use(recoverPanics)
+	rt.handle("/panic", func(auth *connAuth, data interface{}) Response {
+		panic("handler bug")
+	})
+	rt.handle("/ok", func(auth *connAuth, data interface{}) Response {
+		return Response{Status: true, Message: "fine"}
+	})
+
+	resp := rt.serve(&connAuth{}, Request{Method: "/panic"})
+	detail, _ := resp.Data.(errorDetail)
+	if resp.Status || detail.Code != codeInternal || strings.Contains(resp.Message, "handler bug") {
+		t.Fatalf("panic answered with %+v, want an internal error that hides the panic", resp)
+	}
+	if resp := rt.serve(&connAuth{}, Request{Method: "/ok"}); !resp.Status {
+		t.Fatalf("request after a panic failed: %+v", resp)
+	}
+}
+
+func TestHandleTwicePanics(t *testing.T) {
+	rt := newRouter()
+	handler := func(auth *connAuth, data interface{}) Response { return Response{Status: true} }
+	rt.handle("/twice", handler)
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registering a method twice did not panic")
+		}
+	}()
+	rt.handle("/twice", handler)
+}
+
+func TestValidateDataRejectsNonObjects(t *testing.T) {
+	rt := newRouter()
+	rt.use(validateData)
+	rt.handle("/echo", func(auth *connAuth, data interface{}) Response { return Response{Status: true} })
+
+	for _, data := range []interface{}{nil, map[string]interface{}{}} {
+		if resp := rt.serve(&connAuth{}, Request{Method: "/echo", Data: data}); !resp.Status {
+			t.Errorf("data %v rejected: %s", data, resp.Message)
+		}
+	}
+	for _, data := range []interface{}{"text", 1.0, []interface{}{}, true} {
+		resp := rt.serve(&connAuth{}, Request{Method: "/echo", Data: data})
+		if detail, _ := resp.Data.(errorDetail); resp.Status || detail.Code != codeInvalidRequest {
+			t.Errorf("data %v: status %t, code %q, want %q", data, resp.Status, detail.Code, codeInvalidRequest)
+		}
+	}
+}
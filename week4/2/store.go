@@ -0,0 +1,378 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// memoryRepository keeps the data in memory. Connections are served
+// concurrently, so each method holds the lock for the whole operation: the
+// checks an operation makes and the changes depending on them happen
+// atomically. Callers get views assembled from the records and never share
+// slices with them.
+type memoryRepository struct {
+	mu   sync.RWMutex
+	data *data
+	// save, when set, must store a changed copy of data before it replaces
+	// the current one, so that a change is visible only once it is durable.
+	save func(*data) error
+}
+
+func newMemoryRepository() *memoryRepository {
+	return &memoryRepository{data: newData()}
+}
+
+// update runs fn on the data under the write lock. With save set, fn
+// changes a copy, and an error from fn or save discards the change.
+// Without save, fn changes the data in place to spare a copy per write, so
+// it must return any error before it changes anything.
+func (r *memoryRepository) update(fn func(d *data) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d := r.data
+	if r.save != nil {
+		d = d.clone()
+	}
+	if err := fn(d); err != nil {
+		return err
+	}
+	if r.save != nil {
+		if err := r.save(d); err != nil {
+			return err
+		}
+	}
+	r.data = d
+	return nil
+}
+
+func (r *memoryRepository) close() error {
+	return nil
+}
+
+func (r *memoryRepository) createSchool(school schoolRecord) (School, error) {
+	var view School
+	err := r.update(func(d *data) error {
+		school.Id = d.SchoolIdCounter
+		d.SchoolIdCounter++
+		d.Schools[school.Id] = school
+		view = d.schoolView(school.Id, maxExpand)
+		return nil
+	})
+	return view, err
+}
+
+func (r *memoryRepository) createPerson(person personRecord) (Person, error) {
+	var view Person
+	err := r.update(func(d *data) error {
+		// Only a store nobody was ever created in makes its first person the
+		// platform admin; others get one with platformAdminEnv.
+		firstEver := d.PersonIdCounter == 1 && len(d.Roles) == 0
+		person.Id = d.PersonIdCounter
+		d.PersonIdCounter++
+		d.People[person.Id] = person
+		if firstEver {
+			d.Roles = append(slices.Clone(d.Roles), roleGrant{PersonId: person.Id, Role: rolePlatformAdmin})
+			fmt.Println("Person", person.Id, "is the first platform admin")
+		}
+		view = d.personView(person.Id)
+		return nil
+	})
+	return view, err
+}
+
+func (r *memoryRepository) createClass(class classRecord) (Class, error) {
+	var view Class
+	err := r.update(func(d *data) error {
+		if _, exists := d.Schools[class.SchoolId]; !exists {
+			return errSchoolNotFound
+		}
+		if _, exists := d.People[class.TeacherId]; !exists || d.teacherIsStudent(class.TeacherId) {
+			return errInvalidTeacher
+		}
+
+		class.Id = d.ClassIdCounter
+		d.ClassIdCounter++
+		class.StudentIds = nil
+		d.setClass(class)
+
+		view = d.classView(class.Id, maxExpand)
+		// The class was just created, so the teacher's classes would only
+		// repeat what the response is about.
+		view.Teacher.Classes = nil
+		return nil
+	})
+	return view, err
+}
+
+func (r *memoryRepository) addStudentToClass(classId, studentId uint) (Person, error) {
+	var view Person
+	err := r.update(func(d *data) error {
+		class, exists := d.Classes[classId]
+		if !exists {
+			return errClassNotFound
+		}
+		if _, exists := d.People[studentId]; !exists || d.isInOtherSchoolClasses(studentId, class.SchoolId) {
+			return errStudentConflict
+		}
+		if slices.Contains(d.personClasses[studentId], classId) {
+			return errStudentAlreadyAdded
+		}
+
+		class.StudentIds = append(slices.Clone(class.StudentIds), studentId)
+		d.setClass(class)
+		view = d.personView(studentId)
+		return nil
+	})
+	return view, err
+}
+
+func (r *memoryRepository) removeStudentFromClass(classId, studentId uint) (Person, error) {
+	var view Person
+	err := r.update(func(d *data) error {
+		class, exists := d.Classes[classId]
+		if !exists {
+			return errClassNotFound
+		}
+		if !slices.Contains(class.StudentIds, studentId) {
+			return errStudentNotInClass
+		}
+
+		class.StudentIds = slices.DeleteFunc(slices.Clone(class.StudentIds), func(id uint) bool { return id == studentId })
+		d.setClass(class)
+		view = d.personView(studentId)
+		return nil
+	})
+	return view, err
+}
+
+func (r *memoryRepository) updateSchool(id uint, update schoolUpdate) (School, error) {
+	var view School
+	err := r.update(func(d *data) error {
+		school, exists := d.Schools[id]
+		if !exists {
+			return errSchoolNotFound
+		}
+		if update.Name != nil {
+			school.Name = *update.Name
+		}
+		d.Schools[id] = school
+		view = d.schoolView(id, maxExpand)
+		return nil
+	})
+	return view, err
+}
+
+func (r *memoryRepository) updatePerson(id uint, update personUpdate) (Person, error) {
+	var view Person
+	err := r.update(func(d *data) error {
+		person, exists := d.People[id]
+		if !exists {
+			return errPersonNotFound
+		}
+		if update.Name != nil {
+			person.Name = *update.Name
+		}
+		if update.Age != nil {
+			person.Age = *update.Age
+		}
+		if update.PasswordHash != nil {
+			person.PasswordHash = *update.PasswordHash
+		}
+		d.People[id] = person
+		view = d.personView(id)
+		return nil
+	})
+	return view, err
+}
+
+func (r *memoryRepository) updateClass(id uint, update classUpdate) (Class, error) {
+	var view Class
+	err := r.update(func(d *data) error {
+		class, exists := d.Classes[id]
+		if !exists {
+			return errClassNotFound
+		}
+		if update.Name != nil {
+			class.Name = *update.Name
+		}
+		d.setClass(class)
+		view = d.classView(id, maxExpand)
+		return nil
+	})
+	return view, err
+}
+
+func (r *memoryRepository) deleteSchool(id uint, cascade bool) error {
+	return r.update(func(d *data) error {
+		if _, exists := d.Schools[id]; !exists {
+			return errSchoolNotFound
+		}
+		classIds := slices.Clone(d.schoolClasses[id])
+		if len(classIds) > 0 && !cascade {
+			return errSchoolHasClasses
+		}
+		for _, classId := range classIds {
+			d.deleteClass(classId)
+		}
+		d.revokeRoles(func(g roleGrant) bool { return g.Role == roleSchoolAdmin && g.SchoolId == id })
+		delete(d.Schools, id)
+		return nil
+	})
+}
+
+func (r *memoryRepository) deletePerson(id uint) error {
+	return r.update(func(d *data) error {
+		if _, exists := d.People[id]; !exists {
+			return errPersonNotFound
+		}
+		if d.teaches(id) {
+			return errPersonTeaches
+		}
+		if a := d.access(id); a.platformAdmin && d.platformAdmins() == 1 {
+			return errLastPlatformAdmin
+		}
+		for _, classId := range slices.Clone(d.personClasses[id]) {
+			class := d.Classes[classId]
+			class.StudentIds = slices.DeleteFunc(slices.Clone(class.StudentIds), func(studentId uint) bool { return studentId == id })
+			d.setClass(class)
+		}
+		d.revokeRoles(func(g roleGrant) bool { return g.PersonId == id })
+		delete(d.People, id)
+		return nil
+	})
+}
+
+func (r *memoryRepository) deleteClass(id uint) error {
+	return r.update(func(d *data) error {
+		if _, exists := d.Classes[id]; !exists {
+			return errClassNotFound
+		}
+		d.deleteClass(id)
+		return nil
+	})
+}
+
+func (r *memoryRepository) grantRole(grant roleGrant) error {
+	return r.update(func(d *data) error {
+		if _, exists := d.People[grant.PersonId]; !exists {
+			return errPersonNotFound
+		}
+		if _, exists := d.Schools[grant.SchoolId]; grant.Role == roleSchoolAdmin && !exists {
+			return errSchoolNotFound
+		}
+		if slices.Contains(d.Roles, grant) {
+			return errRoleAlreadyGranted
+		}
+		d.Roles = append(slices.Clone(d.Roles), grant)
+		return nil
+	})
+}
+
+func (r *memoryRepository) revokeRole(grant roleGrant) error {
+	return r.update(func(d *data) error {
+		if !slices.Contains(d.Roles, grant) {
+			return errRoleNotGranted
+		}
+		if grant.Role == rolePlatformAdmin && d.platformAdmins() == 1 {
+			return errLastPlatformAdmin
+		}
+		d.revokeRoles(func(g roleGrant) bool { return g == grant })
+		return nil
+	})
+}
+
+func (r *memoryRepository) roles(personId uint) ([]roleGrant, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if _, exists := r.data.People[personId]; !exists {
+		return nil, errPersonNotFound
+	}
+	return r.data.roles(personId), nil
+}
+
+func (r *memoryRepository) access(personId uint) (access, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if _, exists := r.data.People[personId]; !exists {
+		return access{}, errPersonNotFound
+	}
+	return r.data.access(personId), nil
+}
+
+func (r *memoryRepository) person(id uint) (Person, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if _, exists := r.data.People[id]; !exists {
+		return Person{}, errPersonNotFound
+	}
+	return r.data.personView(id), nil
+}
+
+func (r *memoryRepository) passwordHash(personId uint) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	person, exists := r.data.People[personId]
+	if !exists {
+		return "", errPersonNotFound
+	}
+	return person.PasswordHash, nil
+}
+
+func (r *memoryRepository) school(id uint, expand int) (School, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if _, exists := r.data.Schools[id]; !exists {
+		return School{}, errSchoolNotFound
+	}
+	return r.data.schoolView(id, expand), nil
+}
+
+func (r *memoryRepository) class(id uint, expand int) (Class, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if _, exists := r.data.Classes[id]; !exists {
+		return Class{}, errClassNotFound
+	}
+	return r.data.classView(id, expand), nil
+}
+
+func (r *memoryRepository) schools(expand int) ([]School, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	schools := make([]School, 0, len(r.data.Schools))
+	for id := range r.data.Schools {
+		schools = append(schools, r.data.schoolView(id, expand))
+	}
+	return schools, nil
+}
+
+func (r *memoryRepository) classes(expand int) ([]Class, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	classes := make([]Class, 0, len(r.data.Classes))
+	for id := range r.data.Classes {
+		classes = append(classes, r.data.classView(id, expand))
+	}
+	return classes, nil
+}
+
+func (r *memoryRepository) people() ([]Person, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	people := make([]Person, 0, len(r.data.People))
+	for id := range r.data.People {
+		people = append(people, r.data.personView(id))
+	}
+	return people, nil
+}
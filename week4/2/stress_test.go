@@ -0,0 +1,427 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func init() {
+	passwordCost = bcrypt.MinCost
+}
+
+// testClient makes requests to a server in-process, through the same
+// router as a connection, with its own login state.
+type testClient struct {
+	s    *server
+	auth *connAuth
+}
+
+func newTestServer() *server {
+	s := NewServer().(*server)
+	s.repo = newMemoryRepository()
+	return s
+}
+
+func (s *server) testClient() *testClient {
+	return &testClient{s: s, auth: &connAuth{}}
+}
+
+// call sends data through JSON, as a connection would.
+func (c *testClient) call(method string, data interface{}) (Response, error) {
+	var decoded interface{}
+	if data != nil {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return Response{}, err
+		}
+		if err := json.Unmarshal(raw, &decoded); err != nil {
+			return Response{}, err
+		}
+	}
+	return c.s.router.serve(c.auth, Request{Method: method, Data: decoded}), nil
+}
+
+// callOK calls method and decodes the data of a successful response into v.
+func (c *testClient) callOK(method string, data, v interface{}) error {
+	resp, err := c.call(method, data)
+	if err != nil {
+		return err
+	}
+	if !resp.Status {
+		return fmt.Errorf("%s failed: %s", method, resp.Message)
+	}
+	raw, err := json.Marshal(resp.Data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+func (c *testClient) login(id uint, password string) error {
+	return c.callOK(LoginMethod, map[string]interface{}{"id": id, "password": password}, &struct{}{})
+}
+
+// loginAdmin creates the first person of a new server, who becomes its
+// platform admin, and returns a client logged in as them.
+func loginAdmin(t *testing.T, s *server) (*testClient, uint) {
+	t.Helper()
+	c := s.testClient()
+	var admin entity
+	if err := c.callOK(CreatePersonMethod, map[string]interface{}{"name": "admin", "age": 40, "password": "admin password"}, &admin); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.login(admin.Id, "admin password"); err != nil {
+		t.Fatal(err)
+	}
+	return c, admin.Id
+}
+
+type entity struct {
+	Id   uint   `json:"id"`
+	Name string `json:"name"`
+}
+
+// idPool is the IDs of one kind of record. All holds every ID ever handed
+// out, to catch duplicates; live those not deleted, to pick from.
+type idPool struct {
+	all  map[uint]bool
+	live []uint
+}
+
+func newIdPool() *idPool {
+	return &idPool{all: make(map[uint]bool)}
+}
+
+// stressResults collects what the workers created.
+type stressResults struct {
+	mu      sync.Mutex
+	schools *idPool
+	people  *idPool
+	classes *idPool
+	// passwords holds the password of the people created with one.
+	passwords map[uint]string
+}
+
+func (r *stressResults) created(t *testing.T, kind string, p *idPool, id uint) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if p.all[id] {
+		t.Errorf("%s id %d handed out twice", kind, id)
+		return
+	}
+	p.all[id] = true
+	p.live = append(p.live, id)
+}
+
+func (r *stressResults) deleted(p *idPool, id uint) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p.live = slices.DeleteFunc(p.live, func(live uint) bool { return live == id })
+}
+
+func (r *stressResults) pick(rng *rand.Rand, p *idPool) (uint, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(p.live) == 0 {
+		return 0, false
+	}
+	return p.live[rng.Intn(len(p.live))], true
+}
+
+// credentials picks a person created with a password.
+func (r *stressResults) credentials(rng *rand.Rand) (uint, string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, i := range rng.Perm(len(r.people.live)) {
+		if password, ok := r.passwords[r.people.live[i]]; ok {
+			return r.people.live[i], password, true
+		}
+	}
+	return 0, "", false
+}
+
+// TestConcurrentRequests makes random requests of every kind from many
+// clients at once, then checks that the data is still consistent. Run it
+// with -race to find unsynchronized access too.
+func TestConcurrentRequests(t *testing.T) {
+	workers, ops := 16, 200
+	if testing.Short() {
+		workers, ops = 4, 50
+	}
+
+	s := newTestServer()
+	admin, adminId := loginAdmin(t, s)
+	r := &stressResults{
+		schools:   newIdPool(),
+		people:    newIdPool(),
+		classes:   newIdPool(),
+		passwords: make(map[uint]string),
+	}
+	r.created(t, "person", r.people, adminId)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := &testClient{s: s, auth: &connAuth{token: admin.auth.token}}
+			if err := stressWorker(t, c, w, ops, r); err != nil {
+				t.Errorf("worker %d: %v", w, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	checkConsistent(t, s, admin)
+}
+
+// stressWorker runs ops random requests as the admin. Records are picked
+// from everything any worker created, so workers race on the same records;
+// many requests fail because of that, which is expected. Logins happen on a
+// second client, as the people created with passwords.
+func stressWorker(t *testing.T, c *testClient, worker, ops int, r *stressResults) error {
+	probe := c.s.testClient()
+	rng := rand.New(rand.NewSource(int64(worker)))
+	for i := 0; i < ops; i++ {
+		name := fmt.Sprintf("w%d-%d", worker, i)
+		var method string
+		var data map[string]interface{}
+		var kind string
+		var created, deleted *idPool
+
+		schoolId, hasSchool := r.pick(rng, r.schools)
+		personId, hasPerson := r.pick(rng, r.people)
+		otherId, _ := r.pick(rng, r.people)
+		classId, hasClass := r.pick(rng, r.classes)
+
+		switch n := rng.Intn(100); {
+		case n < 8 || !hasSchool:
+			method, kind, created = CreateSchoolMethod, "school", r.schools
+			data = map[string]interface{}{"name": name}
+		case n < 25 || !hasPerson:
+			method, kind, created = CreatePersonMethod, "person", r.people
+			data = map[string]interface{}{"name": name, "age": 10 + rng.Intn(50)}
+			if rng.Intn(10) == 0 {
+				data["password"] = "secret " + name
+			}
+		case n < 37:
+			method, kind, created = CreateClassMethod, "class", r.classes
+			data = map[string]interface{}{"name": name, "school_id": schoolId, "teacher": map[string]interface{}{"id": personId}}
+		case n < 55 && hasClass:
+			method = AddStudentToClassMethod
+			data = map[string]interface{}{"class_id": classId, "student_id": otherId}
+		case n < 60 && hasClass:
+			// Pick a student of the class, or this rarely succeeds.
+			var current jsonClass
+			if err := c.callOK(GetClassMethod, map[string]interface{}{"id": classId}, &current); err == nil && len(current.Students) > 0 {
+				otherId = current.Students[rng.Intn(len(current.Students))].Id
+			}
+			method = RemoveStudentMethod
+			data = map[string]interface{}{"class_id": classId, "student_id": otherId}
+		case n < 64:
+			method = UpdateSchoolMethod
+			data = map[string]interface{}{"id": schoolId, "name": name}
+		case n < 70:
+			method = UpdatePersonMethod
+			data = map[string]interface{}{"id": personId, "name": name, "age": rng.Intn(80)}
+		case n < 74 && hasClass:
+			method = UpdateClassMethod
+			data = map[string]interface{}{"id": classId, "name": name}
+		case n < 77:
+			method, deleted = DeleteSchoolMethod, r.schools
+			data = map[string]interface{}{"id": schoolId, "cascade": rng.Intn(2) == 0}
+		case n < 81:
+			method, deleted = DeletePersonMethod, r.people
+			data = map[string]interface{}{"id": personId}
+		case n < 84 && hasClass:
+			method, deleted = DeleteClassMethod, r.classes
+			data = map[string]interface{}{"id": classId}
+		case n < 86:
+			id, password, ok := r.credentials(rng)
+			if !ok || probe.login(id, password) != nil {
+				// Nobody can log in yet, or the person was deleted meanwhile.
+				continue
+			}
+			var me entity
+			if err := probe.callOK(WhoAmIMethod, nil, &me); err == nil && me.Id != id {
+				return fmt.Errorf("logged in as person %d, but am %d", id, me.Id)
+			}
+			continue
+		default:
+			method = ListClassesMethod
+			data = map[string]interface{}{"limit": 10}
+		}
+
+		resp, err := c.call(method, data)
+		if err != nil {
+			return err
+		}
+		if !resp.Status {
+			continue
+		}
+		if created != nil {
+			var e entity
+			raw, _ := json.Marshal(resp.Data)
+			if err := json.Unmarshal(raw, &e); err != nil {
+				return err
+			}
+			r.created(t, kind, created, e.Id)
+			if password, ok := data["password"].(string); ok {
+				r.mu.Lock()
+				r.passwords[e.Id] = password
+				r.mu.Unlock()
+			}
+		}
+		if deleted != nil {
+			r.deleted(deleted, data["id"].(uint))
+		}
+	}
+	return nil
+}
+
+type (
+	jsonPerson struct {
+		entity
+		Age     int    `json:"age"`
+		Classes []uint `json:"classes"`
+	}
+	jsonClass struct {
+		entity
+		SchoolId uint         `json:"school_id"`
+		Teacher  jsonPerson   `json:"teacher"`
+		Students []jsonPerson `json:"students"`
+	}
+	jsonSchool struct {
+		entity
+		Classes []jsonClass `json:"classes"`
+	}
+)
+
+// listAll fetches every page of a list.
+func listAll[T any](t *testing.T, c *testClient, method string) []T {
+	t.Helper()
+	var all []T
+	cursor := ""
+	for {
+		var page pageOf[T]
+		if err := c.callOK(method, map[string]interface{}{"cursor": cursor, "limit": maxPageSize}, &page); err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, page.Items...)
+		if page.NextCursor == "" {
+			return all
+		}
+		cursor = page.NextCursor
+	}
+}
+
+// checkConsistent checks that no record refers to one that does not exist,
+// both in the stored records and in what clients read: both sides of every
+// relation agree, and the records nested in others match the records
+// themselves.
+func checkConsistent(t *testing.T, s *server, c *testClient) {
+	t.Helper()
+	repo := s.repo.(*memoryRepository)
+	repo.mu.RLock()
+	err := repo.data.checkReferences()
+	repo.mu.RUnlock()
+	if err != nil {
+		t.Error(err)
+	}
+
+	schools := listAll[jsonSchool](t, c, ListSchoolsMethod)
+	classes := listAll[jsonClass](t, c, ListClassesMethod)
+	people := listAll[jsonPerson](t, c, ListPeopleMethod)
+
+	schoolsById := make(map[uint]jsonSchool)
+	for _, s := range schools {
+		schoolsById[s.Id] = s
+	}
+	classesById := make(map[uint]jsonClass)
+	for _, c := range classes {
+		classesById[c.Id] = c
+	}
+	peopleById := make(map[uint]jsonPerson)
+	for _, p := range people {
+		peopleById[p.Id] = p
+	}
+
+	var errs []error
+	samePerson := func(where string, copy jsonPerson) {
+		p, ok := peopleById[copy.Id]
+		switch {
+		case !ok:
+			errs = append(errs, fmt.Errorf("%s refers to missing person %d", where, copy.Id))
+		case p.Name != copy.Name || p.Age != copy.Age || !sameIds(p.Classes, copy.Classes):
+			errs = append(errs, fmt.Errorf("%s has a stale copy of person %d: %+v, not %+v", where, copy.Id, copy, p))
+		}
+	}
+	sameClass := func(where string, copy jsonClass) {
+		c, ok := classesById[copy.Id]
+		switch {
+		case !ok:
+			errs = append(errs, fmt.Errorf("%s refers to missing class %d", where, copy.Id))
+		case c.Name != copy.Name || c.SchoolId != copy.SchoolId || c.Teacher.Id != copy.Teacher.Id || len(c.Students) != len(copy.Students):
+			errs = append(errs, fmt.Errorf("%s has a stale copy of class %d", where, copy.Id))
+		}
+	}
+
+	for _, s := range schools {
+		where := fmt.Sprintf("school %d", s.Id)
+		for _, copy := range s.Classes {
+			sameClass(where, copy)
+			if copy.SchoolId != s.Id {
+				errs = append(errs, fmt.Errorf("%s lists class %d of school %d", where, copy.Id, copy.SchoolId))
+			}
+		}
+	}
+	for _, c := range classes {
+		where := fmt.Sprintf("class %d", c.Id)
+		s, ok := schoolsById[c.SchoolId]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s belongs to missing school %d", where, c.SchoolId))
+		} else if !slices.ContainsFunc(s.Classes, func(copy jsonClass) bool { return copy.Id == c.Id }) {
+			errs = append(errs, fmt.Errorf("school %d does not list its class %d", c.SchoolId, c.Id))
+		}
+		for _, member := range append([]jsonPerson{c.Teacher}, c.Students...) {
+			samePerson(where, member)
+			if p, ok := peopleById[member.Id]; ok && !slices.Contains(p.Classes, c.Id) {
+				errs = append(errs, fmt.Errorf("person %d does not list their class %d", p.Id, c.Id))
+			}
+		}
+	}
+	for _, p := range people {
+		for _, id := range p.Classes {
+			c, ok := classesById[id]
+			if !ok {
+				errs = append(errs, fmt.Errorf("person %d lists missing class %d", p.Id, id))
+				continue
+			}
+			isStudent := slices.ContainsFunc(c.Students, func(student jsonPerson) bool { return student.Id == p.Id })
+			if c.Teacher.Id != p.Id && !isStudent {
+				errs = append(errs, fmt.Errorf("person %d lists class %d without being in it", p.Id, id))
+			}
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		t.Error(err)
+	}
+}
+
+// sameIds reports whether a and b hold the same IDs, in any order.
+func sameIds(a, b []uint) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(slices.Compact(a), slices.Compact(b))
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Request types declare the rules their fields follow in validate tags,
+// separated by commas:
+//
+//	required   the field is set: a string is not blank, a number is not zero
+//	           and a list is not empty
+//	min=N      a number is at least N, a string has at least N characters
+//	           and a list at least N items
+//	max=N      likewise, at most
+//	oneof=A B  the field is one of the values listed
+//
+// A nil pointer is a field that was left out and follows no rules; the
+// rules of a pointer apply to the value it points to. Nested structs are
+// validated too.
+
+// decodeRequest decodes request data into v, a pointer to a request struct,
+// and validates it. Fields that v does not have are rejected.
+func (s *server) decodeRequest(data, v interface{}) error {
+	reqData, err := json.Marshal(data)
+	if err != nil {
+		return invalidRequest("Invalid request data")
+	}
+	decoder := json.NewDecoder(bytes.NewReader(reqData))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return decodeError(err)
+	}
+	return validate(v)
+}
+
+// decodeError turns an error decoding request data into the field it is
+// about, where it can tell.
+func decodeError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return validationError{{Field: typeErr.Field, Code: "type", Message: "must be " + describeType(typeErr.Type)}}
+	}
+	if quoted, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		field, unquoteErr := strconv.Unquote(quoted)
+		if unquoteErr == nil {
+			return validationError{{Field: field, Code: "unknown", Message: "is not a known field"}}
+		}
+	}
+	return invalidRequest("Invalid request data")
+}
+
+func describeType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "a non-negative integer"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Slice, reflect.Array:
+		return "a list"
+	case reflect.Pointer:
+		return describeType(t.Elem())
+	default:
+		return "an object"
+	}
+}
+
+// validate checks the fields of the struct v points to against their
+// validate tags, and returns a validationError listing all that fail.
+func validate(v interface{}) error {
+	var errs validationError
+	validateStruct(reflect.ValueOf(v).Elem(), "", &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func validateStruct(v reflect.Value, prefix string, errs *validationError) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		value := v.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			validateStruct(value, prefix, errs)
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		name = prefix + name
+
+		if value.Kind() == reflect.Pointer {
+			if value.IsNil() {
+				continue
+			}
+			value = value.Elem()
+		}
+		if rules := field.Tag.Get("validate"); rules != "" {
+			for _, rule := range strings.Split(rules, ",") {
+				if fe, ok := checkRule(value, rule); !ok {
+					fe.Field = name
+					*errs = append(*errs, fe)
+				}
+			}
+		}
+		if value.Kind() == reflect.Struct {
+			validateStruct(value, name+".", errs)
+		}
+	}
+}
+
+// checkRule checks value against one rule, and describes how it fails.
+func checkRule(value reflect.Value, rule string) (fieldError, bool) {
+	name, arg, _ := strings.Cut(rule, "=")
+	switch name {
+	case "required":
+		if isBlank(value) {
+			return fieldError{Code: "required", Message: "is required"}, false
+		}
+	case "min", "max":
+		limit, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			panic(fmt.Sprintf("validate: bad %s rule %q", name, rule))
+		}
+		size, unit := measure(value)
+		if name == "min" && size < limit {
+			return fieldError{Code: "min", Message: fmt.Sprintf("must be at least %s%s", arg, unit)}, false
+		}
+		if name == "max" && size > limit {
+			return fieldError{Code: "max", Message: fmt.Sprintf("must be at most %s%s", arg, unit)}, false
+		}
+	case "oneof":
+		options := strings.Fields(arg)
+		for _, option := range options {
+			if fmt.Sprint(value.Interface()) == option {
+				return fieldError{}, true
+			}
+		}
+		return fieldError{Code: "oneof", Message: "must be one of " + strings.Join(options, ", ")}, false
+	default:
+		panic(fmt.Sprintf("validate: unknown rule %q", rule))
+	}
+	return fieldError{}, true
+}
+
+func isBlank(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.String:
+		return strings.TrimSpace(value.String()) == ""
+	case reflect.Slice, reflect.Map:
+		return value.Len() == 0
+	default:
+		return value.IsZero()
+	}
+}
+
+// measure returns the size min and max compare to their limit, and the
+// unit to name in messages.
+func measure(value reflect.Value) (float64, string) {
+	switch value.Kind() {
+	case reflect.String:
+		return float64(utf8.RuneCountInString(value.String())), " characters"
+	case reflect.Slice, reflect.Map:
+		return float64(value.Len()), " items"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int()), ""
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint()), ""
+	case reflect.Float32, reflect.Float64:
+		return value.Float(), ""
+	default:
+		panic("validate: cannot measure a " + value.Kind().String())
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// validated exercises every rule on the kinds of fields requests use.
+type validated struct {
+	Name     string    `json:"name" validate:"required,max=5"`
+	Age      int       `json:"age" validate:"min=0,max=150"`
+	Count    *int      `json:"count" validate:"min=1,max=3"`
+	Nickname *string   `json:"nickname" validate:"required,min=2"`
+	Tags     []string  `json:"tags" validate:"max=2"`
+	Kind     string    `json:"kind" validate:"oneof=a b"`
+	Ref      personRef `json:"ref"`
+	embeddedRules
+}
+
+type embeddedRules struct {
+	Level uint `json:"level" validate:"max=9"`
+}
+
+// failures returns the invalid fields of err as "field:code".
+func failures(t *testing.T, err error) []string {
+	t.Helper()
+	if err == nil {
+		return nil
+	}
+	var invalid validationError
+	if !errors.As(err, &invalid) {
+		t.Fatalf("got %v, want a validationError", err)
+	}
+	var got []string
+	for _, fe := range invalid {
+		got = append(got, fe.Field+":"+fe.Code)
+	}
+	return got
+}
+
+func TestDecodeRequestValidates(t *testing.T) {
+	s := newTestServer()
+	// valid is a request every rule accepts; each test changes it.
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{"name": "ab", "kind": "a", "ref": map[string]interface{}{"id": 1}}
+	}
+	tests := []struct {
+		name   string
+		change map[string]interface{}
+		want   []string
+	}{
+		{"valid", nil, nil},
+		{"required string missing", map[string]interface{}{"name": nil}, []string{"name:required"}},
+		{"required string blank", map[string]interface{}{"name": "  "}, []string{"name:required"}},
+		{"string at max", map[string]interface{}{"name": "abcde"}, nil},
+		{"string over max", map[string]interface{}{"name": "abcdef"}, []string{"name:max"}},
+		{"max counts characters not bytes", map[string]interface{}{"name": "ééééé"}, nil},
+		{"int under min", map[string]interface{}{"age": -1}, []string{"age:min"}},
+		{"int at bounds", map[string]interface{}{"age": 150}, nil},
+		{"int over max", map[string]interface{}{"age": 151}, []string{"age:max"}},
+		{"uint over max in an embedded struct", map[string]interface{}{"level": 10}, []string{"level:max"}},
+		{"pointer left out follows no rules", map[string]interface{}{"count": nil, "nickname": nil}, nil},
+		{"pointer to an int under min", map[string]interface{}{"count": 0}, []string{"count:min"}},
+		{"pointer to an int over max", map[string]interface{}{"count": 4}, []string{"count:max"}},
+		{"pointer to an int in range", map[string]interface{}{"count": 2}, nil},
+		{"pointer to a blank string", map[string]interface{}{"nickname": ""}, []string{"nickname:required", "nickname:min"}},
+		{"pointer to a short string", map[string]interface{}{"nickname": "x"}, []string{"nickname:min"}},
+		{"list over max", map[string]interface{}{"tags": []string{"a", "b", "c"}}, []string{"tags:max"}},
+		{"oneof", map[string]interface{}{"kind": "c"}, []string{"kind:oneof"}},
+		{"nested required", map[string]interface{}{"ref": map[string]interface{}{}}, []string{"ref.id:required"}},
+		{"nested fields ignored", map[string]interface{}{"ref": map[string]interface{}{"id": 2, "name": "x", "age": 3}}, nil},
+		{"every failure listed", map[string]interface{}{"name": "", "age": -1, "ref": map[string]interface{}{"id": 0}}, []string{"name:required", "age:min", "ref.id:required"}},
+		{"unknown field", map[string]interface{}{"surname": "x"}, []string{"surname:unknown"}},
+		{"unknown nested field", map[string]interface{}{"ref": map[string]interface{}{"id": 1, "email": "x"}}, []string{"email:unknown"}},
+		{"wrong type", map[string]interface{}{"age": "old"}, []string{"age:type"}},
+		{"wrong nested type", map[string]interface{}{"ref": map[string]interface{}{"id": -1}}, []string{"ref.id:type"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := valid()
+			for field, value := range tt.change {
+				if value == nil {
+					delete(data, field)
+				} else {
+					data[field] = value
+				}
+			}
+			var req validated
+			got := failures(t, s.decodeRequest(data, &req))
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("invalid fields %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidationErrorMessages(t *testing.T) {
+	s := newTestServer()
+	var req validated
+	err := s.decodeRequest(map[string]interface{}{"name": "abcdef", "kind": "a", "ref": map[string]interface{}{"id": 1}}, &req)
+	if want := "Invalid request data: name must be at most 5 characters"; fmt.Sprint(err) != want {
+		t.Fatalf("got %q, want %q", err, want)
+	}
+
+	var fresh validated
+	resp := errorResponse(s.decodeRequest(map[string]interface{}{"tags": []string{"a", "b", "c"}, "age": 200}, &fresh))
+	detail, _ := resp.Data.(errorDetail)
+	if resp.Message != "Invalid request data: 5 invalid fields" || detail.Code != codeInvalidRequest || len(detail.Fields) != 5 {
+		t.Fatalf("got %q with %+v", resp.Message, detail)
+	}
+}
+
+func TestDecodeRequestRejectsNonObjects(t *testing.T) {
+	s := newTestServer()
+	for _, data := range []interface{}{"text", 1, []interface{}{}} {
+		var req validated
+		err := s.decodeRequest(data, &req)
+		var reqErr requestError
+		if !errors.As(err, &reqErr) || reqErr.code != codeInvalidRequest {
+			t.Errorf("data %v: got %v, want an invalid request", data, err)
+		}
+	}
+}
+
+func TestUnknownRulePanics(t *testing.T) {
+	type badRule struct {
+		Name string `json:"name" validate:"shorter=3"`
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("an unknown rule did not panic")
+		}
+	}()
+	validate(&badRule{})
+}
@@ -0,0 +1,418 @@
+// Package client speaks the QueraMQ newline-delimited JSON protocol served
+// by server.handleConnection. It answers heartbeats on its own, once asked
+// for with EnableHeartbeats, and keeps deliveries pushed by the broker apart
+// from responses to requests.
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned by requests made after the connection went away.
+var ErrClosed = errors.New("client: connection closed")
+
+// Delivery is a message pushed to a subscriber.
+type Delivery struct {
+	Topic    string
+	ID       string            `json:"id"`
+	Content  string            `json:"content"`
+	Priority int               `json:"priority"`
+	Headers  map[string]string `json:"headers"`
+}
+
+type TopicStats struct {
+	Topic            string  `json:"topic"`
+	Depth            int     `json:"depth"`
+	InFlight         int     `json:"in_flight"`
+	Subscribers      int     `json:"subscribers"`
+	Filtered         int     `json:"filtered"`
+	OldestAgeSeconds float64 `json:"oldest_age_seconds"`
+}
+
+// Quota limits what a namespace may use. Zero fields mean no limit.
+type Quota struct {
+	MaxTopics      int `json:"max_topics"`
+	MaxMessages    int `json:"max_messages"`
+	MaxConnections int `json:"max_connections"`
+}
+
+// RateLimitedError is returned by requests the broker refused to stay
+// within a rate limit. Retrying after RetryAfter can succeed.
+type RateLimitedError struct {
+	// Scope is the limit that refused: connection, identity or topic.
+	Scope      string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("rate limited per %s, retry after %s", e.Scope, e.RetryAfter)
+}
+
+// envelope holds the fields needed to route an incoming line.
+type envelope struct {
+	Action       string    `json:"action"`
+	Topic        string    `json:"topic"`
+	Message      *Delivery `json:"message"`
+	Error        string    `json:"error"`
+	Scope        string    `json:"scope"`
+	RetryAfterMS int64     `json:"retry_after_ms"`
+}
+
+type Client struct {
+	conn      net.Conn
+	wmu       sync.Mutex
+	reqMu     sync.Mutex
+	responses chan json.RawMessage
+	// waiting is set while a call waits for its response, so that the
+	// reader can drop responses nobody asked for.
+	respMu     sync.Mutex
+	waiting    bool
+	deliveries chan Delivery
+	// pending holds the deliveries read but not yet received from
+	// Deliveries, so that the reader never waits for the application.
+	pendingMu sync.Mutex
+	pending   []Delivery
+	queued    chan struct{}
+	closing   chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+	err       error
+}
+
+func Dial(addr string) (*Client, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return New(conn), nil
+}
+
+// New wraps an established connection, for example one dialed through a
+// proxy or wrapped in TLS.
+func New(conn net.Conn) *Client {
+	c := &Client{
+		conn:       conn,
+		responses:  make(chan json.RawMessage, 1),
+		deliveries: make(chan Delivery),
+		queued:     make(chan struct{}, 1),
+		closing:    make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go c.readLoop()
+	go c.pump()
+	return c
+}
+
+// Deliveries returns the messages pushed to this client's subscriptions.
+// Messages wait in an unbounded queue until received, so requests and
+// heartbeats go on however far behind the application is. The channel is
+// closed once the connection has ended and every queued message has been
+// received, or as soon as Close is called.
+func (c *Client) Deliveries() <-chan Delivery {
+	return c.deliveries
+}
+
+// Done is closed when the connection ends; Err then reports why.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *Client) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() { close(c.closing) })
+	return c.conn.Close()
+}
+
+// Hello selects the namespace whose topics this connection uses. It must be
+// the first request; connections that skip it use the default namespace.
+func (c *Client) Hello(namespace string) error {
+	return c.call(map[string]interface{}{"action": "hello", "namespace": namespace}, nil)
+}
+
+// HelloWithToken is Hello for a client that authenticates with a token the
+// broker was configured with, for example to manage namespaces. The
+// broker's per-identity rate limits then count all connections of the
+// token's principal together.
+func (c *Client) HelloWithToken(namespace, token string) error {
+	return c.call(map[string]interface{}{"action": "hello", "namespace": namespace, "token": token}, nil)
+}
+
+// EnableHeartbeats asks the broker to ping this connection, which the
+// client answers on its own. The broker then disconnects the client, and
+// requeues its unacknowledged deliveries, once it has gone silent for a few
+// heartbeat intervals.
+func (c *Client) EnableHeartbeats() error {
+	return c.call(map[string]interface{}{"action": "heartbeat"}, nil)
+}
+
+// PublishWait publishes like Publish, but when the broker refuses because of
+// a rate limit it waits for the hinted time and tries again.
+func (c *Client) PublishWait(topic, content string, priority int, headers map[string]string) error {
+	for {
+		err := c.Publish(topic, content, priority, headers)
+		var limited *RateLimitedError
+		if !errors.As(err, &limited) {
+			return err
+		}
+		select {
+		case <-time.After(limited.RetryAfter):
+		case <-c.done:
+			return ErrClosed
+		}
+	}
+}
+
+// CreateNamespace adds a namespace. The connection must have authenticated
+// as an admin with HelloWithToken.
+func (c *Client) CreateNamespace(name string, quota Quota) error {
+	return c.call(map[string]interface{}{"action": "create_namespace", "namespace": name, "quota": quota}, nil)
+}
+
+// DeleteNamespace removes a namespace and disconnects its clients. Like
+// CreateNamespace, it needs an admin connection.
+func (c *Client) DeleteNamespace(name string) error {
+	return c.call(map[string]interface{}{"action": "delete_namespace", "namespace": name}, nil)
+}
+
+func (c *Client) Publish(topic, content string, priority int, headers map[string]string) error {
+	message := map[string]interface{}{
+		"topic":    topic,
+		"content":  content,
+		"priority": priority,
+	}
+	if len(headers) > 0 {
+		message["headers"] = headers
+	}
+	return c.call(map[string]interface{}{"action": "publish", "message": message}, nil)
+}
+
+// Subscribe starts deliveries from topic, limited to messages matching
+// filter when it is not empty. The broker settles each message once it has
+// sent it, so a message is lost if the client fails to process it.
+func (c *Client) Subscribe(topic, filter string) error {
+	return c.subscribe(topic, filter, false)
+}
+
+// SubscribeWithAcks is Subscribe, except that every delivery must be
+// settled with Ack. Messages left unacknowledged for 30 seconds, or when
+// the connection ends, are delivered again.
+func (c *Client) SubscribeWithAcks(topic, filter string) error {
+	return c.subscribe(topic, filter, true)
+}
+
+func (c *Client) subscribe(topic, filter string, acks bool) error {
+	request := map[string]interface{}{"action": "subscribe", "topic": topic}
+	if filter != "" {
+		request["filter"] = filter
+	}
+	if acks {
+		request["ack"] = true
+	}
+	return c.call(request, nil)
+}
+
+func (c *Client) Unsubscribe(topic string) error {
+	return c.call(map[string]interface{}{"action": "unsubscribe", "topic": topic}, nil)
+}
+
+func (c *Client) Ack(topic, id string) error {
+	return c.call(map[string]interface{}{"action": "ack", "topic": topic, "id": id}, nil)
+}
+
+func (c *Client) Begin() error {
+	return c.call(map[string]interface{}{"action": "begin"}, nil)
+}
+
+func (c *Client) Commit() error {
+	return c.call(map[string]interface{}{"action": "commit"}, nil)
+}
+
+func (c *Client) Rollback() error {
+	return c.call(map[string]interface{}{"action": "rollback"}, nil)
+}
+
+func (c *Client) Topics() ([]string, error) {
+	var response struct {
+		Topics []string `json:"topics"`
+	}
+	err := c.call(map[string]interface{}{"action": "topics"}, &response)
+	return response.Topics, err
+}
+
+// Stats returns the statistics of topic, or of every topic when topic is
+// empty.
+func (c *Client) Stats(topic string) ([]TopicStats, error) {
+	request := map[string]interface{}{"action": "stats"}
+	if topic != "" {
+		request["topic"] = topic
+	}
+	var response struct {
+		Stats []TopicStats `json:"stats"`
+	}
+	err := c.call(request, &response)
+	return response.Stats, err
+}
+
+// Purge drops every queued message of topic and returns how many there were.
+func (c *Client) Purge(topic string) (int, error) {
+	var response struct {
+		Purged int `json:"purged"`
+	}
+	err := c.call(map[string]interface{}{"action": "purge", "topic": topic}, &response)
+	return response.Purged, err
+}
+
+// call sends request and decodes the matching response into result. The
+// broker answers requests in order, so only one may be outstanding.
+func (c *Client) call(request interface{}, result interface{}) error {
+	c.reqMu.Lock()
+	defer c.reqMu.Unlock()
+
+	c.setWaiting(true)
+	if err := c.send(request); err != nil {
+		c.setWaiting(false)
+		return err
+	}
+
+	select {
+	case raw := <-c.responses:
+		var env envelope
+		if err := json.Unmarshal(raw, &env); err != nil {
+			return err
+		}
+		if env.Error == "rate_limited" {
+			return &RateLimitedError{Scope: env.Scope, RetryAfter: time.Duration(env.RetryAfterMS) * time.Millisecond}
+		}
+		if env.Error != "" {
+			return errors.New(env.Error)
+		}
+		if result != nil {
+			return json.Unmarshal(raw, result)
+		}
+		return nil
+	case <-c.done:
+		if c.err != nil {
+			return c.err
+		}
+		return ErrClosed
+	}
+}
+
+func (c *Client) send(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err = c.conn.Write(append(data, '\n'))
+	return err
+}
+
+func (c *Client) readLoop() {
+	defer close(c.done)
+
+	decoder := json.NewDecoder(c.conn)
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			c.err = fmt.Errorf("client: %w", err)
+			return
+		}
+
+		var env envelope
+		if err := json.Unmarshal(raw, &env); err != nil {
+			c.err = fmt.Errorf("client: %w", err)
+			return
+		}
+
+		switch env.Action {
+		case "ping":
+			if err := c.send(map[string]interface{}{"action": "pong"}); err != nil {
+				c.err = fmt.Errorf("client: %w", err)
+				return
+			}
+		case "pong":
+		case "message":
+			if env.Message != nil {
+				delivery := *env.Message
+				delivery.Topic = env.Topic
+				c.enqueue(delivery)
+			}
+		default:
+			c.respMu.Lock()
+			if c.waiting {
+				c.waiting = false
+				c.responses <- raw
+			}
+			// Otherwise nobody asked for it, and handing it to the next
+			// call would answer that call with the wrong response.
+			c.respMu.Unlock()
+		}
+	}
+}
+
+func (c *Client) setWaiting(waiting bool) {
+	c.respMu.Lock()
+	c.waiting = waiting
+	c.respMu.Unlock()
+}
+
+func (c *Client) enqueue(delivery Delivery) {
+	c.pendingMu.Lock()
+	c.pending = append(c.pending, delivery)
+	c.pendingMu.Unlock()
+	select {
+	case c.queued <- struct{}{}:
+	default:
+	}
+}
+
+// pump hands queued deliveries to the Deliveries channel in order.
+func (c *Client) pump() {
+	defer close(c.deliveries)
+	for {
+		c.pendingMu.Lock()
+		batch := c.pending
+		c.pending = nil
+		c.pendingMu.Unlock()
+
+		for _, delivery := range batch {
+			select {
+			case c.deliveries <- delivery:
+			case <-c.closing:
+				return
+			}
+		}
+		if len(batch) > 0 {
+			continue
+		}
+
+		select {
+		case <-c.queued:
+		case <-c.done:
+			c.pendingMu.Lock()
+			drained := len(c.pending) == 0
+			c.pendingMu.Unlock()
+			if drained {
+				return
+			}
+		case <-c.closing:
+			return
+		}
+	}
+}
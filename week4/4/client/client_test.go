@@ -0,0 +1,220 @@
+package client_test
+
+import (
+	"QueraMQ/client"
+	"QueraMQ/server"
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func startServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	s := server.NewServer(addr)
+	go s.Run()
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i == 100 {
+			t.Fatal("server did not start:", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Cleanup(s.Stop)
+	return addr
+}
+
+func dial(t *testing.T, addr string) *client.Client {
+	t.Helper()
+	c, err := client.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// Deliveries from many backlogged topics must not hold up responses while
+// the application is not reading them yet.
+func TestRequestsWithUndrainedDeliveries(t *testing.T) {
+	addr := startServer(t)
+	publisher := dial(t, addr)
+	const topics, perTopic = 8, 20
+	for i := 0; i < topics; i++ {
+		for j := 0; j < perTopic; j++ {
+			if err := publisher.Publish(fmt.Sprint("backlog-", i), fmt.Sprint(j), 1, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	subscriber := dial(t, addr)
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < topics; i++ {
+			if err := subscriber.Subscribe(fmt.Sprint("backlog-", i), ""); err != nil {
+				done <- err
+				return
+			}
+		}
+		_, err := subscriber.Topics()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("requests blocked behind undrained deliveries")
+	}
+
+	received := 0
+	timeout := time.After(5 * time.Second)
+	for received < topics*perTopic {
+		select {
+		case <-subscriber.Deliveries():
+			received++
+		case <-timeout:
+			t.Fatalf("received %d of %d messages", received, topics*perTopic)
+		}
+	}
+}
+
+func TestDeliveriesClosedOnClose(t *testing.T) {
+	addr := startServer(t)
+	publisher := dial(t, addr)
+	for i := 0; i < 3; i++ {
+		if err := publisher.Publish("closing", fmt.Sprint(i), 1, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	subscriber := dial(t, addr)
+	if err := subscriber.Subscribe("closing", ""); err != nil {
+		t.Fatal(err)
+	}
+	subscriber.Close()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-subscriber.Deliveries():
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("Deliveries was not closed")
+		}
+	}
+}
+
+// fakeBroker is the broker end of a pipe to a client under test.
+type fakeBroker struct {
+	conn  net.Conn
+	lines *bufio.Scanner
+}
+
+func newFakeBroker(t *testing.T) (*client.Client, *fakeBroker) {
+	t.Helper()
+	clientEnd, brokerEnd := net.Pipe()
+	c := client.New(clientEnd)
+	t.Cleanup(func() {
+		c.Close()
+		brokerEnd.Close()
+	})
+	return c, &fakeBroker{conn: brokerEnd, lines: bufio.NewScanner(brokerEnd)}
+}
+
+func (b *fakeBroker) write(t *testing.T, line string) {
+	t.Helper()
+	b.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := fmt.Fprintln(b.conn, line); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (b *fakeBroker) read(t *testing.T) string {
+	t.Helper()
+	b.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if !b.lines.Scan() {
+		t.Fatalf("client sent nothing: %v", b.lines.Err())
+	}
+	return b.lines.Text()
+}
+
+// A response that arrives while no request waits for it must not answer
+// the next request.
+func TestUnsolicitedResponseIsDropped(t *testing.T) {
+	c, broker := newFakeBroker(t)
+
+	broker.write(t, `{"status": "ok", "topics": ["stale"]}`)
+	// The client reads in order, so once it answers this ping it has
+	// handled the stray response.
+	broker.write(t, `{"action": "ping"}`)
+	if line := broker.read(t); line != `{"action":"pong"}` {
+		t.Fatalf("client answered the ping with %s", line)
+	}
+
+	result := make(chan []string, 1)
+	go func() {
+		topics, err := c.Topics()
+		if err != nil {
+			t.Error(err)
+		}
+		result <- topics
+	}()
+	if line := broker.read(t); line != `{"action":"topics"}` {
+		t.Fatalf("client sent %s, want a topics request", line)
+	}
+	broker.write(t, `{"status": "ok", "topics": ["fresh"]}`)
+
+	select {
+	case topics := <-result:
+		if len(topics) != 1 || topics[0] != "fresh" {
+			t.Fatalf("Topics() = %v, want the response to its own request", topics)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Topics() did not return")
+	}
+}
+
+func TestErrorResponseFailsCall(t *testing.T) {
+	c, broker := newFakeBroker(t)
+	errs := make(chan error, 1)
+	go func() { errs <- c.Ack("orders", "unknown") }()
+	broker.read(t)
+	broker.write(t, `{"error": "message not in flight"}`)
+
+	if err := <-errs; err == nil || err.Error() != "message not in flight" {
+		t.Fatalf("Ack() = %v, want the broker's error", err)
+	}
+}
+
+func TestCallFailsOnceConnectionEnds(t *testing.T) {
+	c, broker := newFakeBroker(t)
+	errs := make(chan error, 1)
+	go func() { _, err := c.Topics(); errs <- err }()
+	broker.read(t)
+	broker.conn.Close()
+
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Fatal("Topics() succeeded on a closed connection")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Topics() did not return after the connection ended")
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"QueraMQ/client"
+	"QueraMQ/server"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sentAtHeader carries the publish time so subscribers can measure
+// end-to-end latency.
+const sentAtHeader = "querabench-sent-at"
+
+func runBroker(args []string) error {
+	fs := flag.NewFlagSet("broker", flag.ExitOnError)
+	addr := fs.String("addr", "", "broker address; empty starts an in-process broker")
+	topic := fs.String("topic", "querabench", "topic to use")
+	publishers := fs.Int("publishers", 4, "number of publishing connections")
+	subscribers := fs.Int("subscribers", 4, "number of subscribing connections")
+	messages := fs.Int("messages", 20000, "total number of messages")
+	size := fs.Int("size", 128, "message body size in bytes")
+	rate := fs.Int("rate", 0, "total publish rate in messages per second, 0 for unlimited")
+	timeout := fs.Duration("timeout", time.Minute, "give up when not every message arrived by then")
+	fs.Parse(args)
+
+	if *publishers < 1 || *subscribers < 1 || *messages < 1 {
+		return errors.New("-publishers, -subscribers and -messages must be positive")
+	}
+
+	if *addr == "" {
+		local, err := startLocalBroker()
+		if err != nil {
+			return err
+		}
+		*addr = local
+	}
+
+	mem := newMemorySampler()
+	defer mem.stop()
+
+	latencies := newLatencyRecorder(*messages)
+	var subs []*client.Client
+	for i := 0; i < *subscribers; i++ {
+		conn, err := client.Dial(*addr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if err := conn.SubscribeWithAcks(*topic, ""); err != nil {
+			return err
+		}
+		subs = append(subs, conn)
+	}
+	for _, conn := range subs {
+		go consume(conn, latencies)
+	}
+
+	var pubs []*client.Client
+	for i := 0; i < *publishers; i++ {
+		conn, err := client.Dial(*addr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		pubs = append(pubs, conn)
+	}
+
+	body := strings.Repeat("x", *size)
+	errs := make(chan error, len(pubs))
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i, conn := range pubs {
+		n := *messages / len(pubs)
+		if i < *messages%len(pubs) {
+			n++
+		}
+		var interval time.Duration
+		if *rate > 0 {
+			interval = time.Duration(len(pubs)) * time.Second / time.Duration(*rate)
+		}
+		wg.Add(1)
+		go func(conn *client.Client, n int) {
+			defer wg.Done()
+			if err := produce(conn, *topic, body, n, interval); err != nil {
+				errs <- err
+			}
+		}(conn, n)
+	}
+	wg.Wait()
+	published := time.Since(start)
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
+	}
+
+	select {
+	case <-latencies.done:
+	case <-time.After(*timeout):
+		return fmt.Errorf("only %d of %d messages arrived within %s", latencies.count(), *messages, *timeout)
+	}
+	elapsed := time.Since(start)
+
+	fmt.Printf("broker        %s\n", *addr)
+	fmt.Printf("workload      %d messages of %d bytes, %d publisher(s), %d subscriber(s)\n",
+		*messages, *size, *publishers, *subscribers)
+	fmt.Printf("publish       %s (%.0f msg/s)\n", published.Round(time.Millisecond), float64(*messages)/published.Seconds())
+	fmt.Printf("end to end    %s (%.0f msg/s)\n", elapsed.Round(time.Millisecond), float64(*messages)/elapsed.Seconds())
+	p := latencies.percentiles(50, 90, 99, 100)
+	fmt.Printf("latency       p50 %s  p90 %s  p99 %s  max %s\n", p[0], p[1], p[2], p[3])
+	fmt.Printf("memory        peak heap %s, allocated %s (this process)\n",
+		formatBytes(mem.peakHeap()), formatBytes(mem.allocated()))
+	return nil
+}
+
+func produce(conn *client.Client, topic, body string, n int, interval time.Duration) error {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for i := 0; i < n; i++ {
+		if tick != nil {
+			<-tick
+		}
+		headers := map[string]string{sentAtHeader: strconv.FormatInt(time.Now().UnixNano(), 10)}
+		if err := conn.Publish(topic, body, i%10, headers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func consume(conn *client.Client, latencies *latencyRecorder) {
+	for delivery := range conn.Deliveries() {
+		if sentAt, err := strconv.ParseInt(delivery.Headers[sentAtHeader], 10, 64); err == nil {
+			latencies.record(time.Since(time.Unix(0, sentAt)))
+		}
+		if err := conn.Ack(delivery.Topic, delivery.ID); err != nil {
+			return
+		}
+	}
+}
+
+// startLocalBroker runs a broker in this process on a free port.
+func startLocalBroker() (string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	go server.NewServer(addr).Run()
+
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return addr, nil
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return "", fmt.Errorf("local broker did not start on %s", addr)
+}
+
+type latencyRecorder struct {
+	mu       sync.Mutex
+	samples  []time.Duration
+	expected int
+	done     chan struct{}
+}
+
+func newLatencyRecorder(expected int) *latencyRecorder {
+	return &latencyRecorder{
+		samples:  make([]time.Duration, 0, expected),
+		expected: expected,
+		done:     make(chan struct{}),
+	}
+}
+
+func (r *latencyRecorder) record(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.samples = append(r.samples, d)
+	if len(r.samples) == r.expected {
+		close(r.done)
+	}
+}
+
+func (r *latencyRecorder) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.samples)
+}
+
+func (r *latencyRecorder) percentiles(ps ...float64) []time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sorted := append([]time.Duration(nil), r.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	result := make([]time.Duration, len(ps))
+	if len(sorted) == 0 {
+		return result
+	}
+	for i, p := range ps {
+		index := int(p/100*float64(len(sorted))+0.5) - 1
+		index = max(0, min(index, len(sorted)-1))
+		result[i] = sorted[index].Round(time.Microsecond)
+	}
+	return result
+}
+
+// memorySampler tracks the peak heap of this process while a run is going.
+type memorySampler struct {
+	mu         sync.Mutex
+	peak       uint64
+	startAlloc uint64
+	lastAlloc  uint64
+	quit       chan struct{}
+}
+
+func newMemorySampler() *memorySampler {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	m := &memorySampler{startAlloc: stats.TotalAlloc, quit: make(chan struct{})}
+	m.sample()
+	go func() {
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.sample()
+			case <-m.quit:
+				return
+			}
+		}
+	}()
+	return m
+}
+
+func (m *memorySampler) sample() {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.peak = max(m.peak, stats.HeapInuse)
+	m.lastAlloc = stats.TotalAlloc
+}
+
+func (m *memorySampler) peakHeap() uint64 {
+	m.sample()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.peak
+}
+
+func (m *memorySampler) allocated() uint64 {
+	m.sample()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastAlloc - m.startAlloc
+}
+
+func (m *memorySampler) stop() {
+	close(m.quit)
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for n/div >= unit && exp < 3 {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGT"[exp])
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+const usage = `usage: querabench <mode> [flags]
+
+modes:
+  broker  run publishers and subscribers against a broker
+
+Run "querabench <mode> -h" for the flags of a mode. The benchmarks of the
+in-memory priority queues run with "go test -bench . ./queue".
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "broker":
+		err = runBroker(os.Args[2:])
+	default:
+		fmt.Fprintf(os.Stderr, "querabench: unknown mode %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "querabench:", err)
+		os.Exit(1)
+	}
+}
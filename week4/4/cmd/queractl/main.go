@@ -0,0 +1,463 @@
+package main
+
+import (
+	"QueraMQ/client"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `usage: queractl [-addr host:port] [-n namespace] [-token token] [-o table|json] <command> [flags]
+
+commands:
+  publish    publish a message given as arguments, from a file or from stdin
+  subscribe  print messages delivered from a topic
+  topics     list topics
+  stats      show topic statistics
+  purge      drop every queued message of a topic
+  bench      measure publish throughput
+  namespace  create or delete a namespace
+
+Run "queractl <command> -h" for the flags of a command.
+`
+
+type cli struct {
+	addr      string
+	namespace string
+	token     string
+	json      bool
+	stdin     io.Reader
+	stdout    io.Writer
+}
+
+// headerFlag collects repeated -header key=value flags.
+type headerFlag map[string]string
+
+func (h headerFlag) String() string {
+	pairs := make([]string, 0, len(h))
+	for k, v := range h {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (h headerFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return errors.New("header must be key=value")
+	}
+	h[key] = val
+	return nil
+}
+
+func main() {
+	addr := flag.String("addr", "localhost:8080", "broker address")
+	namespace := flag.String("n", "", "namespace to work in, empty for the default one")
+	token := flag.String("token", "", "token to authenticate with, needed to manage namespaces")
+	output := flag.String("o", "table", "output format: table or json")
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *output != "table" && *output != "json" {
+		fmt.Fprintln(os.Stderr, "queractl: -o must be table or json")
+		os.Exit(2)
+	}
+
+	commands := map[string]func(*cli, []string) error{
+		"publish":   (*cli).publish,
+		"subscribe": (*cli).subscribe,
+		"topics":    (*cli).topics,
+		"stats":     (*cli).stats,
+		"purge":     (*cli).purge,
+		"bench":     (*cli).bench,
+		"namespace": (*cli).namespaceCommand,
+	}
+	command, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "queractl: unknown command %q\n\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c := &cli{addr: *addr, namespace: *namespace, token: *token, json: *output == "json", stdin: os.Stdin, stdout: os.Stdout}
+	if err := command(c, flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "queractl:", err)
+		os.Exit(1)
+	}
+}
+
+// dial connects to the broker, selects the namespace given with -n and
+// authenticates with the token given with -token.
+func (c *cli) dial() (*client.Client, error) {
+	conn, err := client.Dial(c.addr)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c.token != "":
+		err = conn.HelloWithToken(c.namespace, c.token)
+	case c.namespace != "":
+		err = conn.Hello(c.namespace)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (c *cli) publish(args []string) error {
+	fs := flag.NewFlagSet("publish", flag.ExitOnError)
+	topic := fs.String("topic", "", "topic to publish to (required)")
+	priority := fs.Int("priority", 0, "message priority, lower is more urgent")
+	file := fs.String("file", "-", "read the body from this file, - for stdin")
+	lines := fs.Bool("lines", false, "publish every input line as its own message")
+	headers := headerFlag{}
+	fs.Var(headers, "header", "message header as key=value, may be repeated")
+	fs.Parse(args)
+
+	if *topic == "" {
+		return errors.New("publish: -topic is required")
+	}
+
+	var bodies []string
+	if fs.NArg() > 0 {
+		bodies = []string{strings.Join(fs.Args(), " ")}
+	} else {
+		var err error
+		if bodies, err = c.readBodies(*file, *lines); err != nil {
+			return err
+		}
+	}
+
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, body := range bodies {
+		if err := conn.Publish(*topic, body, *priority, headers); err != nil {
+			return err
+		}
+	}
+
+	if c.json {
+		return c.printJSON(map[string]interface{}{"topic": *topic, "published": len(bodies)})
+	}
+	fmt.Fprintf(c.stdout, "published %d message(s) to %s\n", len(bodies), *topic)
+	return nil
+}
+
+func (c *cli) readBodies(file string, lines bool) ([]string, error) {
+	in := c.stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	if !lines {
+		data, err := io.ReadAll(in)
+		if err != nil {
+			return nil, err
+		}
+		return []string{string(data)}, nil
+	}
+
+	var bodies []string
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			bodies = append(bodies, line)
+		}
+	}
+	return bodies, scanner.Err()
+}
+
+func (c *cli) subscribe(args []string) error {
+	fs := flag.NewFlagSet("subscribe", flag.ExitOnError)
+	topic := fs.String("topic", "", "topic to subscribe to (required)")
+	filter := fs.String("filter", "", "server-side filter, e.g. \"priority <= 2 AND region = 'eu'\"")
+	follow := fs.Bool("follow", false, "keep printing messages until interrupted")
+	count := fs.Int("count", 1, "number of messages to print when not following")
+	noAck := fs.Bool("no-ack", false, "leave messages unacknowledged so they are redelivered")
+	fs.Parse(args)
+
+	if *topic == "" {
+		return errors.New("subscribe: -topic is required")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.SubscribeWithAcks(*topic, *filter); err != nil {
+		return err
+	}
+
+	for received := 0; *follow || received < *count; received++ {
+		select {
+		case <-ctx.Done():
+			return nil
+		case delivery, ok := <-conn.Deliveries():
+			if !ok {
+				return conn.Err()
+			}
+			if err := c.printDelivery(delivery); err != nil {
+				return err
+			}
+			if !*noAck {
+				if err := conn.Ack(delivery.Topic, delivery.ID); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (c *cli) printDelivery(d client.Delivery) error {
+	if c.json {
+		return c.printJSON(map[string]interface{}{
+			"topic":    d.Topic,
+			"id":       d.ID,
+			"priority": d.Priority,
+			"headers":  d.Headers,
+			"content":  d.Content,
+		})
+	}
+
+	headers := make([]string, 0, len(d.Headers))
+	for k, v := range d.Headers {
+		headers = append(headers, k+"="+v)
+	}
+	fmt.Fprintf(c.stdout, "%s  %s  priority=%d  %s\n  %s\n", d.Topic, d.ID, d.Priority, strings.Join(headers, " "), d.Content)
+	return nil
+}
+
+func (c *cli) topics(args []string) error {
+	fs := flag.NewFlagSet("topics", flag.ExitOnError)
+	fs.Parse(args)
+
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	topics, err := conn.Topics()
+	if err != nil {
+		return err
+	}
+
+	if c.json {
+		return c.printJSON(topics)
+	}
+	w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TOPIC")
+	for _, topic := range topics {
+		fmt.Fprintln(w, topic)
+	}
+	return w.Flush()
+}
+
+func (c *cli) stats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	topic := fs.String("topic", "", "only show this topic")
+	fs.Parse(args)
+
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stats, err := conn.Stats(*topic)
+	if err != nil {
+		return err
+	}
+
+	if c.json {
+		return c.printJSON(stats)
+	}
+	w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TOPIC\tDEPTH\tIN FLIGHT\tSUBSCRIBERS\tFILTERED\tOLDEST")
+	for _, st := range stats {
+		oldest := time.Duration(st.OldestAgeSeconds * float64(time.Second)).Round(time.Millisecond)
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%s\n", st.Topic, st.Depth, st.InFlight, st.Subscribers, st.Filtered, oldest)
+	}
+	return w.Flush()
+}
+
+func (c *cli) purge(args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	topic := fs.String("topic", "", "topic to purge (required)")
+	fs.Parse(args)
+
+	if *topic == "" {
+		return errors.New("purge: -topic is required")
+	}
+
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	purged, err := conn.Purge(*topic)
+	if err != nil {
+		return err
+	}
+
+	if c.json {
+		return c.printJSON(map[string]interface{}{"topic": *topic, "purged": purged})
+	}
+	fmt.Fprintf(c.stdout, "purged %d message(s) from %s\n", purged, *topic)
+	return nil
+}
+
+func (c *cli) bench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	topic := fs.String("topic", "queractl-bench", "topic to publish to")
+	messages := fs.Int("n", 10000, "total number of messages")
+	size := fs.Int("size", 128, "message body size in bytes")
+	connections := fs.Int("c", 4, "number of publishing connections")
+	keep := fs.Bool("keep", false, "keep the published messages instead of purging them")
+	fs.Parse(args)
+
+	if *connections < 1 || *messages < 1 {
+		return errors.New("bench: -n and -c must be positive")
+	}
+
+	clients := make([]*client.Client, *connections)
+	for i := range clients {
+		conn, err := c.dial()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		clients[i] = conn
+	}
+
+	body := strings.Repeat("x", *size)
+	errs := make(chan error, len(clients))
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i, conn := range clients {
+		n := *messages / len(clients)
+		if i < *messages%len(clients) {
+			n++
+		}
+		wg.Add(1)
+		go func(conn *client.Client, n int) {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				if err := conn.Publish(*topic, body, j%10, nil); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(conn, n)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
+	}
+
+	if !*keep {
+		if _, err := clients[0].Purge(*topic); err != nil {
+			return err
+		}
+	}
+
+	rate := float64(*messages) / elapsed.Seconds()
+	if c.json {
+		return c.printJSON(map[string]interface{}{
+			"messages":        *messages,
+			"connections":     *connections,
+			"bytes":           *size,
+			"elapsed_seconds": elapsed.Seconds(),
+			"messages_per_s":  rate,
+		})
+	}
+	fmt.Fprintf(c.stdout, "published %d messages of %d bytes over %d connection(s) in %s (%.0f msg/s)\n",
+		*messages, *size, *connections, elapsed.Round(time.Millisecond), rate)
+	return nil
+}
+
+func (c *cli) namespaceCommand(args []string) error {
+	fs := flag.NewFlagSet("namespace", flag.ExitOnError)
+	var quota client.Quota
+	fs.IntVar(&quota.MaxTopics, "max-topics", 0, "topic quota of a new namespace, 0 for none")
+	fs.IntVar(&quota.MaxMessages, "max-messages", 0, "queued message quota of a new namespace, 0 for none")
+	fs.IntVar(&quota.MaxConnections, "max-connections", 0, "connection quota of a new namespace, 0 for none")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: queractl namespace create|delete [flags] <name>")
+		fs.PrintDefaults()
+	}
+	if len(args) < 1 {
+		fs.Usage()
+		return errors.New("namespace: create or delete is required")
+	}
+	operation := args[0]
+	fs.Parse(args[1:])
+	if fs.NArg() != 1 {
+		return errors.New("namespace: exactly one name is required")
+	}
+	name := fs.Arg(0)
+
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	switch operation {
+	case "create":
+		err = conn.CreateNamespace(name, quota)
+	case "delete":
+		err = conn.DeleteNamespace(name)
+	default:
+		return fmt.Errorf("namespace: unknown operation %q", operation)
+	}
+	if err != nil {
+		return err
+	}
+
+	if c.json {
+		return c.printJSON(map[string]interface{}{"namespace": name, "operation": operation})
+	}
+	fmt.Fprintf(c.stdout, "%sd namespace %s\n", operation, name)
+	return nil
+}
+
+func (c *cli) printJSON(v interface{}) error {
+	encoder := json.NewEncoder(c.stdout)
+	return encoder.Encode(v)
+}
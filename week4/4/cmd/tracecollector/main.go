@@ -0,0 +1,78 @@
+// Command tracecollector stands in for an OpenTelemetry collector during
+// development: it accepts OTLP/JSON trace exports over HTTP and prints one
+// line per span, grouped by trace.
+package main
+
+import (
+	"QueraMQ/tracing"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:4318", "address to accept OTLP/HTTP exports on")
+	raw := flag.Bool("raw", false, "print the received JSON instead of a summary")
+	flag.Parse()
+
+	var mu sync.Mutex
+	http.HandleFunc("POST /v1/traces", func(w http.ResponseWriter, r *http.Request) {
+		var request tracing.OTLPRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "invalid OTLP/JSON body", http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if *raw {
+			json.NewEncoder(os.Stdout).Encode(request)
+		} else {
+			printSpans(request)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	})
+
+	log.Printf("Collecting traces at http://%s/v1/traces", *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
+
+func printSpans(request tracing.OTLPRequest) {
+	var spans []tracing.OTLPSpan
+	for _, rs := range request.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			spans = append(spans, ss.Spans...)
+		}
+	}
+	sort.SliceStable(spans, func(i, j int) bool {
+		if spans[i].TraceID != spans[j].TraceID {
+			return spans[i].TraceID < spans[j].TraceID
+		}
+		return spans[i].StartTimeUnixNano < spans[j].StartTimeUnixNano
+	})
+
+	for _, span := range spans {
+		start, _ := strconv.ParseInt(span.StartTimeUnixNano, 10, 64)
+		end, _ := strconv.ParseInt(span.EndTimeUnixNano, 10, 64)
+		parent := span.ParentSpanID
+		if parent == "" {
+			parent = "-"
+		}
+
+		attrs := make([]string, 0, len(span.Attributes))
+		for _, attr := range span.Attributes {
+			attrs = append(attrs, attr.Key+"="+attr.Value.StringValue)
+		}
+		fmt.Printf("trace=%s span=%s parent=%s %-24s %10s  %s\n",
+			span.TraceID, span.SpanID, parent, span.Name, time.Duration(end-start), strings.Join(attrs, " "))
+	}
+}
@@ -0,0 +1,225 @@
+// Package filter parses and evaluates subscription filters such as
+//
+//	priority <= 2 AND (region = 'eu' OR NOT tier = 'free')
+//
+// A comparison names either priority or a message header on the left and a
+// number or a single-quoted string on the right. Supported operators are
+// =, !=, <, <=, > and >=, combined with AND, OR, NOT and parentheses.
+package filter
+
+import (
+	"QueraMQ/queue"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Filter is a parsed filter expression.
+type Filter struct {
+	expr string
+	root node
+}
+
+// Parse compiles expr into a Filter.
+func Parse(expr string) (*Filter, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %s at position %d", tok, tok.pos)
+	}
+	return &Filter{expr: expr, root: root}, nil
+}
+
+// Match reports whether message satisfies the filter. A nil Filter matches
+// every message.
+func (f *Filter) Match(message *queue.Message) bool {
+	if f == nil {
+		return true
+	}
+	return f.root.eval(message)
+}
+
+func (f *Filter) String() string {
+	return f.expr
+}
+
+type node interface {
+	eval(message *queue.Message) bool
+}
+
+type andNode struct{ left, right node }
+
+func (n andNode) eval(m *queue.Message) bool { return n.left.eval(m) && n.right.eval(m) }
+
+type orNode struct{ left, right node }
+
+func (n orNode) eval(m *queue.Message) bool { return n.left.eval(m) || n.right.eval(m) }
+
+type notNode struct{ operand node }
+
+func (n notNode) eval(m *queue.Message) bool { return !n.operand.eval(m) }
+
+// comparison compares a field with a literal. A comparison on a header that
+// is missing, or that is not numeric when compared with a number, is false.
+type comparison struct {
+	field   string
+	op      string
+	text    string
+	number  float64
+	numeric bool
+}
+
+func (c comparison) eval(m *queue.Message) bool {
+	if c.field == "priority" {
+		return compare(float64(m.Priority), c.number, c.op)
+	}
+
+	value, ok := m.Headers[c.field]
+	if !ok {
+		return false
+	}
+	if c.numeric {
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return false
+		}
+		return compare(number, c.number, c.op)
+	}
+	return compare(value, c.text, c.op)
+}
+
+func compare[T float64 | string](left, right T, op string) bool {
+	switch op {
+	case "=":
+		return left == right
+	case "!=":
+		return left != right
+	case "<":
+		return left < right
+	case "<=":
+		return left <= right
+	case ">":
+		return left > right
+	case ">=":
+		return left >= right
+	}
+	return false
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().isKeyword("OR") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().isKeyword("AND") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if p.peek().isKeyword("NOT") {
+		p.next()
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	tok := p.next()
+	switch {
+	case tok.kind == tokenLParen:
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokenRParen {
+			return nil, fmt.Errorf("expected ) at position %d, got %s", closing.pos, closing)
+		}
+		return expr, nil
+	case tok.kind == tokenIdent && !tok.isKeyword("AND") && !tok.isKeyword("OR") && !tok.isKeyword("NOT"):
+		return p.parseComparison(tok)
+	default:
+		return nil, fmt.Errorf("expected a field name at position %d, got %s", tok.pos, tok)
+	}
+}
+
+func (p *parser) parseComparison(field token) (node, error) {
+	op := p.next()
+	if op.kind != tokenOp {
+		return nil, fmt.Errorf("expected a comparison operator at position %d, got %s", op.pos, op)
+	}
+
+	c := comparison{field: field.text, op: op.text}
+	if strings.EqualFold(field.text, "priority") {
+		c.field = "priority"
+	}
+
+	literal := p.next()
+	switch literal.kind {
+	case tokenNumber:
+		number, err := strconv.ParseFloat(literal.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", literal.text, literal.pos)
+		}
+		c.number, c.numeric = number, true
+	case tokenString:
+		if c.field == "priority" {
+			return nil, fmt.Errorf("priority must be compared with a number at position %d", literal.pos)
+		}
+		c.text = literal.text
+	default:
+		return nil, fmt.Errorf("expected a number or quoted string at position %d, got %s", literal.pos, literal)
+	}
+	return c, nil
+}
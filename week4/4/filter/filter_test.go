@@ -0,0 +1,122 @@
+package filter_test
+
+import (
+	"QueraMQ/filter"
+	"QueraMQ/queue"
+	"strings"
+	"testing"
+)
+
+func message(priority int, headers ...string) *queue.Message {
+	m := &queue.Message{Priority: priority, Headers: make(map[string]string)}
+	for i := 0; i+1 < len(headers); i += 2 {
+		m.Headers[headers[i]] = headers[i+1]
+	}
+	return m
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		expr    string
+		message *queue.Message
+		want    bool
+	}{
+		// Precedence: NOT binds tighter than AND, which binds tighter than OR.
+		{"and before or", "priority = 1 OR priority = 2 AND region = 'eu'", message(1, "region", "us"), true},
+		{"and before or, right side", "priority = 1 OR priority = 2 AND region = 'eu'", message(2, "region", "us"), false},
+		{"parentheses override", "(priority = 1 OR priority = 2) AND region = 'eu'", message(1, "region", "us"), false},
+		{"not before and", "NOT region = 'eu' AND tier = 'pro'", message(0, "region", "us", "tier", "pro"), true},
+		{"not of a group", "NOT (region = 'eu' AND tier = 'pro')", message(0, "region", "eu", "tier", "pro"), false},
+		{"double not", "NOT NOT region = 'eu'", message(0, "region", "eu"), true},
+		{"keywords ignore case", "priority <= 2 and not region = 'eu' or tier = 'free'", message(2, "region", "us"), true},
+
+		// Priority and its operators.
+		{"priority field ignores case", "PRIORITY < 3", message(2), true},
+		{"less or equal", "priority <= 2", message(2), true},
+		{"greater", "priority > 2", message(2), false},
+		{"greater or equal", "priority >= -1", message(-1), true},
+		{"not equal", "priority != 2", message(2), false},
+		{"double equals", "priority == 2", message(2), true},
+		{"decimal", "priority < 2.5", message(2), true},
+
+		// Quoting.
+		{"doubled quote", "name = 'O''Brien'", message(0, "name", "O'Brien"), true},
+		{"spaces and keywords in a string", "note = 'a AND b'", message(0, "note", "a AND b"), true},
+		{"empty string", "note = ''", message(0, "note", ""), true},
+		{"string order", "region < 'f'", message(0, "region", "eu"), true},
+
+		// Headers.
+		{"header names are case sensitive", "Region = 'eu'", message(0, "region", "eu"), false},
+		{"missing header", "region = 'eu'", message(0), false},
+		{"missing header under not", "NOT region = 'eu'", message(0), true},
+		{"missing header with not equal", "region != 'eu'", message(0), false},
+		{"numeric header", "size > 10", message(0, "size", "12"), true},
+		{"numeric header compares as a number", "size > 9", message(0, "size", "10"), true},
+		{"non-numeric header with a number", "size > 10", message(0, "size", "big"), false},
+		{"header names with dots and dashes", "x-trace.id = 'abc'", message(0, "x-trace.id", "abc"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := filter.Parse(tt.expr)
+			if err != nil {
+				t.Fatalf("Parse(%q): %v", tt.expr, err)
+			}
+			if got := f.Match(tt.message); got != tt.want {
+				t.Fatalf("%q matched %v, want %v", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		// want is part of the error message.
+		want string
+	}{
+		{"", "expected a field name at position 0"},
+		{"priority", "expected a comparison operator"},
+		{"priority =", "expected a number or quoted string"},
+		{"priority = 'high'", "priority must be compared with a number"},
+		{"region = eu", "expected a number or quoted string"},
+		{"region = 'eu", "unterminated string at position 9"},
+		{"region ! 'eu'", "unexpected ! at position 7"},
+		{"priority = 1.2.3", `invalid number "1.2.3"`},
+		{"(priority = 1", "expected ) at position 13"},
+		{"priority = 1)", `unexpected ")" at position 12`},
+		{"priority = 1 AND", "expected a field name"},
+		{"AND priority = 1", "expected a field name at position 0"},
+		{"priority = 1 region = 'eu'", `unexpected "region"`},
+		{"NOT", "expected a field name"},
+		{"region = 'eu' # comment", "unexpected '#' at position 14"},
+	}
+	for _, tt := range tests {
+		f, err := filter.Parse(tt.expr)
+		if err == nil {
+			t.Errorf("Parse(%q) = %v, want an error", tt.expr, f)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Parse(%q) error %q, want it to contain %q", tt.expr, err, tt.want)
+		}
+	}
+}
+
+func TestNilFilterMatchesEverything(t *testing.T) {
+	var f *filter.Filter
+	if !f.Match(message(9)) {
+		t.Fatal("nil filter rejected a message")
+	}
+}
+
+func TestStringReturnsExpression(t *testing.T) {
+	const expr = "priority <= 2 AND region = 'eu'"
+	f, err := filter.Parse(expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := f.String(); got != expr {
+		t.Fatalf("String() = %q, want %q", got, expr)
+	}
+}
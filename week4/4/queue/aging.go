@@ -0,0 +1,42 @@
+package queue
+
+import "time"
+
+// AgingPolicy improves the effective priority of a queued message by one
+// level for every Interval it has waited, so that a steady stream of urgent
+// messages cannot starve the rest forever. A zero Interval disables aging.
+type AgingPolicy struct {
+	Interval time.Duration `json:"interval"`
+}
+
+// agingEpoch is the instant ranks count intervals from. Counting from the
+// Unix epoch would make ranks so large that float64 could no longer tell
+// apart messages enqueued a fraction of a short Interval apart.
+var agingEpoch = time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Rank returns the key messages are ordered by; lower ranks pop first.
+//
+// Every message ages at the same rate, so comparing
+// Priority - age/Interval between two messages gives the same answer at
+// any moment. Rank drops the shared "now" term, which keeps a heap ordered
+// by it valid without ever re-sorting.
+func (p AgingPolicy) Rank(message *Message) float64 {
+	if p.Interval <= 0 {
+		return float64(message.Priority)
+	}
+	// The whole intervals and the remainder are exact integers until they
+	// are converted, so only their sum is rounded.
+	since := message.EnqueuedAt.Sub(agingEpoch)
+	intervals, rest := since/p.Interval, since%p.Interval
+	return float64(message.Priority) + float64(intervals) + float64(rest)/float64(p.Interval)
+}
+
+// agingQueue is a MessageQueue ordered by AgingPolicy.Rank.
+type agingQueue struct {
+	MessageQueue
+	policy AgingPolicy
+}
+
+func (q agingQueue) Less(i, j int) bool {
+	return q.policy.Rank(q.MessageQueue[i]) < q.policy.Rank(q.MessageQueue[j])
+}
@@ -0,0 +1,33 @@
+package queue_test
+
+import (
+	"QueraMQ/queue"
+	"testing"
+	"time"
+)
+
+// Messages enqueued a fraction of an Interval apart must still rank in
+// the order they waited, even with an Interval of a microsecond.
+func TestAgingRankKeepsSubIntervalOrder(t *testing.T) {
+	policy := queue.AgingPolicy{Interval: time.Microsecond}
+	enqueued := time.Date(2026, time.October, 19, 12, 0, 0, 0, time.UTC)
+	older := &queue.Message{Priority: 5, EnqueuedAt: enqueued}
+	newer := &queue.Message{Priority: 5, EnqueuedAt: enqueued.Add(100 * time.Nanosecond)}
+
+	if older, newer := policy.Rank(older), policy.Rank(newer); older >= newer {
+		t.Fatalf("older message ranks %v, newer %v; want the older first", older, newer)
+	}
+}
+
+// A message one priority level less urgent overtakes one enqueued an
+// Interval later.
+func TestAgingRankTradesPriorityForAge(t *testing.T) {
+	policy := queue.AgingPolicy{Interval: time.Second}
+	enqueued := time.Date(2026, time.October, 19, 12, 0, 0, 0, time.UTC)
+	waiting := &queue.Message{Priority: 3, EnqueuedAt: enqueued}
+	urgent := &queue.Message{Priority: 2, EnqueuedAt: enqueued.Add(1500 * time.Millisecond)}
+
+	if waiting, urgent := policy.Rank(waiting), policy.Rank(urgent); waiting >= urgent {
+		t.Fatalf("waiting message ranks %v, urgent %v; want the waiting one first", waiting, urgent)
+	}
+}
@@ -0,0 +1,162 @@
+package queue
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ConcurrentQueue is a MessageQueue that is safe for use by multiple
+// goroutines. Lookups by ID rely on Message.Index to locate a message in
+// the heap without scanning it. PushMessage and Peek hand out copies of
+// queued messages, so that reading them never races with UpdatePriority.
+type ConcurrentQueue struct {
+	mu    sync.Mutex
+	mq    agingQueue
+	byID  map[uuid.UUID]*Message
+	ready chan struct{}
+}
+
+func NewConcurrentQueue() *ConcurrentQueue {
+	return NewAgingQueue(AgingPolicy{})
+}
+
+// NewAgingQueue returns a ConcurrentQueue ordered by policy.
+func NewAgingQueue(policy AgingPolicy) *ConcurrentQueue {
+	return &ConcurrentQueue{
+		mq:    agingQueue{MessageQueue: MessageQueue{}, policy: policy},
+		byID:  make(map[uuid.UUID]*Message),
+		ready: make(chan struct{}),
+	}
+}
+
+func (q *ConcurrentQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.mq.Len()
+}
+
+func (q *ConcurrentQueue) PushMessage(content string, priority int) *Message {
+	message := &Message{
+		ID:         uuid.New(),
+		Content:    content,
+		Priority:   priority,
+		EnqueuedAt: time.Now(),
+	}
+	pushed := *message
+	q.Enqueue(message)
+	return &pushed
+}
+
+// Enqueue adds an existing message, keeping its ID and, when set, its
+// EnqueuedAt so that a requeued message does not lose the age it gained.
+func (q *ConcurrentQueue) Enqueue(message *Message) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if message.EnqueuedAt.IsZero() {
+		message.EnqueuedAt = time.Now()
+	}
+	if old, exists := q.byID[message.ID]; exists {
+		heap.Remove(&q.mq, old.Index)
+	}
+	heap.Push(&q.mq, message)
+	q.byID[message.ID] = message
+
+	close(q.ready)
+	q.ready = make(chan struct{})
+}
+
+// TryPop removes the highest-priority message without blocking.
+func (q *ConcurrentQueue) TryPop() (*Message, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.pop()
+}
+
+// PopWait removes the highest-priority message, blocking until one is
+// available or ctx is done.
+func (q *ConcurrentQueue) PopWait(ctx context.Context) (*Message, error) {
+	for {
+		q.mu.Lock()
+		if message, ok := q.pop(); ok {
+			q.mu.Unlock()
+			return message, nil
+		}
+		ready := q.ready
+		q.mu.Unlock()
+
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Peek returns a copy of the highest-priority message without removing it.
+func (q *ConcurrentQueue) Peek() (*Message, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.mq.Len() == 0 {
+		return nil, false
+	}
+	head := *q.mq.MessageQueue[0]
+	return &head, true
+}
+
+// Oldest returns the enqueue time of the message that has waited longest,
+// or the zero time when the queue is empty.
+func (q *ConcurrentQueue) Oldest() time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var oldest time.Time
+	for _, message := range q.mq.MessageQueue {
+		if oldest.IsZero() || message.EnqueuedAt.Before(oldest) {
+			oldest = message.EnqueuedAt
+		}
+	}
+	return oldest
+}
+
+func (q *ConcurrentQueue) Remove(id uuid.UUID) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	message, exists := q.byID[id]
+	if !exists {
+		return false
+	}
+	heap.Remove(&q.mq, message.Index)
+	delete(q.byID, id)
+	return true
+}
+
+func (q *ConcurrentQueue) UpdatePriority(id uuid.UUID, priority int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	message, exists := q.byID[id]
+	if !exists {
+		return false
+	}
+	message.Priority = priority
+	heap.Fix(&q.mq, message.Index)
+	return true
+}
+
+func (q *ConcurrentQueue) pop() (*Message, bool) {
+	if q.mq.Len() == 0 {
+		return nil, false
+	}
+	message := heap.Pop(&q.mq).(*Message)
+	delete(q.byID, message.ID)
+	return message, true
+}
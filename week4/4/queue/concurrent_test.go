@@ -0,0 +1,291 @@
+package queue_test
+
+import (
+	"QueraMQ/queue"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func pushAll(q *queue.ConcurrentQueue, priorities ...int) []*queue.Message {
+	pushed := make([]*queue.Message, len(priorities))
+	for i, priority := range priorities {
+		pushed[i] = q.PushMessage(fmt.Sprint("p", priority), priority)
+	}
+	return pushed
+}
+
+// popAll empties q with TryPop and returns the priorities in pop order.
+func popAll(q *queue.ConcurrentQueue) []int {
+	var got []int
+	for {
+		message, ok := q.TryPop()
+		if !ok {
+			return got
+		}
+		got = append(got, message.Priority)
+	}
+}
+
+func expectOrder(t *testing.T, got []int, want ...int) {
+	t.Helper()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("popped priorities %v, want %v", got, want)
+	}
+}
+
+func TestTryPopReturnsHighestPriorityFirst(t *testing.T) {
+	q := queue.NewConcurrentQueue()
+	if _, ok := q.TryPop(); ok {
+		t.Fatal("TryPop on an empty queue returned a message")
+	}
+	pushAll(q, 5, -1, 3, 0, 9)
+	if n := q.Len(); n != 5 {
+		t.Fatalf("Len() = %d, want 5", n)
+	}
+	expectOrder(t, popAll(q), -1, 0, 3, 5, 9)
+	if n := q.Len(); n != 0 {
+		t.Fatalf("Len() after popping everything = %d, want 0", n)
+	}
+}
+
+func TestPopWaitBlocksUntilPush(t *testing.T) {
+	q := queue.NewConcurrentQueue()
+	popped := make(chan *queue.Message, 1)
+	go func() {
+		message, err := q.PopWait(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		popped <- message
+	}()
+
+	select {
+	case message := <-popped:
+		t.Fatalf("PopWait returned %v from an empty queue", message)
+	case <-time.After(50 * time.Millisecond):
+	}
+	pushed := q.PushMessage("late", 1)
+	select {
+	case message := <-popped:
+		if message == nil || message.ID != pushed.ID {
+			t.Fatalf("PopWait returned %v, want the pushed message", message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("PopWait did not return after a push")
+	}
+}
+
+func TestPopWaitStopsWithContext(t *testing.T) {
+	q := queue.NewConcurrentQueue()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	message, err := q.PopWait(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) || message != nil {
+		t.Fatalf("PopWait() = %v, %v, want nil and the context's error", message, err)
+	}
+}
+
+func TestPeekLeavesHeadQueued(t *testing.T) {
+	q := queue.NewConcurrentQueue()
+	if _, ok := q.Peek(); ok {
+		t.Fatal("Peek on an empty queue returned a message")
+	}
+	pushed := pushAll(q, 4, 2, 7)
+
+	head, ok := q.Peek()
+	if !ok || head.ID != pushed[1].ID {
+		t.Fatalf("Peek() = %v, want the priority 2 message", head)
+	}
+	// Peek hands out a copy, so changing it leaves the queue alone.
+	head.Priority = 100
+	if n := q.Len(); n != 3 {
+		t.Fatalf("Len() after Peek = %d, want 3", n)
+	}
+	expectOrder(t, popAll(q), 2, 4, 7)
+}
+
+func TestRemove(t *testing.T) {
+	q := queue.NewConcurrentQueue()
+	pushed := pushAll(q, 1, 2, 3, 4)
+
+	if !q.Remove(pushed[2].ID) {
+		t.Fatal("Remove of a queued message returned false")
+	}
+	if q.Remove(pushed[2].ID) {
+		t.Fatal("Remove of a removed message returned true")
+	}
+	if q.Remove(uuid.New()) {
+		t.Fatal("Remove of an unknown id returned true")
+	}
+	expectOrder(t, popAll(q), 1, 2, 4)
+}
+
+func TestUpdatePriorityReordersQueue(t *testing.T) {
+	q := queue.NewConcurrentQueue()
+	pushed := pushAll(q, 1, 2, 3, 4)
+
+	if !q.UpdatePriority(pushed[3].ID, 0) {
+		t.Fatal("UpdatePriority of a queued message returned false")
+	}
+	if !q.UpdatePriority(pushed[0].ID, 5) {
+		t.Fatal("UpdatePriority of a queued message returned false")
+	}
+	if q.UpdatePriority(uuid.New(), 0) {
+		t.Fatal("UpdatePriority of an unknown id returned true")
+	}
+	if head, _ := q.Peek(); head.ID != pushed[3].ID {
+		t.Fatalf("Peek() = %q after raising its priority, want %q", head.Content, pushed[3].Content)
+	}
+	expectOrder(t, popAll(q), 0, 2, 3, 5)
+}
+
+// Producers and blocked consumers share the queue; every message must be
+// popped exactly once.
+func TestConcurrentPushAndPopWait(t *testing.T) {
+	const producers, consumers, perProducer = 4, 4, 250
+	q := queue.NewConcurrentQueue()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	seen := make(map[uuid.UUID]int)
+	var consumed sync.WaitGroup
+	var remaining sync.WaitGroup
+	remaining.Add(producers * perProducer)
+	for c := 0; c < consumers; c++ {
+		consumed.Add(1)
+		go func() {
+			defer consumed.Done()
+			for {
+				message, err := q.PopWait(ctx)
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				seen[message.ID]++
+				mu.Unlock()
+				remaining.Done()
+			}
+		}()
+	}
+
+	var produced sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		produced.Add(1)
+		go func(p int) {
+			defer produced.Done()
+			for i := 0; i < perProducer; i++ {
+				q.PushMessage(fmt.Sprint(p, "-", i), i%7)
+			}
+		}(p)
+	}
+	produced.Wait()
+	remaining.Wait()
+	cancel()
+	consumed.Wait()
+
+	if len(seen) != producers*perProducer {
+		t.Fatalf("popped %d distinct messages, want %d", len(seen), producers*perProducer)
+	}
+	for id, n := range seen {
+		if n != 1 {
+			t.Fatalf("message %s popped %d times", id, n)
+		}
+	}
+}
+
+// Reading what Peek returns while other goroutines reprioritize and remove
+// messages must not race with them.
+func TestConcurrentPeekAndUpdates(t *testing.T) {
+	const n = 200
+	q := queue.NewConcurrentQueue()
+	pushed := pushAll(q, make([]int, n)...)
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i, message := range pushed {
+			q.UpdatePriority(message.ID, n-i)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for _, message := range pushed[:n/2] {
+			q.Remove(message.ID)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			if head, ok := q.Peek(); ok && head.Priority < 0 {
+				t.Errorf("Peek() returned priority %d", head.Priority)
+			}
+		}
+	}()
+	wg.Wait()
+
+	got := popAll(q)
+	if len(got) != n/2 {
+		t.Fatalf("popped %d messages, want %d", len(got), n/2)
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i] < got[i-1] {
+			t.Fatalf("popped priority %d after %d", got[i], got[i-1])
+		}
+	}
+}
+
+func TestShardedQueuePopsEveryMessageOnce(t *testing.T) {
+	const workers, perWorker = 4, 100
+	q := queue.NewShardedQueue(4)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				q.PushMessage(fmt.Sprint(w, "-", i), i%5)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	removed := q.PushMessage("removed", 0)
+	if !q.Remove(removed.ID) || q.Remove(removed.ID) {
+		t.Fatal("Remove did not remove the message exactly once")
+	}
+
+	seen := make(map[uuid.UUID]bool)
+	var mu sync.Mutex
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				message, ok := q.TryPop()
+				if !ok {
+					return
+				}
+				mu.Lock()
+				if seen[message.ID] {
+					t.Errorf("message %s popped twice", message.ID)
+				}
+				seen[message.ID] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(seen) != workers*perWorker || q.Len() != 0 {
+		t.Fatalf("popped %d messages and %d are left, want %d and none", len(seen), q.Len(), workers*perWorker)
+	}
+}
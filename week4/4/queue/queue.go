@@ -2,6 +2,7 @@ package queue
 
 import (
 	"container/heap"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -13,10 +14,12 @@ type IMessageQueue interface {
 }
 
 type Message struct {
-	ID       uuid.UUID
-	Content  string
-	Priority int
-	Index    int
+	ID         uuid.UUID
+	Content    string
+	Priority   int
+	Index      int
+	EnqueuedAt time.Time
+	Headers    map[string]string
 }
 
 type MessageQueue []*Message
@@ -51,9 +54,10 @@ func (mq *MessageQueue) Pop() interface{} {
 
 func (mq *MessageQueue) PushMessage(content string, priority int) {
 	message := &Message{
-		ID:       uuid.New(),
-		Content:  content,
-		Priority: priority,
+		ID:         uuid.New(),
+		Content:    content,
+		Priority:   priority,
+		EnqueuedAt: time.Now(),
 	}
 	heap.Push(mq, message)
 }
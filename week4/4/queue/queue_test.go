@@ -0,0 +1,85 @@
+package queue_test
+
+import (
+	"QueraMQ/queue"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"testing"
+)
+
+// benchmarkSizes are the numbers of messages a MessageQueue holds while
+// it is measured, so that the cost per heap level shows.
+var benchmarkSizes = []int{100, 10000, 1000000}
+
+func filledQueue(size int, r *rand.Rand) queue.IMessageQueue {
+	mq := queue.NewMessageQueue()
+	for i := 0; i < size; i++ {
+		mq.PushMessage("payload", r.Intn(1000))
+	}
+	return mq
+}
+
+func BenchmarkPush(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("size-%d", size), func(b *testing.B) {
+			r := rand.New(rand.NewSource(1))
+			mq := filledQueue(size, r)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				mq.PushMessage("payload", r.Intn(1000))
+			}
+		})
+	}
+}
+
+func BenchmarkPop(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("size-%d", size), func(b *testing.B) {
+			// Every iteration pops one of the extra b.N messages, so the
+			// queue shrinks back to size.
+			r := rand.New(rand.NewSource(1))
+			mq := filledQueue(size+b.N, r)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				mq.PopMessage()
+			}
+		})
+	}
+}
+
+type priorityQueue interface {
+	PushMessage(content string, priority int) *queue.Message
+	TryPop() (*queue.Message, bool)
+}
+
+// BenchmarkParallelPushPop runs one push and one pop per iteration from
+// GOMAXPROCS goroutines against the same queue.
+func BenchmarkParallelPushPop(b *testing.B) {
+	shards := runtime.GOMAXPROCS(0)
+	queues := []struct {
+		name string
+		new  func() priorityQueue
+	}{
+		{"concurrent", func() priorityQueue { return queue.NewConcurrentQueue() }},
+		{fmt.Sprintf("sharded-%d", shards), func() priorityQueue { return queue.NewShardedQueue(shards) }},
+	}
+
+	for _, q := range queues {
+		b.Run(q.name, func(b *testing.B) {
+			pq := q.new()
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(rand.Int63()))
+				for pb.Next() {
+					pq.PushMessage("payload", r.Intn(10))
+					pq.TryPop()
+				}
+			})
+		})
+	}
+}
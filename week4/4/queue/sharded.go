@@ -0,0 +1,72 @@
+package queue
+
+import (
+	"sync/atomic"
+
+	"github.com/google/uuid"
+)
+
+// ShardedQueue spreads messages over several ConcurrentQueues to reduce lock
+// contention. Ordering is relaxed: TryPop returns the best message among the
+// shard heads it observed, which may already have been taken by a concurrent
+// caller, in which case it falls back to any other shard.
+type ShardedQueue struct {
+	shards []*ConcurrentQueue
+	next   atomic.Uint64
+}
+
+func NewShardedQueue(shards int) *ShardedQueue {
+	if shards < 1 {
+		shards = 1
+	}
+	q := &ShardedQueue{shards: make([]*ConcurrentQueue, shards)}
+	for i := range q.shards {
+		q.shards[i] = NewConcurrentQueue()
+	}
+	return q
+}
+
+func (q *ShardedQueue) Len() int {
+	n := 0
+	for _, shard := range q.shards {
+		n += shard.Len()
+	}
+	return n
+}
+
+func (q *ShardedQueue) PushMessage(content string, priority int) *Message {
+	shard := q.shards[q.next.Add(1)%uint64(len(q.shards))]
+	return shard.PushMessage(content, priority)
+}
+
+func (q *ShardedQueue) TryPop() (*Message, bool) {
+	best := -1
+	bestPriority := 0
+	for i, shard := range q.shards {
+		if head, ok := shard.Peek(); ok && (best == -1 || head.Priority < bestPriority) {
+			best, bestPriority = i, head.Priority
+		}
+	}
+	if best == -1 {
+		return nil, false
+	}
+	if message, ok := q.shards[best].TryPop(); ok {
+		return message, true
+	}
+
+	for _, shard := range q.shards {
+		if message, ok := shard.TryPop(); ok {
+			return message, true
+		}
+	}
+	return nil, false
+}
+
+func (q *ShardedQueue) Remove(id uuid.UUID) bool {
+	for _, shard := range q.shards {
+		if shard.Remove(id) {
+			return true
+		}
+	}
+	return false
+}
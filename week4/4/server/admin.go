@@ -0,0 +1,69 @@
+package server
+
+import (
+	"encoding/json"
+)
+
+// Topics returns every topic of the default namespace, sorted by name.
+func (s *Server) Topics() []*Topic {
+	return s.namespaceTopics(s.defaultNamespace())
+}
+
+func (s *Server) handleTopics(encoder *json.Encoder, ns *Namespace) {
+	names := make([]string, 0)
+	for _, topic := range s.namespaceTopics(ns) {
+		names = append(names, topic.Name)
+	}
+
+	response := map[string]interface{}{"status": "ok", "topics": names}
+	encoder.Encode(response)
+}
+
+func (s *Server) handleStats(request map[string]interface{}, encoder *json.Encoder, ns *Namespace) {
+	topics := s.namespaceTopics(ns)
+	if name, ok := request["topic"].(string); ok {
+		topics = nil
+		for _, topic := range s.namespaceTopics(ns) {
+			if topic.Name == name {
+				topics = append(topics, topic)
+			}
+		}
+		if len(topics) == 0 {
+			s.sendError(encoder, "topic not found")
+			return
+		}
+	}
+
+	stats := make([]map[string]interface{}, 0, len(topics))
+	for _, topic := range topics {
+		st := topic.Stats()
+		stats = append(stats, map[string]interface{}{
+			"topic":              topic.Name,
+			"depth":              st.Depth,
+			"in_flight":          st.InFlight,
+			"subscribers":        st.Subscribers,
+			"filtered":           st.Filtered,
+			"oldest_age_seconds": st.OldestAge.Seconds(),
+		})
+	}
+
+	response := map[string]interface{}{"status": "ok", "stats": stats}
+	encoder.Encode(response)
+}
+
+func (s *Server) handlePurge(request map[string]interface{}, encoder *json.Encoder, ns *Namespace) {
+	topicName, ok := request["topic"].(string)
+	if !ok {
+		s.sendError(encoder, "topic is required")
+		return
+	}
+
+	topic, err := s.namespaceTopic(ns, topicName)
+	if err != nil {
+		s.sendError(encoder, err.Error())
+		return
+	}
+
+	response := map[string]interface{}{"status": "ok", "purged": topic.Purge()}
+	encoder.Encode(response)
+}
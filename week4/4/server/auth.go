@@ -0,0 +1,37 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+)
+
+// errPermissionDenied is returned to connections that make requests their
+// principal may not make.
+var errPermissionDenied = errors.New("permission denied")
+
+// Principal is who a client authenticated as by presenting a token at
+// hello.
+type Principal struct {
+	Name string `json:"name"`
+	// Admin allows creating and deleting namespaces.
+	Admin bool `json:"admin"`
+}
+
+// canManageNamespaces reports whether p may create and delete namespaces.
+// Unauthenticated connections, with a nil principal, may not.
+func (p *Principal) canManageNamespaces() bool {
+	return p != nil && p.Admin
+}
+
+// authenticate returns the principal token belongs to. Every token is
+// compared in constant time, so that timing does not reveal how much of a
+// guess was right.
+func (s *Server) authenticate(token string) (*Principal, bool) {
+	var found *Principal
+	for candidate, principal := range s.Credentials {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			found = &principal
+		}
+	}
+	return found, found != nil
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"QueraMQ/client"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// OriginHeader names the broker a bridged message was first published on.
+// Bridges set it when a message leaves its first broker and never forward
+// a message back to the broker named in it.
+const OriginHeader = "queramq-origin"
+
+const (
+	minBridgeBackoff = time.Second
+	maxBridgeBackoff = 30 * time.Second
+)
+
+type BridgeDirection string
+
+const (
+	// BridgeIn republishes messages from the remote broker locally.
+	BridgeIn BridgeDirection = "in"
+	// BridgeOut forwards local messages to the remote broker.
+	BridgeOut BridgeDirection = "out"
+	// BridgeBoth does both.
+	BridgeBoth BridgeDirection = "both"
+)
+
+// Bridge links topics of this broker with the same topics on another one.
+// A bridge consumes from its source topic like any other subscriber, so
+// with local consumers on the same topic it receives its round-robin share.
+// While the remote broker is unreachable nothing is consumed and messages
+// wait in the source topic's storage until the bridge reconnects.
+type Bridge struct {
+	// Remote is the address of the other broker and RemoteName the
+	// NodeName it was configured with.
+	Remote     string
+	RemoteName string
+	Topics     []string
+	Direction  BridgeDirection
+}
+
+func (b Bridge) validate() error {
+	if b.Remote == "" || b.RemoteName == "" {
+		return errors.New("bridge needs Remote and RemoteName")
+	}
+	if len(b.Topics) == 0 {
+		return fmt.Errorf("bridge to %s has no topics", b.RemoteName)
+	}
+	switch b.Direction {
+	case BridgeIn, BridgeOut, BridgeBoth:
+		return nil
+	default:
+		return fmt.Errorf("bridge to %s has invalid direction %q", b.RemoteName, b.Direction)
+	}
+}
+
+// startBridges runs every configured bridge until ctx is done.
+func (s *Server) startBridges(ctx context.Context) error {
+	if len(s.Bridges) == 0 {
+		return nil
+	}
+	if s.NodeName == "" {
+		return errors.New("NodeName is required when bridges are configured")
+	}
+	for _, b := range s.Bridges {
+		if err := b.validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, b := range s.Bridges {
+		if b.Direction == BridgeIn || b.Direction == BridgeBoth {
+			go s.runBridge(ctx, b, true)
+		}
+		if b.Direction == BridgeOut || b.Direction == BridgeBoth {
+			go s.runBridge(ctx, b, false)
+		}
+	}
+	return nil
+}
+
+// runBridge keeps one direction of b forwarding, reconnecting with
+// exponential backoff whenever either side goes away.
+func (s *Server) runBridge(ctx context.Context, b Bridge, inbound bool) {
+	direction := "to"
+	if inbound {
+		direction = "from"
+	}
+
+	backoff := minBridgeBackoff
+	for {
+		connected, err := s.bridgeOnce(ctx, b, inbound)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			backoff = minBridgeBackoff
+		}
+		log.Printf("Bridge %s %s (%s) interrupted: %v, retrying in %s", direction, b.RemoteName, b.Remote, err, backoff)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(backoff*2, maxBridgeBackoff)
+	}
+}
+
+// bridgeOnce connects both sides and forwards until one of them fails.
+// connected reports whether the remote broker was reached at all.
+func (s *Server) bridgeOnce(ctx context.Context, b Bridge, inbound bool) (connected bool, err error) {
+	remote, err := client.Dial(b.Remote)
+	if err != nil {
+		return false, err
+	}
+	defer remote.Close()
+	// Let the remote broker notice a bridge that died and requeue what it
+	// had in flight.
+	if err := remote.EnableHeartbeats(); err != nil {
+		return true, err
+	}
+	local := s.dialLocal(nil)
+	defer local.Close()
+
+	source, sink := local, remote
+	// Skip messages that came from the broker they would be sent to, and
+	// stamp the ones leaving their first broker with its name.
+	skip, origin := b.RemoteName, s.NodeName
+	if inbound {
+		source, sink = remote, local
+		skip, origin = s.NodeName, b.RemoteName
+	}
+
+	expr := fmt.Sprintf("NOT %s = '%s'", OriginHeader, strings.ReplaceAll(skip, "'", "''"))
+	for _, topic := range b.Topics {
+		if err := source.SubscribeWithAcks(topic, expr); err != nil {
+			return true, err
+		}
+	}
+	return true, forward(ctx, source, sink, origin)
+}
+
+// forward republishes every delivery of source on sink and only then acks
+// it, so a message lost in between is redelivered rather than dropped.
+func forward(ctx context.Context, source, sink *client.Client, origin string) error {
+	for {
+		select {
+		case delivery, ok := <-source.Deliveries():
+			if !ok {
+				return source.Err()
+			}
+			headers := make(map[string]string, len(delivery.Headers)+1)
+			for name, value := range delivery.Headers {
+				headers[name] = value
+			}
+			if headers[OriginHeader] == "" {
+				headers[OriginHeader] = origin
+			}
+			if err := sink.PublishWait(delivery.Topic, delivery.Content, delivery.Priority, headers); err != nil {
+				return err
+			}
+			if err := source.Ack(delivery.Topic, delivery.ID); err != nil {
+				return err
+			}
+		case <-sink.Done():
+			return sink.Err()
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// dialLocal connects a client to this server over an in-memory pipe. The
+// server sees the connection come from remote, which rate limits count it
+// by, or from the pipe itself when remote is nil.
+func (s *Server) dialLocal(remote net.Addr) *client.Client {
+	serverSide, clientSide := net.Pipe()
+	if remote != nil {
+		serverSide = remoteConn{Conn: serverSide, remote: remote}
+	}
+	go s.handleConnection(serverSide)
+	return client.New(clientSide)
+}
+
+// remoteConn is a connection made on behalf of a client elsewhere.
+type remoteConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr {
+	return c.remote
+}
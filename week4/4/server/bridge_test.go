@@ -0,0 +1,50 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// A bridge that comes up to find several topics backlogged must forward
+// them all, rather than stall on the deliveries it has not read yet.
+func TestBridgeForwardsBackloggedTopics(t *testing.T) {
+	const topics, perTopic = 6, 40
+	var names []string
+	for i := 0; i < topics; i++ {
+		names = append(names, fmt.Sprint("backlog-", i))
+	}
+
+	remoteAddr := freeAddr(t)
+	local := NewServer(freeAddr(t))
+	local.NodeName = "local"
+	local.Bridges = []Bridge{{Remote: remoteAddr, RemoteName: "remote", Topics: names, Direction: BridgeOut}}
+	start(t, local)
+
+	// The remote broker is down, so the messages wait on the local one.
+	publisher := dial(t, local.Addr)
+	for _, name := range names {
+		for j := 0; j < perTopic; j++ {
+			if err := publisher.Publish(name, fmt.Sprint(j), 1, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	remote := NewServer(remoteAddr)
+	remote.NodeName = "remote"
+	start(t, remote)
+	subscriber := dial(t, remoteAddr)
+	for _, name := range names {
+		if err := subscriber.SubscribeWithAcks(name, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := receive(t, subscriber, topics*perTopic, 10*time.Second)
+	for _, delivery := range got {
+		if origin := delivery.Headers[OriginHeader]; origin != "local" {
+			t.Fatalf("message on %s has origin %q, want local", delivery.Topic, origin)
+		}
+	}
+}
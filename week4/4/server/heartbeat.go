@@ -0,0 +1,114 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHeartbeatInterval = 15 * time.Second
+	defaultMissedHeartbeats  = 3
+	defaultWriteTimeout      = 10 * time.Second
+)
+
+// session wraps a client connection so that responses, deliveries and pings
+// written from different goroutines never interleave, and so that a stalled
+// peer cannot block a writer for longer than writeTimeout.
+type session struct {
+	net.Conn
+	writeTimeout time.Duration
+	wmu          sync.Mutex
+}
+
+func newSession(conn net.Conn, writeTimeout time.Duration) *session {
+	return &session{Conn: conn, writeTimeout: writeTimeout}
+}
+
+func (c *session) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.writeTimeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	return c.Conn.Write(p)
+}
+
+// handleHeartbeat starts pinging conn and from then on expects it to send
+// something, pongs included, within MissedHeartbeats intervals. Clients that
+// never ask are neither pinged nor timed out, since those that predate
+// heartbeats do not expect pings among their responses. A zero interval in
+// the response tells the client that heartbeats are disabled.
+func (s *Server) handleHeartbeat(encoder *json.Encoder, conn net.Conn, done chan struct{}, enabled *bool) {
+	if s.HeartbeatInterval > 0 && !*enabled {
+		*enabled = true
+		go s.heartbeat(conn, done)
+	}
+
+	response := map[string]interface{}{
+		"status":      "ok",
+		"interval_ms": max(s.HeartbeatInterval, 0).Milliseconds(),
+		"missed":      s.missedHeartbeats(),
+	}
+	encoder.Encode(response)
+}
+
+// heartbeat pings conn every HeartbeatInterval until done is closed.
+func (s *Server) heartbeat(conn net.Conn, done chan struct{}) {
+	if s.HeartbeatInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.HeartbeatInterval)
+	defer ticker.Stop()
+
+	ping, _ := json.Marshal(map[string]interface{}{"action": "ping"})
+	ping = append(ping, '\n')
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if _, err := conn.Write(ping); err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Printf("Failed to ping %s: %v", conn.RemoteAddr(), err)
+				}
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// extendReadDeadline gives the client MissedHeartbeats intervals to send its
+// next message, pongs included.
+func (s *Server) extendReadDeadline(conn net.Conn) {
+	if s.HeartbeatInterval <= 0 {
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(s.HeartbeatInterval * time.Duration(s.missedHeartbeats())))
+}
+
+func (s *Server) missedHeartbeats() int {
+	if s.MissedHeartbeats <= 0 {
+		return defaultMissedHeartbeats
+	}
+	return s.MissedHeartbeats
+}
+
+// dropClient removes conn from every topic and requeues its unacknowledged
+// deliveries.
+func (s *Server) dropClient(conn net.Conn) {
+	s.mu.Lock()
+	topics := s.allTopics()
+	s.mu.Unlock()
+
+	for _, topic := range topics {
+		topic.RemoveClient(conn)
+	}
+}
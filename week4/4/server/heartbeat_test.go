@@ -0,0 +1,137 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+const testHeartbeat = 50 * time.Millisecond
+
+// rawConn is a connection that speaks the protocol line by line, the way a
+// client that predates heartbeats does.
+type rawConn struct {
+	net.Conn
+	lines *bufio.Scanner
+}
+
+func dialRaw(t *testing.T, addr string) *rawConn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &rawConn{Conn: conn, lines: bufio.NewScanner(conn)}
+}
+
+func (c *rawConn) send(t *testing.T, request map[string]interface{}) {
+	t.Helper()
+	data, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(append(data, '\n')); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// next reads the next line, or returns nil once the broker closed the
+// connection.
+func (c *rawConn) next(t *testing.T) map[string]interface{} {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if !c.lines.Scan() {
+		if err := c.lines.Err(); err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				t.Fatal("timed out waiting for the broker")
+			}
+		}
+		return nil
+	}
+	var line map[string]interface{}
+	if err := json.Unmarshal(c.lines.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	return line
+}
+
+func startWithHeartbeats(t *testing.T) *Server {
+	t.Helper()
+	s := NewServer(freeAddr(t))
+	s.HeartbeatInterval = testHeartbeat
+	start(t, s)
+	return s
+}
+
+// A client that never asked for heartbeats is neither pinged nor dropped
+// for being quiet.
+func TestHeartbeatsAreOptIn(t *testing.T) {
+	s := startWithHeartbeats(t)
+	conn := dialRaw(t, s.Addr)
+
+	time.Sleep(5 * testHeartbeat * defaultMissedHeartbeats)
+	conn.send(t, map[string]interface{}{"action": "topics"})
+	response := conn.next(t)
+	if response == nil {
+		t.Fatal("broker closed a quiet connection that did not ask for heartbeats")
+	}
+	if _, ok := response["topics"]; !ok {
+		t.Fatalf("got %v, want the topics response", response)
+	}
+}
+
+// A client that asked for heartbeats and stops answering them is dropped,
+// and its unacknowledged deliveries are requeued.
+func TestSilentHeartbeatClientIsDropped(t *testing.T) {
+	s := startWithHeartbeats(t)
+	conn := dialRaw(t, s.Addr)
+
+	conn.send(t, map[string]interface{}{"action": "heartbeat"})
+	if response := conn.next(t); response["status"] != "ok" || response["interval_ms"] != float64(testHeartbeat.Milliseconds()) {
+		t.Fatalf("heartbeat response %v", response)
+	}
+	conn.send(t, map[string]interface{}{"action": "subscribe", "topic": "jobs", "ack": true})
+	if response := conn.next(t); response["status"] != "ok" {
+		t.Fatalf("subscribe response %v", response)
+	}
+	if err := dial(t, s.Addr).Publish("jobs", "work", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	pings, delivered := 0, false
+	for line := conn.next(t); line != nil; line = conn.next(t) {
+		switch line["action"] {
+		case "ping":
+			pings++
+		case "message":
+			delivered = true
+		}
+	}
+	if pings == 0 || !delivered {
+		t.Fatalf("saw %d pings and delivery %v before the broker hung up", pings, delivered)
+	}
+
+	topic, _ := s.GetTopic("jobs")
+	if stats := topic.Stats(); stats.Subscribers != 0 || stats.InFlight != 0 || stats.Depth != 1 {
+		t.Fatalf("%d subscribers, %d in flight and %d queued after the drop, want 0, 0 and 1",
+			stats.Subscribers, stats.InFlight, stats.Depth)
+	}
+}
+
+// The client answers pings on its own, so a connection with heartbeats
+// stays up however long the application is quiet.
+func TestClientAnswersHeartbeats(t *testing.T) {
+	s := startWithHeartbeats(t)
+	c := dial(t, s.Addr)
+	if err := c.EnableHeartbeats(); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(3 * testHeartbeat * defaultMissedHeartbeats)
+	if _, err := c.Topics(); err != nil {
+		t.Fatalf("connection with heartbeats dropped: %v", err)
+	}
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"QueraMQ/tracing"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultPullMax = 1
+	maxPullMax     = 100
+	maxPullWait    = 30 * time.Second
+	// namespaceHeader selects the namespace of an HTTP request; requests
+	// without it use the default namespace.
+	namespaceHeader = "X-QueraMQ-Namespace"
+)
+
+func (s *Server) newHTTPServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", s.handleWebSocket)
+	mux.HandleFunc("POST /topics/{name}/messages", s.handleHTTPPublish)
+	mux.HandleFunc("GET /topics/{name}/messages", s.handleHTTPPull)
+	mux.HandleFunc("POST /ack", s.handleHTTPAck)
+	mux.HandleFunc("GET /metrics", s.handleMetrics)
+
+	return &http.Server{
+		Addr:    s.HTTPAddr,
+		Handler: mux,
+	}
+}
+
+func (s *Server) runHTTP(httpServer *http.Server) {
+	log.Printf("HTTP gateway started at %s", httpServer.Addr)
+	if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("HTTP gateway stopped: %v", err)
+	}
+}
+
+func (s *Server) handleHTTPPublish(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Content  *string           `json:"content"`
+		Priority *int              `json:"priority"`
+		Headers  map[string]string `json:"headers"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeHTTPError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if body.Content == nil {
+		writeHTTPError(w, http.StatusBadRequest, "message content is required")
+		return
+	}
+	if body.Priority == nil {
+		writeHTTPError(w, http.StatusBadRequest, "priority is required")
+		return
+	}
+
+	// A traceparent sent as an HTTP header continues the caller's trace
+	// unless the message carries its own.
+	if traceparent := r.Header.Get(tracing.TraceparentHeader); traceparent != "" {
+		if _, ok := body.Headers[tracing.TraceparentHeader]; !ok {
+			if body.Headers == nil {
+				body.Headers = make(map[string]string)
+			}
+			body.Headers[tracing.TraceparentHeader] = traceparent
+		}
+	}
+
+	ns, ok := s.httpNamespace(w, r)
+	if !ok {
+		return
+	}
+	topic, err := s.namespaceTopic(ns, r.PathValue("name"))
+	if err != nil {
+		writeHTTPTopicError(w, err)
+		return
+	}
+	limit, ok := s.httpLimit(w, r)
+	if !ok {
+		return
+	}
+	if scope, retryAfter, ok := s.limiter.allow(limit, topic); !ok {
+		writeHTTPRateLimited(w, scope, retryAfter)
+		return
+	}
+	if err := s.checkMessageQuota(ns); err != nil {
+		writeHTTPTopicError(w, err)
+		return
+	}
+	if err := topic.Publish(*body.Content, *body.Priority, body.Headers); err != nil {
+		log.Printf("Failed to publish to topic %s: %v", topic.Name, err)
+		writeHTTPError(w, http.StatusInternalServerError, "failed to store message")
+		return
+	}
+
+	writeHTTPJSON(w, http.StatusCreated, map[string]interface{}{"status": "ok"})
+}
+
+func (s *Server) handleHTTPPull(w http.ResponseWriter, r *http.Request) {
+	max := defaultPullMax
+	if value := r.URL.Query().Get("max"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			writeHTTPError(w, http.StatusBadRequest, "max must be a positive integer")
+			return
+		}
+		max = min(n, maxPullMax)
+	}
+
+	var wait time.Duration
+	if value := r.URL.Query().Get("wait"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			writeHTTPError(w, http.StatusBadRequest, "wait must be a duration such as 5s")
+			return
+		}
+		wait = min(d, maxPullWait)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+
+	ns, ok := s.httpNamespace(w, r)
+	if !ok {
+		return
+	}
+	topic, err := s.namespaceTopic(ns, r.PathValue("name"))
+	if err != nil {
+		writeHTTPTopicError(w, err)
+		return
+	}
+	messages := make([]map[string]interface{}, 0)
+	for _, message := range topic.Pull(ctx, max) {
+		messages = append(messages, messagePayload(message))
+	}
+
+	writeHTTPJSON(w, http.StatusOK, map[string]interface{}{"messages": messages})
+}
+
+func (s *Server) handleHTTPAck(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Topic string   `json:"topic"`
+		IDs   []string `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeHTTPError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if body.Topic == "" {
+		writeHTTPError(w, http.StatusBadRequest, "topic is required")
+		return
+	}
+
+	ids := make([]uuid.UUID, 0, len(body.IDs))
+	for _, value := range body.IDs {
+		id, err := uuid.Parse(value)
+		if err != nil {
+			writeHTTPError(w, http.StatusBadRequest, "invalid message id: "+value)
+			return
+		}
+		ids = append(ids, id)
+	}
+
+	ns, ok := s.httpNamespace(w, r)
+	if !ok {
+		return
+	}
+	topic, err := s.namespaceTopic(ns, body.Topic)
+	if err != nil {
+		writeHTTPTopicError(w, err)
+		return
+	}
+	// Pulled messages belong to no connection, so any HTTP client may ack
+	// them, but not messages pushed to subscribers.
+	acked := topic.Ack(ids, nil)
+
+	writeHTTPJSON(w, http.StatusOK, map[string]interface{}{"status": "ok", "acked": acked})
+}
+
+// httpNamespace resolves the namespace named by the namespaceHeader of r,
+// writing an error response when it does not exist.
+func (s *Server) httpNamespace(w http.ResponseWriter, r *http.Request) (*Namespace, bool) {
+	name := r.Header.Get(namespaceHeader)
+	if name == "" {
+		name = DefaultNamespace
+	}
+	ns, ok := s.namespace(name)
+	if !ok {
+		writeHTTPError(w, http.StatusNotFound, "namespace "+name+" not found")
+	}
+	return ns, ok
+}
+
+func writeHTTPTopicError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errQuotaExceeded) {
+		writeHTTPError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	writeHTTPError(w, http.StatusInternalServerError, err.Error())
+}
+
+func writeHTTPRateLimited(w http.ResponseWriter, scope string, retryAfter time.Duration) {
+	seconds := int64(math.Ceil(retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	writeHTTPJSON(w, http.StatusTooManyRequests, map[string]interface{}{
+		"error":          "rate_limited",
+		"scope":          scope,
+		"retry_after_ms": retryAfterMillis(retryAfter),
+	})
+}
+
+func writeHTTPJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeHTTPError(w http.ResponseWriter, status int, message string) {
+	writeHTTPJSON(w, status, map[string]interface{}{"error": message})
+}
+
+// httpLimit returns the rate limiting state of the client making r, which
+// authenticates with a bearer token or is counted by its address.
+func (s *Server) httpLimit(w http.ResponseWriter, r *http.Request) (*connLimit, bool) {
+	var principal *Principal
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		if principal, ok = s.authenticate(token); !ok {
+			writeHTTPError(w, http.StatusUnauthorized, "invalid token")
+			return nil, false
+		}
+	}
+	return s.limiter.httpLimit(clientIdentity(principal, r.RemoteAddr)), true
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startHTTP serves the HTTP gateway of a running s from an httptest server.
+func startHTTP(t *testing.T) (*Server, *httptest.Server) {
+	t.Helper()
+	s := NewServer(freeAddr(t))
+	start(t, s)
+	gateway := httptest.NewServer(s.newHTTPServer().Handler)
+	t.Cleanup(gateway.Close)
+	return s, gateway
+}
+
+// do sends a request to the gateway and decodes its JSON response.
+func do(t *testing.T, gateway *httptest.Server, method, path, body string) (int, map[string]interface{}) {
+	t.Helper()
+	req, err := http.NewRequest(method, gateway.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := gateway.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var decoded map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, decoded
+}
+
+// pulledIDs returns the ids of the messages in a pull response.
+func pulledIDs(response map[string]interface{}) []string {
+	var ids []string
+	messages, _ := response["messages"].([]interface{})
+	for _, message := range messages {
+		ids = append(ids, message.(map[string]interface{})["id"].(string))
+	}
+	return ids
+}
+
+func TestHTTPPublishValidatesBody(t *testing.T) {
+	_, gateway := startHTTP(t)
+	tests := []struct {
+		name string
+		body string
+		want int
+		err  string
+	}{
+		{"valid", `{"content": "hi", "priority": 0}`, http.StatusCreated, ""},
+		{"empty content", `{"content": "", "priority": 1}`, http.StatusCreated, ""},
+		{"missing content", `{"priority": 1}`, http.StatusBadRequest, "message content is required"},
+		{"missing priority", `{"content": "hi"}`, http.StatusBadRequest, "priority is required"},
+		{"not JSON", `content=hi`, http.StatusBadRequest, "invalid JSON body"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, response := do(t, gateway, "POST", "/topics/orders/messages", tt.body)
+			if status != tt.want || (tt.err != "" && response["error"] != tt.err) {
+				t.Fatalf("status %d with %v, want %d with error %q", status, response, tt.want, tt.err)
+			}
+		})
+	}
+}
+
+func TestHTTPPullValidatesQuery(t *testing.T) {
+	_, gateway := startHTTP(t)
+	tests := []struct {
+		query string
+		err   string
+	}{
+		{"max=0", "max must be a positive integer"},
+		{"max=-3", "max must be a positive integer"},
+		{"max=ten", "max must be a positive integer"},
+		{"wait=-1s", "wait must be a duration such as 5s"},
+		{"wait=5", "wait must be a duration such as 5s"},
+	}
+	for _, tt := range tests {
+		status, response := do(t, gateway, "GET", "/topics/orders/messages?"+tt.query, "")
+		if status != http.StatusBadRequest || response["error"] != tt.err {
+			t.Errorf("%s: status %d with %v, want 400 with %q", tt.query, status, response, tt.err)
+		}
+	}
+}
+
+func TestHTTPPullReturnsUpToMax(t *testing.T) {
+	_, gateway := startHTTP(t)
+	for i := 0; i < 3; i++ {
+		do(t, gateway, "POST", "/topics/orders/messages", `{"content": "order", "priority": 1}`)
+	}
+
+	_, response := do(t, gateway, "GET", "/topics/orders/messages", "")
+	if ids := pulledIDs(response); len(ids) != defaultPullMax {
+		t.Fatalf("pulled %d messages without max, want %d", len(ids), defaultPullMax)
+	}
+	_, response = do(t, gateway, "GET", "/topics/orders/messages?max=500", "")
+	if ids := pulledIDs(response); len(ids) != 2 {
+		t.Fatalf("pulled %d messages with a large max, want the 2 left", len(ids))
+	}
+}
+
+func TestHTTPPullLongPoll(t *testing.T) {
+	_, gateway := startHTTP(t)
+
+	began := time.Now()
+	status, response := do(t, gateway, "GET", "/topics/orders/messages?wait=100ms", "")
+	if elapsed := time.Since(began); elapsed < 100*time.Millisecond {
+		t.Fatalf("empty long poll returned after %v, want it to wait 100ms", elapsed)
+	}
+	if messages, ok := response["messages"].([]interface{}); status != http.StatusOK || !ok || len(messages) != 0 {
+		t.Fatalf("timed out long poll answered %d with %v, want 200 and an empty list", status, response)
+	}
+
+	// A message published while the poll waits ends it early.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		resp, err := gateway.Client().Post(gateway.URL+"/topics/orders/messages", "application/json",
+			strings.NewReader(`{"content": "late", "priority": 1}`))
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	began = time.Now()
+	_, response = do(t, gateway, "GET", "/topics/orders/messages?wait=10s", "")
+	if ids := pulledIDs(response); len(ids) != 1 || time.Since(began) > 5*time.Second {
+		t.Fatalf("long poll returned %v after %v, want the late message", response, time.Since(began))
+	}
+}
+
+func TestHTTPAck(t *testing.T) {
+	s, gateway := startHTTP(t)
+	do(t, gateway, "POST", "/topics/orders/messages", `{"content": "pulled", "priority": 1}`)
+	_, response := do(t, gateway, "GET", "/topics/orders/messages", "")
+	pulled := pulledIDs(response)[0]
+
+	// A message pushed to a subscriber belongs to its connection.
+	subscriber := dial(t, s.Addr)
+	if err := subscriber.SubscribeWithAcks("orders", ""); err != nil {
+		t.Fatal(err)
+	}
+	do(t, gateway, "POST", "/topics/orders/messages", `{"content": "pushed", "priority": 1}`)
+	pushed := collect(subscriber, 200*time.Millisecond)
+	if len(pushed) != 1 {
+		t.Fatalf("subscriber received %d messages, want 1", len(pushed))
+	}
+
+	tests := []struct {
+		name  string
+		body  string
+		want  int
+		acked float64
+		err   string
+	}{
+		{"unknown id", `{"topic": "orders", "ids": ["6ba7b810-9dad-11d1-80b4-00c04fd430c8"]}`, http.StatusOK, 0, ""},
+		{"foreign id", `{"topic": "orders", "ids": ["` + pushed[0].ID + `"]}`, http.StatusOK, 0, ""},
+		{"pulled id", `{"topic": "orders", "ids": ["` + pulled + `"]}`, http.StatusOK, 1, ""},
+		{"pulled id again", `{"topic": "orders", "ids": ["` + pulled + `"]}`, http.StatusOK, 0, ""},
+		{"invalid id", `{"topic": "orders", "ids": ["nope"]}`, http.StatusBadRequest, 0, "invalid message id: nope"},
+		{"missing topic", `{"ids": []}`, http.StatusBadRequest, 0, "topic is required"},
+		{"not JSON", `ids`, http.StatusBadRequest, 0, "invalid JSON body"},
+	}
+	for _, tt := range tests {
+		status, response := do(t, gateway, "POST", "/ack", tt.body)
+		if status != tt.want {
+			t.Errorf("%s: status %d with %v, want %d", tt.name, status, response, tt.want)
+		} else if tt.err != "" && response["error"] != tt.err {
+			t.Errorf("%s: error %v, want %q", tt.name, response["error"], tt.err)
+		} else if tt.err == "" && response["acked"] != tt.acked {
+			t.Errorf("%s: acked %v, want %v", tt.name, response["acked"], tt.acked)
+		}
+	}
+
+	// The subscriber can still settle its own message.
+	if err := subscriber.Ack(pushed[0].Topic, pushed[0].ID); err != nil {
+		t.Fatalf("subscriber could not ack its message after the HTTP ack: %v", err)
+	}
+}
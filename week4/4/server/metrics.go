@@ -0,0 +1,56 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// handleMetrics serves topic metrics in the Prometheus text format.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var topics []*Topic
+	var namespaces []string
+	for _, ns := range s.sortedNamespaces() {
+		for _, topic := range s.namespaceTopics(ns) {
+			topics = append(topics, topic)
+			namespaces = append(namespaces, ns.Name)
+		}
+	}
+	stats := make([]TopicStats, len(topics))
+	for i, topic := range topics {
+		stats[i] = topic.Stats()
+	}
+
+	metrics := []struct {
+		name  string
+		kind  string
+		help  string
+		value func(TopicStats) float64
+	}{
+		{"queramq_topic_depth", "gauge", "Messages waiting in the topic queue.",
+			func(st TopicStats) float64 { return float64(st.Depth) }},
+		{"queramq_topic_in_flight", "gauge", "Messages delivered or pulled but not yet acknowledged.",
+			func(st TopicStats) float64 { return float64(st.InFlight) }},
+		{"queramq_topic_subscribers", "gauge", "Connections subscribed to the topic.",
+			func(st TopicStats) float64 { return float64(st.Subscribers) }},
+		{"queramq_topic_filtered", "gauge", "Queued messages that no subscriber filter matches.",
+			func(st TopicStats) float64 { return float64(st.Filtered) }},
+		{"queramq_topic_oldest_message_age_seconds", "gauge", "Time the oldest queued message has been waiting.",
+			func(st TopicStats) float64 { return st.OldestAge.Seconds() }},
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, metric := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+		for i, topic := range topics {
+			fmt.Fprintf(w, "%s{namespace=%s,topic=%s} %g\n",
+				metric.name, strconv.Quote(namespaces[i]), strconv.Quote(topic.Name), metric.value(stats[i]))
+		}
+	}
+
+	rejected := s.limiter.rejectedCounts()
+	fmt.Fprint(w, "# HELP queramq_rate_limited_total Publishes refused by a rate limit.\n# TYPE queramq_rate_limited_total counter\n")
+	for _, scope := range []string{scopeConnection, scopeIdentity, scopeTopic} {
+		fmt.Fprintf(w, "queramq_rate_limited_total{scope=%s} %d\n", strconv.Quote(scope), rejected[scope])
+	}
+}
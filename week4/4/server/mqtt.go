@@ -0,0 +1,446 @@
+package server
+
+import (
+	"QueraMQ/client"
+	"QueraMQ/queue"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// mqttConnectTimeout is how long a new MQTT connection may take to send
+	// CONNECT.
+	mqttConnectTimeout       = 10 * time.Second
+	defaultMQTTRetryInterval = 20 * time.Second
+	// mqttMaxInflight caps the QoS 1 messages sent to a client and awaiting
+	// its PUBACK; the rest wait in the session's queue.
+	mqttMaxInflight = 32
+	// mqttMaxQueued caps the messages waiting for a slow client. Messages
+	// published while it is full are dropped for that client.
+	mqttMaxQueued = 10000
+)
+
+// mqttSession adapts one MQTT 3.1.1 connection onto the broker. Every
+// session receives its own copy of each message published to a topic its
+// filters match, the way MQTT subscribers do, while the message is still
+// queued for QueraMQ subscribers and pull consumers as usual. Publishes go
+// through a local client, so that they are rate-limited and counted
+// against quotas like any other.
+//
+// Sessions are always clean: a client asking to keep its session is
+// accepted, but nothing survives a disconnect, including QoS 1 messages it
+// did not acknowledge.
+type mqttSession struct {
+	server *Server
+	conn   net.Conn
+	local  *client.Client
+	// subMu serializes subscription changes, which lock topics and must
+	// not hold mu while they do. Topics created meanwhile are followed
+	// under mu alone; see topicCreated.
+	subMu   sync.Mutex
+	mu      sync.Mutex
+	filters map[string]byte
+	topics  map[*Topic]bool
+	closed  bool
+	// queue holds the messages waiting to be sent, and queued is signalled
+	// when it grows or room frees up in pending.
+	queue       []mqttMessage
+	queued      chan struct{}
+	overflowing bool
+	pending     map[uint16]*mqttMessage
+	nextID      uint16
+}
+
+// mqttMessage is a session's copy of a published message.
+type mqttMessage struct {
+	topic    string
+	payload  []byte
+	qos      byte
+	packetID uint16
+	sentAt   time.Time
+}
+
+func (s *Server) runMQTT(ln net.Listener) {
+	log.Printf("MQTT listener started at %s", s.MQTTAddr)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("MQTT listener stopped: %v", err)
+			}
+			return
+		}
+		go s.handleMQTT(conn)
+	}
+}
+
+func (s *Server) handleMQTT(conn net.Conn) {
+	conn = newSession(conn, s.WriteTimeout)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(mqttConnectTimeout))
+	packet, err := readMQTTPacket(reader)
+	if err != nil || packet.kind != mqttConnect {
+		log.Printf("MQTT client %s did not send CONNECT", conn.RemoteAddr())
+		return
+	}
+	connect, err := parseMQTTConnect(packet.body)
+	if err != nil {
+		log.Printf("Invalid CONNECT from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	if connect.protocol != "MQTT" || connect.level != 4 {
+		conn.Write(encodeMQTTPacket(mqttConnack, 0, []byte{0, mqttUnacceptableProtocol}))
+		return
+	}
+	if connect.clientID == "" && !connect.cleanSession {
+		conn.Write(encodeMQTTPacket(mqttConnack, 0, []byte{0, mqttIdentifierRejected}))
+		return
+	}
+
+	m := &mqttSession{
+		server:  s,
+		conn:    conn,
+		local:   s.dialLocal(conn.RemoteAddr()),
+		filters: make(map[string]byte),
+		topics:  make(map[*Topic]bool),
+		queued:  make(chan struct{}, 1),
+		pending: make(map[uint16]*mqttMessage),
+	}
+	defer m.local.Close()
+
+	if err := m.local.Hello(DefaultNamespace); err != nil {
+		log.Printf("Failed to set up MQTT client %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	s.mu.Lock()
+	s.mqttSessions[m] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.mqttSessions, m)
+		s.mu.Unlock()
+		m.unfollowAll()
+	}()
+
+	if _, err := conn.Write(encodeMQTTPacket(mqttConnack, 0, []byte{0, mqttAccepted})); err != nil {
+		return
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go m.deliver(done)
+
+	keepAlive := time.Duration(connect.keepAlive) * time.Second
+	if !m.serve(reader, keepAlive) && connect.will != nil {
+		if err := m.local.Publish(connect.will.topic, string(connect.will.message), 0, nil); err != nil {
+			log.Printf("Failed to publish will of MQTT client %s: %v", connect.clientID, err)
+		}
+	}
+}
+
+// serve handles packets until the connection ends and reports whether the
+// client disconnected cleanly.
+func (m *mqttSession) serve(reader *bufio.Reader, keepAlive time.Duration) bool {
+	for {
+		// The client must send something within one and a half keep-alive
+		// periods; zero turns the check off.
+		var deadline time.Time
+		if keepAlive > 0 {
+			deadline = time.Now().Add(keepAlive * 3 / 2)
+		}
+		m.conn.SetReadDeadline(deadline)
+
+		packet, err := readMQTTPacket(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Closing MQTT client %s: %v", m.conn.RemoteAddr(), err)
+			}
+			return false
+		}
+
+		switch packet.kind {
+		case mqttPublish:
+			err = m.publish(packet)
+		case mqttPuback:
+			err = m.puback(packet)
+		case mqttSubscribe:
+			err = m.subscribe(packet)
+		case mqttUnsubscribe:
+			err = m.unsubscribe(packet)
+		case mqttPingreq:
+			_, err = m.conn.Write(encodeMQTTPacket(mqttPingresp, 0, nil))
+		case mqttDisconnect:
+			return true
+		default:
+			err = fmt.Errorf("unexpected MQTT packet type %d", packet.kind)
+		}
+		if err != nil {
+			log.Printf("Closing MQTT client %s: %v", m.conn.RemoteAddr(), err)
+			return false
+		}
+	}
+}
+
+func (m *mqttSession) publish(packet mqttPacket) error {
+	p, err := parseMQTTPublish(packet.flags, packet.body)
+	if err != nil {
+		return err
+	}
+	if p.qos == 2 {
+		return errors.New("QoS 2 is not supported")
+	}
+
+	// MQTT 3.1.1 has no way to refuse a publish, so a rate-limited client
+	// is slowed down instead: its packets are not read while it waits.
+	if err := m.local.PublishWait(p.topic, string(p.payload), 0, nil); err != nil {
+		return err
+	}
+	if p.qos == 1 {
+		_, err = m.conn.Write(encodeMQTTAck(mqttPuback, p.packetID))
+	}
+	return err
+}
+
+func (m *mqttSession) puback(packet mqttPacket) error {
+	r := &mqttReader{data: packet.body}
+	packetID := r.uint16()
+	if r.err != nil {
+		return r.err
+	}
+
+	m.mu.Lock()
+	delete(m.pending, packetID)
+	m.mu.Unlock()
+	m.signal()
+	return nil
+}
+
+func (m *mqttSession) subscribe(packet mqttPacket) error {
+	packetID, subscriptions, err := parseMQTTSubscribe(packet.flags, packet.body, true)
+	if err != nil {
+		return err
+	}
+
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+
+	codes := make([]byte, len(subscriptions))
+	m.mu.Lock()
+	for i, sub := range subscriptions {
+		if !validMQTTFilter(sub.filter) || sub.qos > 2 {
+			codes[i] = mqttSubscribeFailure
+			continue
+		}
+		codes[i] = min(sub.qos, 1)
+		m.filters[sub.filter] = codes[i]
+	}
+	m.mu.Unlock()
+
+	// Follow the topics before acknowledging, so that the client receives
+	// whatever is published once it has SUBACK.
+	for _, topic := range m.server.Topics() {
+		m.follow(topic)
+	}
+	_, err = m.conn.Write(encodeMQTTAck(mqttSuback, packetID, codes...))
+	return err
+}
+
+func (m *mqttSession) unsubscribe(packet mqttPacket) error {
+	packetID, subscriptions, err := parseMQTTSubscribe(packet.flags, packet.body, false)
+	if err != nil {
+		return err
+	}
+
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+
+	m.mu.Lock()
+	for _, sub := range subscriptions {
+		delete(m.filters, sub.filter)
+	}
+	var unfollow []*Topic
+	for topic := range m.topics {
+		if _, ok := m.qos(topic.Name); !ok {
+			unfollow = append(unfollow, topic)
+			delete(m.topics, topic)
+		}
+	}
+	m.mu.Unlock()
+
+	// Messages already queued for the topics are still sent, as MQTT allows.
+	for _, topic := range unfollow {
+		topic.removeTap(m)
+	}
+	_, err = m.conn.Write(encodeMQTTAck(mqttUnsuback, packetID))
+	return err
+}
+
+// topicCreated follows a topic that matches the session's wildcard filters
+// but was created after them. The topic is not in its namespace yet, so
+// nothing else can use it and the tap is added without locking it.
+func (m *mqttSession) topicCreated(topic *Topic) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, matched := m.qos(topic.Name); matched && !m.closed {
+		m.topics[topic] = true
+		topic.taps[m] = struct{}{}
+	}
+}
+
+// follow adds the session as a tap of topic if one of its filters matches
+// the topic and it does not follow it yet. The caller holds subMu.
+func (m *mqttSession) follow(topic *Topic) {
+	m.mu.Lock()
+	_, matched := m.qos(topic.Name)
+	follow := matched && !m.topics[topic] && !m.closed
+	if follow {
+		m.topics[topic] = true
+	}
+	m.mu.Unlock()
+
+	if follow {
+		topic.addTap(m)
+	}
+}
+
+// unfollowAll stops following every topic once the connection has ended.
+func (m *mqttSession) unfollowAll() {
+	m.subMu.Lock()
+	defer m.subMu.Unlock()
+
+	m.mu.Lock()
+	topics := m.topics
+	m.topics = make(map[*Topic]bool)
+	m.closed = true
+	m.mu.Unlock()
+
+	for topic := range topics {
+		topic.removeTap(m)
+	}
+}
+
+// qos returns the highest QoS granted by the filters matching topic. The
+// caller holds mu.
+func (m *mqttSession) qos(topic string) (byte, bool) {
+	var granted byte
+	matched := false
+	for filter, qos := range m.filters {
+		if matchMQTTFilter(filter, topic) {
+			granted = max(granted, qos)
+			matched = true
+		}
+	}
+	return granted, matched
+}
+
+// published queues a copy of a message published to a followed topic. It
+// is called with the topic locked, so it only queues the message for
+// deliver to send.
+func (m *mqttSession) published(topic *Topic, message *queue.Message) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	qos, ok := m.qos(topic.Name)
+	if !ok {
+		return
+	}
+	if len(m.queue) >= mqttMaxQueued {
+		if !m.overflowing {
+			log.Printf("MQTT client %s is too slow, dropping its messages", m.conn.RemoteAddr())
+			m.overflowing = true
+		}
+		return
+	}
+	m.queue = append(m.queue, mqttMessage{topic: topic.Name, payload: []byte(message.Content), qos: qos})
+	m.signal()
+}
+
+func (m *mqttSession) signal() {
+	select {
+	case m.queued <- struct{}{}:
+	default:
+	}
+}
+
+// deliver sends queued messages as PUBLISH packets until done is closed,
+// and sends QoS 1 messages again while they go unacknowledged.
+func (m *mqttSession) deliver(done <-chan struct{}) {
+	retry := time.NewTicker(m.retryInterval() / 2)
+	defer retry.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-m.queued:
+		case <-retry.C:
+		}
+
+		for _, packet := range m.outgoing(time.Now()) {
+			if _, err := m.conn.Write(packet); err != nil {
+				m.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func (m *mqttSession) retryInterval() time.Duration {
+	if m.server.MQTTRetryInterval > 0 {
+		return m.server.MQTTRetryInterval
+	}
+	return defaultMQTTRetryInterval
+}
+
+// outgoing returns the packets to send next: the QoS 1 messages due to be
+// sent again, then queued messages while fewer than mqttMaxInflight await
+// PUBACK.
+func (m *mqttSession) outgoing(now time.Time) [][]byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var packets [][]byte
+	for _, msg := range m.pending {
+		if now.Sub(msg.sentAt) >= m.retryInterval() {
+			msg.sentAt = now
+			packets = append(packets, encodeMQTTPublish(msg.topic, msg.payload, msg.qos, msg.packetID, true))
+		}
+	}
+
+	sent := 0
+	for ; sent < len(m.queue) && len(m.pending) < mqttMaxInflight; sent++ {
+		msg := m.queue[sent]
+		if msg.qos > 0 {
+			msg.packetID = m.nextPacketID()
+			msg.sentAt = now
+			m.pending[msg.packetID] = &msg
+		}
+		packets = append(packets, encodeMQTTPublish(msg.topic, msg.payload, msg.qos, msg.packetID, false))
+	}
+	m.queue = slices.Delete(m.queue, 0, sent)
+	if len(m.queue) == 0 {
+		m.overflowing = false
+	}
+	return packets
+}
+
+// nextPacketID returns an unused non-zero packet identifier. The caller
+// holds mu.
+func (m *mqttSession) nextPacketID() uint16 {
+	for {
+		m.nextID++
+		if _, used := m.pending[m.nextID]; m.nextID != 0 && !used {
+			return m.nextID
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// startMQTT runs a server with its MQTT listener until the test ends.
+func startMQTT(t *testing.T, configure func(s *Server)) *Server {
+	t.Helper()
+	s := NewServer(freeAddr(t))
+	s.MQTTAddr = freeAddr(t)
+	if configure != nil {
+		configure(s)
+	}
+	start(t, s)
+	waitListening(t, s.MQTTAddr)
+	return s
+}
+
+// connectMQTT connects an MQTT client to s. Unless autoAck is set, the
+// test acks QoS 1 messages itself.
+func connectMQTT(t *testing.T, s *Server, id string, autoAck bool) mqtt.Client {
+	t.Helper()
+	opts := mqtt.NewClientOptions().
+		AddBroker("tcp://" + s.MQTTAddr).
+		SetClientID(id).
+		SetAutoReconnect(false).
+		SetAutoAckDisabled(!autoAck)
+	c := mqtt.NewClient(opts)
+	wait(t, c.Connect())
+	t.Cleanup(func() { c.Disconnect(100) })
+	return c
+}
+
+func wait(t *testing.T, token mqtt.Token) {
+	t.Helper()
+	if !token.WaitTimeout(5 * time.Second) {
+		t.Fatal("timed out waiting for the broker")
+	}
+	if err := token.Error(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// subscribeMQTT subscribes c to filter and returns the messages it
+// receives.
+func subscribeMQTT(t *testing.T, c mqtt.Client, filter string, qos byte) <-chan mqtt.Message {
+	t.Helper()
+	messages := make(chan mqtt.Message, 100)
+	wait(t, c.Subscribe(filter, qos, func(_ mqtt.Client, m mqtt.Message) {
+		messages <- m
+	}))
+	return messages
+}
+
+func nextMQTT(t *testing.T, messages <-chan mqtt.Message, timeout time.Duration) mqtt.Message {
+	t.Helper()
+	select {
+	case m := <-messages:
+		return m
+	case <-time.After(timeout):
+		t.Fatal("no message arrived")
+		return nil
+	}
+}
+
+// Every MQTT subscriber receives its own copy of each message, while the
+// topic's QueraMQ subscribers still share the queue.
+func TestMQTTSubscribersEachReceiveACopy(t *testing.T) {
+	const n = 20
+	s := startMQTT(t, nil)
+	if _, err := s.GetTopic("sensors/temp"); err != nil {
+		t.Fatal(err)
+	}
+
+	queue := dial(t, s.Addr)
+	if err := queue.SubscribeWithAcks("sensors/temp", ""); err != nil {
+		t.Fatal(err)
+	}
+	first := subscribeMQTT(t, connectMQTT(t, s, "first", true), "sensors/#", 1)
+	second := subscribeMQTT(t, connectMQTT(t, s, "second", true), "sensors/temp", 0)
+
+	publisher := connectMQTT(t, s, "publisher", true)
+	for i := 0; i < n; i++ {
+		wait(t, publisher.Publish("sensors/temp", 1, false, fmt.Sprint(i)))
+	}
+
+	for name, messages := range map[string]<-chan mqtt.Message{"first": first, "second": second} {
+		for i := 0; i < n; i++ {
+			m := nextMQTT(t, messages, 5*time.Second)
+			if got, want := string(m.Payload()), fmt.Sprint(i); got != want || m.Topic() != "sensors/temp" {
+				t.Fatalf("%s subscriber got %q on %s, want %q on sensors/temp", name, got, m.Topic(), want)
+			}
+		}
+	}
+	receive(t, queue, n, 5*time.Second)
+}
+
+// A QoS 1 message the client does not acknowledge is sent again with DUP
+// set, until it is.
+func TestMQTTRedeliversUnacknowledgedWithDup(t *testing.T) {
+	const retry = 100 * time.Millisecond
+	s := startMQTT(t, func(s *Server) { s.MQTTRetryInterval = retry })
+	if _, err := s.GetTopic("alerts"); err != nil {
+		t.Fatal(err)
+	}
+	messages := subscribeMQTT(t, connectMQTT(t, s, "subscriber", false), "alerts", 1)
+
+	if err := dial(t, s.Addr).Publish("alerts", "fire", 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	first := nextMQTT(t, messages, 5*time.Second)
+	if first.Duplicate() {
+		t.Fatal("first delivery has DUP set")
+	}
+	again := nextMQTT(t, messages, 5*time.Second)
+	if !again.Duplicate() || again.MessageID() != first.MessageID() || string(again.Payload()) != "fire" {
+		t.Fatalf("redelivered %q with DUP %v and id %d, want %q with DUP and id %d",
+			again.Payload(), again.Duplicate(), again.MessageID(), "fire", first.MessageID())
+	}
+	again.Ack()
+
+	// Copies sent before the ack arrived may still come in; after that,
+	// nothing should.
+	time.Sleep(2 * retry)
+	for len(messages) > 0 {
+		<-messages
+	}
+	select {
+	case m := <-messages:
+		t.Fatalf("message %q sent again after it was acknowledged", m.Payload())
+	case <-time.After(5 * retry):
+	}
+}
+
+// A wildcard subscription receives the first message published to a topic
+// created after it.
+func TestMQTTWildcardFollowsNewTopics(t *testing.T) {
+	s := startMQTT(t, nil)
+	messages := subscribeMQTT(t, connectMQTT(t, s, "subscriber", true), "sensors/+/temp", 1)
+
+	publisher := connectMQTT(t, s, "publisher", true)
+	wait(t, publisher.Publish("sensors/kitchen/temp", 1, false, "21.5"))
+	wait(t, publisher.Publish("sensors/kitchen/humidity", 1, false, "60"))
+	if err := dial(t, s.Addr).Publish("sensors/hall/temp", "19", 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"sensors/kitchen/temp", "sensors/hall/temp"} {
+		if m := nextMQTT(t, messages, 5*time.Second); m.Topic() != want {
+			t.Fatalf("got a message on %s, want %s", m.Topic(), want)
+		}
+	}
+	select {
+	case m := <-messages:
+		t.Fatalf("unexpected message on %s", m.Topic())
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,307 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// MQTT 3.1.1 control packet types.
+const (
+	mqttConnect     = 1
+	mqttConnack     = 2
+	mqttPublish     = 3
+	mqttPuback      = 4
+	mqttSubscribe   = 8
+	mqttSuback      = 9
+	mqttUnsubscribe = 10
+	mqttUnsuback    = 11
+	mqttPingreq     = 12
+	mqttPingresp    = 13
+	mqttDisconnect  = 14
+)
+
+// CONNACK return codes.
+const (
+	mqttAccepted             = 0
+	mqttUnacceptableProtocol = 1
+	mqttIdentifierRejected   = 2
+)
+
+// mqttSubscribeFailure is the SUBACK return code of a rejected filter.
+const mqttSubscribeFailure byte = 0x80
+
+// maxMQTTPacket bounds the remaining length of a packet we are willing to
+// buffer, well below the 256 MB the protocol allows.
+const maxMQTTPacket = 1 << 20
+
+var errMalformedMQTT = errors.New("malformed MQTT packet")
+
+type mqttPacket struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+func readMQTTPacket(r *bufio.Reader) (mqttPacket, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return mqttPacket{}, err
+	}
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return mqttPacket{}, errMalformedMQTT
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return mqttPacket{}, err
+		}
+		length += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	if length > maxMQTTPacket {
+		return mqttPacket{}, fmt.Errorf("MQTT packet of %d bytes is too large", length)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return mqttPacket{}, err
+	}
+	return mqttPacket{kind: header >> 4, flags: header & 0x0f, body: body}, nil
+}
+
+func encodeMQTTPacket(kind, flags byte, body []byte) []byte {
+	packet := []byte{kind<<4 | flags}
+	length := len(body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if length == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+// mqttReader consumes the fields of a packet body in order.
+type mqttReader struct {
+	data []byte
+	err  error
+}
+
+func (r *mqttReader) byte() byte {
+	if r.err != nil || len(r.data) < 1 {
+		r.err = errMalformedMQTT
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+
+func (r *mqttReader) uint16() uint16 {
+	if r.err != nil || len(r.data) < 2 {
+		r.err = errMalformedMQTT
+		return 0
+	}
+	v := binary.BigEndian.Uint16(r.data)
+	r.data = r.data[2:]
+	return v
+}
+
+func (r *mqttReader) bytes() []byte {
+	n := int(r.uint16())
+	if r.err != nil || len(r.data) < n {
+		r.err = errMalformedMQTT
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *mqttReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *mqttReader) rest() []byte {
+	b := r.data
+	r.data = nil
+	return b
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+type mqttConnectPacket struct {
+	protocol     string
+	level        byte
+	cleanSession bool
+	keepAlive    uint16
+	clientID     string
+	will         *mqttWill
+	username     string
+	password     []byte
+}
+
+// mqttWill is published on the client's behalf when it disconnects without
+// sending DISCONNECT.
+type mqttWill struct {
+	topic   string
+	message []byte
+	qos     byte
+}
+
+func parseMQTTConnect(body []byte) (mqttConnectPacket, error) {
+	r := &mqttReader{data: body}
+	var p mqttConnectPacket
+	p.protocol = r.string()
+	p.level = r.byte()
+	flags := r.byte()
+	p.keepAlive = r.uint16()
+	p.clientID = r.string()
+	if r.err != nil {
+		return p, r.err
+	}
+	if flags&0x01 != 0 {
+		return p, errMalformedMQTT
+	}
+
+	p.cleanSession = flags&0x02 != 0
+	if flags&0x04 != 0 {
+		p.will = &mqttWill{qos: flags >> 3 & 0x03}
+		p.will.topic = r.string()
+		p.will.message = r.bytes()
+	}
+	if flags&0x80 != 0 {
+		p.username = r.string()
+	}
+	if flags&0x40 != 0 {
+		p.password = r.bytes()
+	}
+	return p, r.err
+}
+
+type mqttPublishPacket struct {
+	topic    string
+	packetID uint16
+	qos      byte
+	payload  []byte
+}
+
+func parseMQTTPublish(flags byte, body []byte) (mqttPublishPacket, error) {
+	r := &mqttReader{data: body}
+	p := mqttPublishPacket{qos: flags >> 1 & 0x03}
+	if p.qos == 3 {
+		return p, errMalformedMQTT
+	}
+	p.topic = r.string()
+	if p.qos > 0 {
+		p.packetID = r.uint16()
+	}
+	p.payload = r.rest()
+	if r.err == nil && (p.topic == "" || strings.ContainsAny(p.topic, "+#")) {
+		return p, fmt.Errorf("invalid topic name %q", p.topic)
+	}
+	return p, r.err
+}
+
+// encodeMQTTPublish encodes PUBLISH. dup marks a QoS 1 message sent again
+// because the first attempt was not acknowledged.
+func encodeMQTTPublish(topic string, payload []byte, qos byte, packetID uint16, dup bool) []byte {
+	body := appendMQTTString(nil, topic)
+	if qos > 0 {
+		body = binary.BigEndian.AppendUint16(body, packetID)
+	}
+	flags := qos << 1
+	if dup {
+		flags |= 0x08
+	}
+	return encodeMQTTPacket(mqttPublish, flags, append(body, payload...))
+}
+
+type mqttSubscription struct {
+	filter string
+	qos    byte
+}
+
+// parseMQTTSubscribe decodes SUBSCRIBE, and UNSUBSCRIBE when withQoS is
+// false.
+func parseMQTTSubscribe(flags byte, body []byte, withQoS bool) (uint16, []mqttSubscription, error) {
+	if flags != 0x02 {
+		return 0, nil, errMalformedMQTT
+	}
+	r := &mqttReader{data: body}
+	packetID := r.uint16()
+	var subscriptions []mqttSubscription
+	for r.err == nil && len(r.data) > 0 {
+		sub := mqttSubscription{filter: r.string()}
+		if withQoS {
+			sub.qos = r.byte()
+		}
+		subscriptions = append(subscriptions, sub)
+	}
+	if r.err == nil && len(subscriptions) == 0 {
+		return 0, nil, errMalformedMQTT
+	}
+	return packetID, subscriptions, r.err
+}
+
+func encodeMQTTAck(kind byte, packetID uint16, payload ...byte) []byte {
+	return encodeMQTTPacket(kind, 0, append(binary.BigEndian.AppendUint16(nil, packetID), payload...))
+}
+
+// validMQTTFilter reports whether filter is a well-formed topic filter: '#'
+// may only be the last level and '+' must fill a whole level.
+func validMQTTFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+	}
+	return true
+}
+
+// matchMQTTFilter reports whether topic matches the topic filter. Topics
+// starting with '$' are not matched by a leading wildcard.
+func matchMQTTFilter(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
@@ -0,0 +1,316 @@
+package server
+
+import (
+	"QueraMQ/storage"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"path/filepath"
+	"sort"
+)
+
+// DefaultNamespace holds the topics of clients that do not select a
+// namespace, as well as those of MQTT clients and bridges.
+const DefaultNamespace = "default"
+
+// errQuotaExceeded is wrapped by the errors of requests a namespace quota
+// refuses.
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// Quota limits what a namespace may use. Zero fields mean no limit.
+type Quota struct {
+	MaxTopics int `json:"max_topics"`
+	// MaxMessages caps the messages queued across all topics of the
+	// namespace; publishing beyond it fails until consumers catch up.
+	MaxMessages    int `json:"max_messages"`
+	MaxConnections int `json:"max_connections"`
+}
+
+// Namespace is an isolated set of topics, like a virtual host: the same
+// topic name in two namespaces refers to two different topics. Its fields
+// are guarded by the server's mutex.
+type Namespace struct {
+	Name        string
+	Quota       Quota
+	topics      map[string]*Topic
+	connections map[net.Conn]struct{}
+	deleted     bool
+}
+
+func newNamespace(name string, quota Quota) *Namespace {
+	return &Namespace{
+		Name:        name,
+		Quota:       quota,
+		topics:      make(map[string]*Topic),
+		connections: make(map[net.Conn]struct{}),
+	}
+}
+
+// CreateNamespace adds an empty namespace.
+func (s *Server) CreateNamespace(name string, quota Quota) error {
+	if name == "" {
+		return errors.New("namespace name is required")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.namespaces[name]; exists {
+		return fmt.Errorf("namespace %s already exists", name)
+	}
+	s.namespaces[name] = newNamespace(name, quota)
+	return nil
+}
+
+// DeleteNamespace closes the topics of a namespace and disconnects its
+// clients. Messages kept by persistent storage backends stay on disk and
+// reappear if the namespace is created again.
+func (s *Server) DeleteNamespace(name string) error {
+	if name == DefaultNamespace {
+		return errors.New("the default namespace cannot be deleted")
+	}
+
+	s.mu.Lock()
+	ns, exists := s.namespaces[name]
+	if !exists {
+		s.mu.Unlock()
+		return fmt.Errorf("namespace %s not found", name)
+	}
+	delete(s.namespaces, name)
+	ns.deleted = true
+	topics := make([]*Topic, 0, len(ns.topics))
+	for _, topic := range ns.topics {
+		topics = append(topics, topic)
+	}
+	connections := make([]net.Conn, 0, len(ns.connections))
+	for conn := range ns.connections {
+		connections = append(connections, conn)
+	}
+	s.mu.Unlock()
+
+	for _, conn := range connections {
+		conn.Close()
+	}
+	for _, topic := range topics {
+		topic.Close()
+	}
+	return nil
+}
+
+// joinNamespace binds conn to the namespace called name, subject to its
+// connection quota.
+func (s *Server) joinNamespace(name string, conn net.Conn) (*Namespace, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ns, exists := s.namespaces[name]
+	if !exists {
+		return nil, fmt.Errorf("namespace %s not found", name)
+	}
+	if ns.Quota.MaxConnections > 0 && len(ns.connections) >= ns.Quota.MaxConnections {
+		return nil, fmt.Errorf("%w: namespace %s allows %d connections", errQuotaExceeded, name, ns.Quota.MaxConnections)
+	}
+	ns.connections[conn] = struct{}{}
+	return ns, nil
+}
+
+func (s *Server) leaveNamespace(ns *Namespace, conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(ns.connections, conn)
+}
+
+// namespaceTopic returns the topic called name in ns, creating it if it does
+// not exist yet.
+func (s *Server) namespaceTopic(ns *Namespace, topicName string) (*Topic, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ns.deleted {
+		return nil, fmt.Errorf("namespace %s was deleted", ns.Name)
+	}
+	topic, exists := ns.topics[topicName]
+	if exists {
+		return topic, nil
+	}
+	if ns.Quota.MaxTopics > 0 && len(ns.topics) >= ns.Quota.MaxTopics {
+		return nil, fmt.Errorf("%w: namespace %s allows %d topics", errQuotaExceeded, ns.Name, ns.Quota.MaxTopics)
+	}
+
+	cfg, ok := s.TopicStorage[topicName]
+	if !ok {
+		cfg = s.DefaultStorage
+	}
+	if ns.Name != DefaultNamespace && cfg.Path != "" {
+		cfg.Path = filepath.Join(cfg.Path, "namespaces", url.PathEscape(ns.Name))
+	}
+	store, err := storage.Open(cfg, topicName)
+	if err != nil {
+		log.Printf("Failed to open storage for topic %s in namespace %s: %v", topicName, ns.Name, err)
+		return nil, fmt.Errorf("failed to open topic %s", topicName)
+	}
+
+	newTopic := NewTopic(topicName, store, s.Tracer)
+	if ns.Name == DefaultNamespace {
+		// Before anyone can publish to it, so that MQTT clients receive the
+		// topic's first message too.
+		for session := range s.mqttSessions {
+			session.topicCreated(newTopic)
+		}
+	}
+	ns.topics[topicName] = newTopic
+	return newTopic, nil
+}
+
+// checkMessageQuota fails when ns already queues as many messages as its
+// quota allows.
+func (s *Server) checkMessageQuota(ns *Namespace) error {
+	if ns.Quota.MaxMessages <= 0 {
+		return nil
+	}
+
+	queued := 0
+	for _, topic := range s.namespaceTopics(ns) {
+		queued += topic.Depth()
+	}
+	if queued >= ns.Quota.MaxMessages {
+		return fmt.Errorf("%w: namespace %s allows %d queued messages", errQuotaExceeded, ns.Name, ns.Quota.MaxMessages)
+	}
+	return nil
+}
+
+// namespaceTopics returns the topics of ns, sorted by name.
+func (s *Server) namespaceTopics(ns *Namespace) []*Topic {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	topics := make([]*Topic, 0, len(ns.topics))
+	for _, topic := range ns.topics {
+		topics = append(topics, topic)
+	}
+	sort.Slice(topics, func(i, j int) bool { return topics[i].Name < topics[j].Name })
+	return topics
+}
+
+func (s *Server) defaultNamespace() *Namespace {
+	ns, _ := s.namespace(DefaultNamespace)
+	return ns
+}
+
+func (s *Server) namespace(name string) (*Namespace, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ns, ok := s.namespaces[name]
+	return ns, ok
+}
+
+// sortedNamespaces returns every namespace, sorted by name.
+func (s *Server) sortedNamespaces() []*Namespace {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	namespaces := make([]*Namespace, 0, len(s.namespaces))
+	for _, ns := range s.namespaces {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Slice(namespaces, func(i, j int) bool { return namespaces[i].Name < namespaces[j].Name })
+	return namespaces
+}
+
+// allTopics returns the topics of every namespace. The caller holds mu.
+func (s *Server) allTopics() []*Topic {
+	topics := make([]*Topic, 0)
+	for _, ns := range s.namespaces {
+		for _, topic := range ns.topics {
+			topics = append(topics, topic)
+		}
+	}
+	return topics
+}
+
+// handleHello selects the namespace of a connection and authenticates it if
+// it presents a token, which makes rate limits count it by its principal.
+// It must be the first request on the connection.
+func (s *Server) handleHello(request map[string]interface{}, encoder *json.Encoder, conn net.Conn, ns **Namespace, principal **Principal, limit *connLimit) {
+	if *ns != nil {
+		s.sendError(encoder, "hello must be the first request")
+		return
+	}
+	if token, ok := request["token"].(string); ok {
+		authenticated, ok := s.authenticate(token)
+		if !ok {
+			s.sendError(encoder, "invalid token")
+			return
+		}
+		*principal = authenticated
+		limit.identity = clientIdentity(authenticated, conn.RemoteAddr().String())
+	}
+	name, ok := request["namespace"].(string)
+	if !ok || name == "" {
+		name = DefaultNamespace
+	}
+
+	joined, err := s.joinNamespace(name, conn)
+	if err != nil {
+		s.sendError(encoder, err.Error())
+		return
+	}
+	*ns = joined
+
+	response := map[string]interface{}{"status": "ok", "namespace": name}
+	encoder.Encode(response)
+}
+
+func (s *Server) handleCreateNamespace(request map[string]interface{}, encoder *json.Encoder, principal *Principal) {
+	if !principal.canManageNamespaces() {
+		s.sendError(encoder, errPermissionDenied.Error())
+		return
+	}
+	name, ok := request["namespace"].(string)
+	if !ok {
+		s.sendError(encoder, "namespace is required")
+		return
+	}
+
+	var quota Quota
+	if raw, ok := request["quota"]; ok {
+		data, _ := json.Marshal(raw)
+		if err := json.Unmarshal(data, &quota); err != nil {
+			s.sendError(encoder, "invalid quota")
+			return
+		}
+	}
+
+	if err := s.CreateNamespace(name, quota); err != nil {
+		s.sendError(encoder, err.Error())
+		return
+	}
+
+	response := map[string]interface{}{"status": "ok"}
+	encoder.Encode(response)
+}
+
+func (s *Server) handleDeleteNamespace(request map[string]interface{}, encoder *json.Encoder, principal *Principal) {
+	if !principal.canManageNamespaces() {
+		s.sendError(encoder, errPermissionDenied.Error())
+		return
+	}
+	name, ok := request["namespace"].(string)
+	if !ok {
+		s.sendError(encoder, "namespace is required")
+		return
+	}
+
+	if err := s.DeleteNamespace(name); err != nil {
+		s.sendError(encoder, err.Error())
+		return
+	}
+
+	response := map[string]interface{}{"status": "ok"}
+	encoder.Encode(response)
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"QueraMQ/client"
+	"testing"
+)
+
+func TestOnlyAdminsManageNamespaces(t *testing.T) {
+	s := NewServer(freeAddr(t))
+	s.Namespaces = map[string]Quota{"team": {}}
+	s.Credentials = map[string]Principal{
+		"admin-token":  {Name: "ops", Admin: true},
+		"tenant-token": {Name: "tenant"},
+	}
+	start(t, s)
+
+	anonymous := dial(t, s.Addr)
+	if err := anonymous.Hello("team"); err != nil {
+		t.Fatal(err)
+	}
+	tenant := dial(t, s.Addr)
+	if err := tenant.HelloWithToken("team", "tenant-token"); err != nil {
+		t.Fatal(err)
+	}
+	for name, c := range map[string]*client.Client{"anonymous": anonymous, "tenant": tenant} {
+		if err := c.CreateNamespace("other", client.Quota{}); err == nil {
+			t.Errorf("%s created a namespace", name)
+		}
+		if err := c.DeleteNamespace("team"); err == nil {
+			t.Errorf("%s deleted a namespace", name)
+		}
+	}
+	if _, ok := s.namespace("team"); !ok {
+		t.Fatal("namespace team is gone")
+	}
+
+	if err := dial(t, s.Addr).HelloWithToken("", "wrong-token"); err == nil {
+		t.Error("hello with an unknown token succeeded")
+	}
+
+	admin := dial(t, s.Addr)
+	if err := admin.HelloWithToken("", "admin-token"); err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.CreateNamespace("other", client.Quota{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.DeleteNamespace("team"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.namespace("team"); ok {
+		t.Fatal("admin could not delete namespace team")
+	}
+}
@@ -0,0 +1,248 @@
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// prunePeriod is how often idle client, identity and topic buckets are
+// forgotten.
+const prunePeriod = time.Minute
+
+// Rate limit scopes, as reported in rate_limited errors and metrics.
+const (
+	scopeConnection = "connection"
+	scopeIdentity   = "identity"
+	scopeTopic      = "topic"
+)
+
+// RateLimit allows Rate publishes per second on average and bursts of up to
+// Burst. A zero Rate means no limit; a zero Burst allows one second's worth.
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+func (l RateLimit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.Rate))
+}
+
+// RateLimits throttles publishing so that one producer cannot starve the
+// others. A publish must fit every limit that applies to it.
+type RateLimits struct {
+	// Connection limits each connection on its own, and the HTTP requests
+	// of each client together.
+	Connection RateLimit `json:"connection"`
+	// Identity limits all connections of a client together: those that
+	// authenticated as the same principal at hello, and otherwise those
+	// from the same host.
+	Identity RateLimit `json:"identity"`
+	// Topic limits publishes to each topic, whoever makes them.
+	Topic RateLimit `json:"topic"`
+}
+
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit RateLimit, now time.Time) *tokenBucket {
+	return &tokenBucket{limit: limit, tokens: limit.burst(), last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.limit.burst(), b.tokens+elapsed*b.limit.Rate)
+	}
+	b.last = now
+}
+
+// take removes a token, or reports how long it takes until one is there.
+func (b *tokenBucket) take(now time.Time) (time.Duration, bool) {
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	wait := (1 - b.tokens) / b.limit.Rate
+	return time.Duration(math.Ceil(wait * float64(time.Second))), false
+}
+
+func (b *tokenBucket) refund() {
+	b.tokens = math.Min(b.limit.burst(), b.tokens+1)
+}
+
+// rateLimiter holds the token buckets of RateLimits. Identity and topic
+// buckets are created on first use and shared by every connection, and so
+// are the connection buckets of HTTP clients, which have no connection of
+// their own.
+type rateLimiter struct {
+	limits     RateLimits
+	mu         sync.Mutex
+	httpConns  map[string]*tokenBucket
+	identities map[string]*tokenBucket
+	topics     map[*Topic]*tokenBucket
+	rejected   map[string]int
+	pruned     time.Time
+}
+
+func newRateLimiter(limits RateLimits) *rateLimiter {
+	return &rateLimiter{
+		limits:     limits,
+		httpConns:  make(map[string]*tokenBucket),
+		identities: make(map[string]*tokenBucket),
+		topics:     make(map[*Topic]*tokenBucket),
+		rejected:   make(map[string]int),
+		pruned:     time.Now(),
+	}
+}
+
+// connLimit is the rate limiting state of one connection.
+type connLimit struct {
+	bucket   *tokenBucket
+	identity string
+}
+
+func (l *rateLimiter) newConnLimit(identity string) *connLimit {
+	limit := &connLimit{identity: identity}
+	if l.limits.Connection.Rate > 0 {
+		limit.bucket = newTokenBucket(l.limits.Connection, time.Now())
+	}
+	return limit
+}
+
+// httpLimit returns the rate limiting state of the HTTP requests made by
+// the client with identity, whose connection bucket they share.
+func (l *rateLimiter) httpLimit(identity string) *connLimit {
+	limit := &connLimit{identity: identity}
+	if l.limits.Connection.Rate > 0 {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		bucket, ok := l.httpConns[identity]
+		if !ok {
+			bucket = newTokenBucket(l.limits.Connection, time.Now())
+			l.httpConns[identity] = bucket
+		}
+		limit.bucket = bucket
+	}
+	return limit
+}
+
+// clientIdentity is the identity rate limits count a client by: the
+// principal it authenticated as, or else the host it connects from.
+func clientIdentity(principal *Principal, remoteAddr string) string {
+	if principal != nil {
+		return "principal:" + principal.Name
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return "host:" + host
+}
+
+// allow takes a token from every bucket that applies to a publish to topic,
+// or from none of them. When it refuses, it returns the scope that did and
+// how long until a retry can succeed. conn may be nil for requests that do
+// not come over a connection.
+func (l *rateLimiter) allow(conn *connLimit, topic *Topic) (string, time.Duration, bool) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.pruned) > prunePeriod {
+		l.prune(now)
+	}
+
+	type scoped struct {
+		scope  string
+		bucket *tokenBucket
+	}
+	var buckets []scoped
+	if conn != nil && conn.bucket != nil {
+		buckets = append(buckets, scoped{scopeConnection, conn.bucket})
+	}
+	if conn != nil && conn.identity != "" && l.limits.Identity.Rate > 0 {
+		bucket, ok := l.identities[conn.identity]
+		if !ok {
+			bucket = newTokenBucket(l.limits.Identity, now)
+			l.identities[conn.identity] = bucket
+		}
+		buckets = append(buckets, scoped{scopeIdentity, bucket})
+	}
+	if l.limits.Topic.Rate > 0 {
+		bucket, ok := l.topics[topic]
+		if !ok {
+			bucket = newTokenBucket(l.limits.Topic, now)
+			l.topics[topic] = bucket
+		}
+		buckets = append(buckets, scoped{scopeTopic, bucket})
+	}
+
+	for i, b := range buckets {
+		if wait, ok := b.bucket.take(now); !ok {
+			for _, taken := range buckets[:i] {
+				taken.bucket.refund()
+			}
+			l.rejected[b.scope]++
+			return b.scope, wait, false
+		}
+	}
+	return "", 0, true
+}
+
+// prune forgets buckets that have refilled completely, since a new bucket
+// would be in the same state. The caller holds mu.
+func (l *rateLimiter) prune(now time.Time) {
+	for identity, bucket := range l.httpConns {
+		if bucket.refill(now); bucket.tokens >= bucket.limit.burst() {
+			delete(l.httpConns, identity)
+		}
+	}
+	for identity, bucket := range l.identities {
+		if bucket.refill(now); bucket.tokens >= bucket.limit.burst() {
+			delete(l.identities, identity)
+		}
+	}
+	for topic, bucket := range l.topics {
+		if bucket.refill(now); bucket.tokens >= bucket.limit.burst() {
+			delete(l.topics, topic)
+		}
+	}
+	l.pruned = now
+}
+
+// rejectedCounts returns how many publishes each scope refused.
+func (l *rateLimiter) rejectedCounts() map[string]int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rejected := make(map[string]int, len(l.rejected))
+	for scope, n := range l.rejected {
+		rejected[scope] = n
+	}
+	return rejected
+}
+
+func (s *Server) sendRateLimited(encoder *json.Encoder, scope string, retryAfter time.Duration) {
+	errorResponse := map[string]interface{}{
+		"error":          "rate_limited",
+		"scope":          scope,
+		"retry_after_ms": retryAfterMillis(retryAfter),
+	}
+	encoder.Encode(errorResponse)
+}
+
+// retryAfterMillis rounds d up to whole milliseconds, so that retrying after
+// the hint never comes too early.
+func retryAfterMillis(d time.Duration) int64 {
+	return int64((d + time.Millisecond - 1) / time.Millisecond)
+}
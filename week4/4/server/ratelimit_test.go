@@ -0,0 +1,89 @@
+package server
+
+import (
+	"QueraMQ/client"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func publishLimited(t *testing.T, c *client.Client) string {
+	t.Helper()
+	err := c.Publish("limited", "message", 1, nil)
+	var limited *client.RateLimitedError
+	if errors.As(err, &limited) {
+		return limited.Scope
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ""
+}
+
+// Connections count against the identity of their host unless they
+// authenticate; nothing a client claims about itself gets it a fresh bucket.
+func TestIdentityLimitsCountAuthenticatedPrincipals(t *testing.T) {
+	s := NewServer(freeAddr(t))
+	s.RateLimits = RateLimits{Identity: RateLimit{Rate: 0.01, Burst: 2}}
+	s.Credentials = map[string]Principal{"service-token": {Name: "service"}}
+	start(t, s)
+
+	for i := 0; i < 2; i++ {
+		if scope := publishLimited(t, dial(t, s.Addr)); scope != "" {
+			t.Fatalf("publish %d refused per %s", i, scope)
+		}
+	}
+	claimed := dial(t, s.Addr)
+	if err := claimed.Hello(""); err != nil {
+		t.Fatal(err)
+	}
+	if scope := publishLimited(t, claimed); scope != scopeIdentity {
+		t.Fatalf("third connection from the host refused per %q, want %s", scope, scopeIdentity)
+	}
+
+	for i := 0; i < 2; i++ {
+		service := dial(t, s.Addr)
+		if err := service.HelloWithToken("", "service-token"); err != nil {
+			t.Fatal(err)
+		}
+		if scope := publishLimited(t, service); scope != "" {
+			t.Fatalf("publish %d as the service refused per %s", i, scope)
+		}
+	}
+	service := dial(t, s.Addr)
+	if err := service.HelloWithToken("", "service-token"); err != nil {
+		t.Fatal(err)
+	}
+	if scope := publishLimited(t, service); scope != scopeIdentity {
+		t.Fatalf("third connection of the service refused per %q, want %s", scope, scopeIdentity)
+	}
+}
+
+// HTTP publishes have no connection, so each client gets a connection
+// bucket of its own that all its requests share.
+func TestHTTPPublishesShareClientBucket(t *testing.T) {
+	s := NewServer(freeAddr(t))
+	s.HTTPAddr = freeAddr(t)
+	s.RateLimits = RateLimits{Connection: RateLimit{Rate: 0.01, Burst: 2}}
+	start(t, s)
+	waitListening(t, s.HTTPAddr)
+
+	url := fmt.Sprintf("http://%s/topics/limited/messages", s.HTTPAddr)
+	for i, want := range []int{http.StatusCreated, http.StatusCreated, http.StatusTooManyRequests} {
+		req, err := http.NewRequest("POST", url, strings.NewReader(`{"content": "message", "priority": 1}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-QueraMQ-Identity", fmt.Sprint("client-", i))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("publish %d: status %d, want %d", i, resp.StatusCode, want)
+		}
+	}
+}
@@ -1,37 +1,134 @@
 package server
 
 import (
+	"QueraMQ/filter"
+	"QueraMQ/queue"
+	"QueraMQ/storage"
+	"QueraMQ/tracing"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/http"
 	"sync"
+	"time"
+
+	"github.com/google/uuid"
 )
 
 type Server struct {
-	Addr   string
-	topics map[string]*Topic
-	ln     net.Listener
-	mu     sync.Mutex
+	Addr string
+	// HTTPAddr enables the HTTP gateway (WebSocket at /ws) when set.
+	HTTPAddr string
+	// MQTTAddr enables the MQTT 3.1.1 listener when set.
+	MQTTAddr string
+	// MQTTRetryInterval is how long a QoS 1 message sent to an MQTT client
+	// may go unacknowledged before it is sent again with DUP set.
+	MQTTRetryInterval time.Duration
+	// HeartbeatInterval is how often clients that asked for heartbeats are
+	// pinged. Such a client that sends nothing for MissedHeartbeats
+	// intervals is disconnected and its subscriptions are dropped. Zero
+	// disables heartbeats.
+	HeartbeatInterval time.Duration
+	MissedHeartbeats  int
+	WriteTimeout      time.Duration
+	// DefaultStorage is the storage backend of every topic that has no
+	// entry in TopicStorage.
+	DefaultStorage storage.Config
+	TopicStorage   map[string]storage.Config
+	// Namespaces are created when the server starts, with their quotas. The
+	// default namespace always exists; an entry for it sets its quota.
+	Namespaces map[string]Quota
+	// RateLimits throttles publishing per connection, identity and topic.
+	RateLimits RateLimits
+	// Credentials maps the tokens clients may present at hello to the
+	// principals they authenticate as. Only admin principals may create and
+	// delete namespaces over the protocol.
+	Credentials map[string]Principal
+	// Tracer records spans for the messages passing through the broker;
+	// nil turns tracing off.
+	Tracer *tracing.Tracer
+	// NodeName identifies this broker to its bridges and is required when
+	// Bridges is not empty.
+	NodeName   string
+	Bridges    []Bridge
+	namespaces map[string]*Namespace
+	limiter    *rateLimiter
+	ln         net.Listener
+	httpServer *http.Server
+	mqttLn     net.Listener
+	// mqttSessions are told about new topics so that their wildcard
+	// subscriptions can pick them up.
+	mqttSessions map[*mqttSession]struct{}
+	stopBridges  context.CancelFunc
+	mu           sync.Mutex
 }
 
 func NewServer(address string) *Server {
 	return &Server{
-		Addr:   address,
-		topics: make(map[string]*Topic),
+		Addr:              address,
+		HeartbeatInterval: defaultHeartbeatInterval,
+		MissedHeartbeats:  defaultMissedHeartbeats,
+		WriteTimeout:      defaultWriteTimeout,
+		MQTTRetryInterval: defaultMQTTRetryInterval,
+		TopicStorage:      make(map[string]storage.Config),
+		namespaces:        map[string]*Namespace{DefaultNamespace: newNamespace(DefaultNamespace, Quota{})},
+		mqttSessions:      make(map[*mqttSession]struct{}),
+		limiter:           newRateLimiter(RateLimits{}),
 	}
 }
 
 func (s *Server) Run() error {
+	s.limiter = newRateLimiter(s.RateLimits)
+
 	ln, err := net.Listen("tcp", s.Addr)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer ln.Close()
+	s.mu.Lock()
 	s.ln = ln
+	s.mu.Unlock()
 	log.Printf("Server started at %s", s.Addr)
 
+	for name, quota := range s.Namespaces {
+		if name == DefaultNamespace {
+			s.mu.Lock()
+			s.namespaces[name].Quota = quota
+			s.mu.Unlock()
+		} else if err := s.CreateNamespace(name, quota); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.mu.Lock()
+	s.stopBridges = cancel
+	s.mu.Unlock()
+	if err := s.startBridges(ctx); err != nil {
+		return err
+	}
+
+	if s.HTTPAddr != "" {
+		s.httpServer = s.newHTTPServer()
+		go s.runHTTP(s.httpServer)
+	}
+
+	if s.MQTTAddr != "" {
+		mqttLn, err := net.Listen("tcp", s.MQTTAddr)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.mqttLn = mqttLn
+		s.mu.Unlock()
+		go s.runMQTT(mqttLn)
+	}
+
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
@@ -44,42 +141,70 @@ func (s *Server) Run() error {
 }
 
 func (s *Server) Stop() {
+	connections := s.GetClientConnections()
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	for _, topic := range s.topics {
+	if s.stopBridges != nil {
+		s.stopBridges()
+	}
+	for _, topic := range s.allTopics() {
 		topic.Close()
 	}
-	connections := s.GetClientConnections()
 	for _, connection := range connections {
 		connection.Close()
 	}
+	if s.httpServer != nil {
+		s.httpServer.Close()
+	}
+	if s.mqttLn != nil {
+		s.mqttLn.Close()
+	}
 	s.ln.Close()
 }
 
-func (s *Server) GetTopic(topicName string) (*Topic, bool) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	topic, exists := s.topics[topicName]
-	if exists {
-		return topic, true
-	} else {
-		newTopic := NewTopic(topicName)
-		s.topics[topicName] = newTopic
-		return newTopic, false
-	}
+// GetTopic returns the topic called topicName in the default namespace,
+// creating it if it does not exist yet.
+func (s *Server) GetTopic(topicName string) (*Topic, error) {
+	return s.namespaceTopic(s.defaultNamespace(), topicName)
 }
 
 func (s *Server) handleConnection(conn net.Conn) {
+	conn = newSession(conn, s.WriteTimeout)
 	defer conn.Close()
+	defer s.dropClient(conn)
+
+	done := make(chan struct{})
+	defer close(done)
+	heartbeats := false
 
 	decoder := json.NewDecoder(conn)
 	encoder := json.NewEncoder(conn)
 
+	var tx *transaction
+	var principal *Principal
+	limit := s.limiter.newConnLimit(clientIdentity(nil, conn.RemoteAddr().String()))
+	// ns stays nil until the connection selects a namespace with hello or
+	// makes its first other request, which binds it to the default one.
+	var ns *Namespace
+	defer func() {
+		if ns != nil {
+			s.leaveNamespace(ns, conn)
+		}
+	}()
+
 	for {
+		if heartbeats {
+			s.extendReadDeadline(conn)
+		}
+
 		var request map[string]interface{}
 		if err := decoder.Decode(&request); err != nil {
-			if errors.Is(err, net.ErrClosed) {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				log.Printf("Client %s missed heartbeats, closing connection", conn.RemoteAddr())
+				return
+			} else if errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe) {
 				return
 			} else if err.Error() == "EOF" {
 				log.Println("Connection closed by client")
@@ -96,13 +221,49 @@ func (s *Server) handleConnection(conn net.Conn) {
 			continue
 		}
 
+		if action == "hello" {
+			s.handleHello(request, encoder, conn, &ns, &principal, limit)
+			continue
+		}
+		if ns == nil && action != "heartbeat" && action != "ping" && action != "pong" {
+			joined, err := s.joinNamespace(DefaultNamespace, conn)
+			if err != nil {
+				s.sendError(encoder, err.Error())
+				return
+			}
+			ns = joined
+		}
+
 		switch action {
 		case "publish":
-			s.handlePublish(request, encoder)
+			s.handlePublish(request, encoder, ns, tx, limit)
 		case "subscribe":
-			s.handleSubscribe(request, encoder, conn)
+			s.handleSubscribe(request, encoder, ns, conn)
 		case "unsubscribe":
 			s.handleUnsubscribe(request, encoder, conn)
+		case "ack":
+			s.handleAck(request, encoder, ns, tx, conn)
+		case "topics":
+			s.handleTopics(encoder, ns)
+		case "stats":
+			s.handleStats(request, encoder, ns)
+		case "purge":
+			s.handlePurge(request, encoder, ns)
+		case "create_namespace":
+			s.handleCreateNamespace(request, encoder, principal)
+		case "delete_namespace":
+			s.handleDeleteNamespace(request, encoder, principal)
+		case "begin":
+			s.handleBegin(&tx, encoder)
+		case "commit":
+			s.handleCommit(&tx, encoder)
+		case "rollback":
+			s.handleRollback(&tx, encoder)
+		case "heartbeat":
+			s.handleHeartbeat(encoder, conn, done, &heartbeats)
+		case "ping":
+			encoder.Encode(map[string]interface{}{"action": "pong"})
+		case "pong":
 		case "shutdown":
 			s.Stop()
 		case "close_connection":
@@ -113,7 +274,7 @@ func (s *Server) handleConnection(conn net.Conn) {
 	}
 }
 
-func (s *Server) handlePublish(request map[string]interface{}, encoder *json.Encoder) {
+func (s *Server) handlePublish(request map[string]interface{}, encoder *json.Encoder, ns *Namespace, tx *transaction, limit *connLimit) {
 
 	messageData, ok := request["message"].(map[string]interface{})
 	if !ok {
@@ -137,23 +298,56 @@ func (s *Server) handlePublish(request map[string]interface{}, encoder *json.Enc
 		s.sendError(encoder, "priority is required")
 		return
 	}
+	headers, err := parseHeaders(messageData["headers"])
+	if err != nil {
+		s.sendError(encoder, err.Error())
+		return
+	}
 
-	topic, exists := s.GetTopic(topicName)
-	if !exists {
-		topic = NewTopic(topicName)
-		s.mu.Lock()
-		s.topics[topicName] = topic
-		s.mu.Unlock()
+	topic, err := s.namespaceTopic(ns, topicName)
+	if err != nil {
+		s.sendError(encoder, err.Error())
+		return
+	}
+	if scope, retryAfter, ok := s.limiter.allow(limit, topic); !ok {
+		s.sendRateLimited(encoder, scope, retryAfter)
+		return
+	}
+	if err := s.checkMessageQuota(ns); err != nil {
+		s.sendError(encoder, err.Error())
+		return
+	}
 
+	if tx != nil {
+		if tx.full() {
+			s.sendError(encoder, "transaction is too large")
+			return
+		}
+		tx.publishes = append(tx.publishes, stagedPublish{
+			topic: topic,
+			message: &queue.Message{
+				ID:       uuid.New(),
+				Content:  content,
+				Priority: int(priority),
+				Headers:  headers,
+			},
+		})
+		response := map[string]interface{}{"status": "staged"}
+		encoder.Encode(response)
+		return
 	}
 
-	topic.MQ.PushMessage(content, int(priority))
+	if err := topic.Publish(content, int(priority), headers); err != nil {
+		log.Printf("Failed to publish to topic %s: %v", topicName, err)
+		s.sendError(encoder, "failed to store message")
+		return
+	}
 
 	response := map[string]interface{}{"status": "ok"}
 	encoder.Encode(response)
 }
 
-func (s *Server) handleSubscribe(request map[string]interface{}, encoder *json.Encoder, conn net.Conn) {
+func (s *Server) handleSubscribe(request map[string]interface{}, encoder *json.Encoder, ns *Namespace, conn net.Conn) {
 
 	topicName, ok := request["topic"].(string)
 	if !ok {
@@ -161,15 +355,25 @@ func (s *Server) handleSubscribe(request map[string]interface{}, encoder *json.E
 		return
 	}
 
-	s.mu.Lock()
-	_, exists := s.topics[topicName]
-	if !exists {
-		topic := NewTopic(topicName)
-		s.topics[topicName] = topic
+	var messageFilter *filter.Filter
+	if expr, ok := request["filter"].(string); ok && expr != "" {
+		parsed, err := filter.Parse(expr)
+		if err != nil {
+			s.sendError(encoder, "invalid filter: "+err.Error())
+			return
+		}
+		messageFilter = parsed
 	}
-	s.mu.Unlock()
 
-	s.topics[topicName].AddClient(conn)
+	topic, err := s.namespaceTopic(ns, topicName)
+	if err != nil {
+		s.sendError(encoder, err.Error())
+		return
+	}
+	// Acks are opt-in, so that subscribers written before them keep
+	// having messages settled on delivery.
+	acks, _ := request["ack"].(bool)
+	topic.AddClient(conn, messageFilter, acks)
 
 	response := map[string]interface{}{"status": "ok"}
 	encoder.Encode(response)
@@ -179,16 +383,83 @@ func (s *Server) handleUnsubscribe(request map[string]interface{}, encoder *json
 	topicName, ok := request["topic"].(string)
 	if !ok {
 		s.sendError(encoder, "topic is required")
+		return
 	}
 
 	s.mu.Lock()
 	s.RemoveClient(encoder, topicName, conn)
 	s.mu.Unlock()
+}
+
+// handleAck settles a message pushed to conn. Messages pushed to other
+// subscribers are reported as not in flight, the same as unknown ones.
+func (s *Server) handleAck(request map[string]interface{}, encoder *json.Encoder, ns *Namespace, tx *transaction, conn net.Conn) {
+	topicName, ok := request["topic"].(string)
+	if !ok {
+		s.sendError(encoder, "topic is required")
+		return
+	}
+	rawID, ok := request["id"].(string)
+	if !ok {
+		s.sendError(encoder, "id is required")
+		return
+	}
+	id, err := uuid.Parse(rawID)
+	if err != nil {
+		s.sendError(encoder, "invalid message id")
+		return
+	}
+
+	topic, err := s.namespaceTopic(ns, topicName)
+	if err != nil {
+		s.sendError(encoder, err.Error())
+		return
+	}
+
+	if tx != nil {
+		if tx.full() {
+			s.sendError(encoder, "transaction is too large")
+			return
+		}
+		if !topic.InFlight(id, conn) {
+			s.sendError(encoder, "message is not in flight")
+			return
+		}
+		tx.acks = append(tx.acks, stagedAck{topic: topic, id: id, owner: conn})
+		response := map[string]interface{}{"status": "staged"}
+		encoder.Encode(response)
+		return
+	}
+
+	if topic.Ack([]uuid.UUID{id}, conn) == 0 {
+		s.sendError(encoder, "message is not in flight")
+		return
+	}
 
 	response := map[string]interface{}{"status": "ok"}
 	encoder.Encode(response)
 }
 
+func parseHeaders(value interface{}) (map[string]string, error) {
+	if value == nil {
+		return nil, nil
+	}
+	raw, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("headers must be an object")
+	}
+
+	headers := make(map[string]string, len(raw))
+	for name, v := range raw {
+		text, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("header %s must be a string", name)
+		}
+		headers[name] = text
+	}
+	return headers, nil
+}
+
 func (s *Server) sendError(encoder *json.Encoder, message string) {
 	errorResponse := map[string]interface{}{"error": message}
 	encoder.Encode(errorResponse)
@@ -199,8 +470,8 @@ func (s *Server) GetClientConnections() []net.Conn {
 	defer s.mu.Unlock()
 
 	connections := make([]net.Conn, 0)
-	for _, topic := range s.topics {
-		connections = append(connections, topic.clients...)
+	for _, topic := range s.allTopics() {
+		connections = append(connections, topic.Clients()...)
 	}
 	return connections
 }
@@ -209,13 +480,8 @@ func (s *Server) ConnectionClose(encoder *json.Encoder, conn net.Conn) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	for _, t := range s.topics {
-		for i := 0; i < len(t.clients); i++ {
-			if conn == t.clients[i] {
-				t.clients = append(t.clients[:i], t.clients[i+1:]...)
-				break
-			}
-		}
+	for _, t := range s.allTopics() {
+		t.RemoveClient(conn)
 	}
 	conn.Close()
 
@@ -224,14 +490,9 @@ func (s *Server) ConnectionClose(encoder *json.Encoder, conn net.Conn) {
 }
 
 func (s *Server) RemoveClient(encoder *json.Encoder, topicName string, conn net.Conn) {
-	for _, t := range s.topics {
+	for _, t := range s.allTopics() {
 		if topicName == t.Name {
-			for i := 0; i < len(t.clients); i++ {
-				if t.clients[i] == conn {
-					t.clients = append(t.clients[:i], t.clients[i+1:]...)
-					break
-				}
-			}
+			t.RemoveClient(conn)
 		}
 	}
 
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"QueraMQ/client"
+	"net"
+	"testing"
+	"time"
+)
+
+// freeAddr returns a local address nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// start runs s until the test ends, once its listener accepts connections.
+func start(t *testing.T, s *Server) {
+	t.Helper()
+	go s.Run()
+	waitListening(t, s.Addr)
+	t.Cleanup(s.Stop)
+}
+
+func waitListening(t *testing.T, addr string) {
+	t.Helper()
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		if i == 200 {
+			t.Fatalf("nothing listening on %s: %v", addr, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func dial(t *testing.T, addr string) *client.Client {
+	t.Helper()
+	c, err := client.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// receive acks and returns deliveries until want have arrived or timeout
+// passes.
+func receive(t *testing.T, c *client.Client, want int, timeout time.Duration) []client.Delivery {
+	t.Helper()
+	var got []client.Delivery
+	deadline := time.After(timeout)
+	for len(got) < want {
+		select {
+		case delivery, ok := <-c.Deliveries():
+			if !ok {
+				t.Fatalf("connection ended after %d of %d messages: %v", len(got), want, c.Err())
+			}
+			if err := c.Ack(delivery.Topic, delivery.ID); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, delivery)
+		case <-deadline:
+			t.Fatalf("received %d of %d messages", len(got), want)
+		}
+	}
+	return got
+}
@@ -1,29 +1,575 @@
 package server
 
 import (
+	"QueraMQ/filter"
 	"QueraMQ/queue"
+	"QueraMQ/storage"
+	"QueraMQ/tracing"
+	"context"
+	"encoding/json"
+	"log"
 	"net"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// ackTimeout is how long a pulled message, or one pushed to a
+	// subscriber that acks, may stay unacknowledged before it is put back
+	// on the queue.
+	ackTimeout = 30 * time.Second
+	// subscriberPrefetch caps the unacknowledged messages pushed to a single
+	// subscriber that acks, so that the rest stay queued in priority order.
+	subscriberPrefetch = 16
 )
 
 type Topic struct {
-	Name    string
-	MQ      queue.IMessageQueue
-	clients []net.Conn
-	close   chan bool
+	Name     string
+	Store    storage.Store
+	clients  []net.Conn
+	subs     map[net.Conn]subscription
+	close    chan bool
+	mu       sync.Mutex
+	inFlight map[uuid.UUID]*inFlightMessage
+	ready    chan struct{}
+	next     int
+	// unmatched and blocked hold the leased messages dispatch skipped past
+	// so that they do not hold up the messages behind them: no
+	// subscriber's filter matches an unmatched message, and only
+	// subscribers without room for another message match a blocked one.
+	// They still count as queued, pulls take them, and they go back to the
+	// store when a subscriber that may take them subscribes or frees up.
+	unmatched []*queue.Message
+	blocked   []*queue.Message
+	taps      map[tap]struct{}
+	tracer    *tracing.Tracer
+}
+
+// tap is handed every message published to the topics it is added to, on
+// top of the subscribers sharing the queue, which still receive the message
+// as usual. It is called with the topic locked and must not block.
+type tap interface {
+	published(topic *Topic, message *queue.Message)
+}
+
+// subscription is how a subscriber asked to receive a topic's messages.
+type subscription struct {
+	filter *filter.Filter
+	// acks keeps each pushed message in flight until the subscriber acks
+	// it. Otherwise the message is settled as soon as it is written, the
+	// way subscribers that predate acks expect.
+	acks bool
+}
+
+// inFlightMessage is a message handed to a consumer and awaiting its ack.
+// It stays leased in the store until then. owner is the subscriber it was
+// pushed to, or nil for pulled messages.
+type inFlightMessage struct {
+	message  *queue.Message
+	owner    net.Conn
+	deadline time.Time
+	span     *tracing.Span
+}
+
+// NewTopic creates a topic on store. tracer records the spans of its
+// messages and may be nil.
+func NewTopic(name string, store storage.Store, tracer *tracing.Tracer) *Topic {
+	t := &Topic{
+		Name:     name,
+		Store:    store,
+		clients:  make([]net.Conn, 0),
+		subs:     make(map[net.Conn]subscription),
+		close:    make(chan bool),
+		inFlight: make(map[uuid.UUID]*inFlightMessage),
+		ready:    make(chan struct{}),
+		taps:     make(map[tap]struct{}),
+		tracer:   tracer,
+	}
+	go t.dispatch()
+	return t
+}
+
+// AddClient subscribes conn to messages matching f, or to every message
+// when f is nil. With acks, conn must ack each message it is pushed before
+// ackTimeout or have it redelivered. Subscribing again replaces the filter
+// and ack mode.
+func (t *Topic) AddClient(conn net.Conn, f *filter.Filter, acks bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, subscribed := t.subs[conn]; !subscribed {
+		t.clients = append(t.clients, conn)
+	}
+	t.subs[conn] = subscription{filter: f, acks: acks}
+	t.unpark()
+	t.notify()
+}
+
+// RemoveClient unsubscribes conn and requeues everything still in flight to it.
+func (t *Topic) RemoveClient(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i := 0; i < len(t.clients); i++ {
+		if t.clients[i] == conn {
+			t.clients = append(t.clients[:i], t.clients[i+1:]...)
+			break
+		}
+	}
+	delete(t.subs, conn)
+
+	for id, pending := range t.inFlight {
+		if pending.owner == conn {
+			t.settle(id, "requeued")
+			t.requeue(pending.message)
+		}
+	}
+	// Blocked messages only conn matched may now match nobody.
+	t.unblock(nil)
+	t.notify()
+}
+
+func (t *Topic) addTap(tp tap) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.taps[tp] = struct{}{}
+}
+
+func (t *Topic) removeTap(tp tap) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.taps, tp)
+}
+
+func (t *Topic) Clients() []net.Conn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]net.Conn(nil), t.clients...)
+}
+
+// TopicStats is a point-in-time view of a topic for monitoring.
+type TopicStats struct {
+	Depth       int
+	InFlight    int
+	Subscribers int
+	// Filtered counts the queued messages that no subscriber's filter
+	// matches. They wait for a pull or a subscriber that matches them.
+	Filtered int
+	// OldestAge is how long the oldest queued message has been waiting. A
+	// value that keeps growing means messages are being starved.
+	OldestAge time.Duration
 }
 
-func NewTopic(name string) *Topic {
-	return &Topic{
-		Name:    name,
-		MQ:      queue.NewMessageQueue(),
-		clients: make([]net.Conn, 0),
+func (t *Topic) Stats() TopicStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := TopicStats{
+		Depth:       t.depth(),
+		InFlight:    len(t.inFlight),
+		Subscribers: len(t.clients),
+		Filtered:    len(t.unmatched),
 	}
+	if oldest := t.oldest(); !oldest.IsZero() {
+		stats.OldestAge = time.Since(oldest)
+	}
+	return stats
+}
+
+// Depth returns the number of queued messages.
+func (t *Topic) Depth() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.depth()
+}
+
+// depth counts the messages in the store and the parked ones. The caller
+// holds mu.
+func (t *Topic) depth() int {
+	return t.Store.Len() + len(t.unmatched) + len(t.blocked)
 }
 
-func (t *Topic) AddClient(conn net.Conn) {
-	t.clients = append(t.clients, conn)
+// oldest returns the enqueue time of the queued or parked message that has
+// waited longest. The caller holds mu.
+func (t *Topic) oldest() time.Time {
+	oldest := t.Store.Oldest()
+	for _, parked := range [][]*queue.Message{t.unmatched, t.blocked} {
+		for _, message := range parked {
+			if oldest.IsZero() || message.EnqueuedAt.Before(oldest) {
+				oldest = message.EnqueuedAt
+			}
+		}
+	}
+	return oldest
 }
 
 func (t *Topic) Close() {
 	t.close <- true
+	if err := t.Store.Close(); err != nil {
+		log.Printf("Failed to close storage of topic %s: %v", t.Name, err)
+	}
+}
+
+func (t *Topic) Publish(content string, priority int, headers map[string]string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	message := &queue.Message{
+		ID:         uuid.New(),
+		Content:    content,
+		Priority:   priority,
+		EnqueuedAt: time.Now(),
+		Headers:    headers,
+	}
+	span := t.traceEnqueue(message, message.EnqueuedAt)
+	defer func() { span.End(time.Now()) }()
+
+	if err := t.Store.Push(message); err != nil {
+		span.SetAttribute("error", err.Error())
+		return err
+	}
+	t.fanOut(message)
+	t.notify()
+	return nil
+}
+
+// fanOut hands a newly published message to the topic's taps. Requeued
+// messages are not published again. The caller holds mu.
+func (t *Topic) fanOut(message *queue.Message) {
+	for tp := range t.taps {
+		tp.published(t, message)
+	}
+}
+
+// Pull removes up to max messages from the queue, blocking until at least
+// one is available or ctx is done. Messages no subscriber can take right
+// now are pulled in priority order with the rest. Pulled messages stay in
+// flight until they are acknowledged or ackTimeout passes.
+func (t *Topic) Pull(ctx context.Context, max int) []*queue.Message {
+	for {
+		t.mu.Lock()
+		now := time.Now()
+		t.requeueExpired(now)
+		t.unpark()
+
+		messages := make([]*queue.Message, 0, max)
+		for len(messages) < max {
+			message := t.pop()
+			if message == nil {
+				break
+			}
+			delivered, span := t.traceDelivery(message, "pull", now)
+			t.inFlight[message.ID] = &inFlightMessage{message: message, deadline: now.Add(ackTimeout), span: span}
+			messages = append(messages, delivered)
+		}
+		if len(messages) > 0 {
+			// Wake dispatch to park again what the pull left behind.
+			t.notify()
+			t.mu.Unlock()
+			return messages
+		}
+
+		ready := t.ready
+		expiry := t.nextDeadline()
+		t.mu.Unlock()
+
+		timeout, stop := expiryTimer(expiry)
+		select {
+		case <-ready:
+		case <-timeout:
+		case <-ctx.Done():
+		}
+		stop()
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// Ack settles the messages of ids in flight to owner, nil for pulled
+// messages, and reports how many it found. A message in flight to another
+// subscriber is left alone.
+func (t *Topic) Ack(ids []uuid.UUID, owner net.Conn) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	acked := 0
+	for _, id := range ids {
+		if pending, ok := t.inFlight[id]; !ok || pending.owner != owner {
+			continue
+		}
+		t.complete(id)
+		acked++
+	}
+	if acked > 0 {
+		t.notify()
+	}
+	return acked
+}
+
+// Purge drops every queued message and returns how many were dropped.
+// Messages already in flight are left to be acked or requeued as usual.
+func (t *Topic) Purge() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.unpark()
+	purged := 0
+	for message := t.pop(); message != nil; message = t.pop() {
+		t.remove(message)
+		purged++
+	}
+	return purged
+}
+
+// InFlight reports whether the message with id is in flight to owner, nil
+// for pulled messages.
+func (t *Topic) InFlight(id uuid.UUID, owner net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pending, ok := t.inFlight[id]
+	return ok && pending.owner == owner
+}
+
+// dispatch pushes queued messages to subscribers in round-robin order until
+// the topic is closed. Messages no subscriber can take are parked rather
+// than dropped or left at the head of the queue, so the messages behind
+// them keep flowing.
+func (t *Topic) dispatch() {
+	for {
+		t.mu.Lock()
+		now := time.Now()
+		t.requeueExpired(now)
+
+		if conn, message := t.nextDelivery(); conn != nil {
+			delivered, span := t.traceDelivery(message, conn.RemoteAddr().String(), now)
+			t.inFlight[message.ID] = &inFlightMessage{message: message, owner: conn, deadline: now.Add(ackTimeout), span: span}
+			acks := t.subs[conn].acks
+			t.mu.Unlock()
+
+			// The message stays in flight while it is written, so that a
+			// failed write requeues it.
+			if err := t.deliver(conn, delivered); err != nil {
+				log.Printf("Failed to deliver to %s: %v", conn.RemoteAddr(), err)
+				t.RemoveClient(conn)
+			} else if !acks {
+				t.Ack([]uuid.UUID{message.ID}, conn)
+			}
+			continue
+		}
+
+		ready := t.ready
+		expiry := t.nextDeadline()
+		t.mu.Unlock()
+
+		timeout, stop := expiryTimer(expiry)
+		select {
+		case <-ready:
+		case <-timeout:
+		case <-t.close:
+			stop()
+			return
+		}
+		stop()
+	}
+}
+
+// nextDelivery leases queued messages in priority order until it finds one
+// a subscriber can take, and returns it with that subscriber. The messages
+// it skips past are parked, and a pull waiting for messages is woken to
+// take them. The caller holds mu.
+func (t *Topic) nextDelivery() (net.Conn, *queue.Message) {
+	parked := false
+	defer func() {
+		if parked {
+			t.notify()
+		}
+	}()
+
+	for t.hasCapacity() {
+		message := t.pop()
+		if message == nil {
+			break
+		}
+		conn, matched := t.nextSubscriber(message)
+		if conn != nil {
+			return conn, message
+		}
+		if matched {
+			t.blocked = append(t.blocked, message)
+		} else {
+			t.unmatched = append(t.unmatched, message)
+		}
+		parked = true
+	}
+	return nil, nil
+}
+
+// unpark returns every parked message to the store. The caller holds mu.
+func (t *Topic) unpark() {
+	for _, message := range t.unmatched {
+		t.requeue(message)
+	}
+	t.unmatched = nil
+	t.unblock(nil)
+}
+
+// unblock returns to the store the blocked messages conn's filter matches,
+// now that conn has room for one of them, or every blocked message when
+// conn is nil. The caller holds mu.
+func (t *Topic) unblock(conn net.Conn) {
+	sub, subscribed := t.subs[conn]
+	if conn != nil && !subscribed {
+		return
+	}
+
+	blocked := t.blocked[:0]
+	for _, message := range t.blocked {
+		if conn == nil || sub.filter.Match(message) {
+			t.requeue(message)
+		} else {
+			blocked = append(blocked, message)
+		}
+	}
+	clear(t.blocked[len(blocked):])
+	t.blocked = blocked
+}
+
+func (t *Topic) deliver(conn net.Conn, message *queue.Message) error {
+	data, err := json.Marshal(map[string]interface{}{
+		"action":  "message",
+		"topic":   t.Name,
+		"message": messagePayload(message),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(append(data, '\n'))
+	return err
+}
+
+// nextSubscriber picks the next subscriber, in round-robin order, whose
+// filter matches message and that has room for another in-flight message.
+// matched reports whether any subscriber's filter matched at all.
+func (t *Topic) nextSubscriber(message *queue.Message) (conn net.Conn, matched bool) {
+	pending := t.pendingBySubscriber()
+	for i := 0; i < len(t.clients); i++ {
+		candidate := t.clients[(t.next+i)%len(t.clients)]
+		if !t.subs[candidate].filter.Match(message) {
+			continue
+		}
+		matched = true
+		if pending[candidate] < subscriberPrefetch {
+			t.next = (t.next + i + 1) % len(t.clients)
+			return candidate, true
+		}
+	}
+	return nil, matched
+}
+
+// hasCapacity reports whether any subscriber can take another message.
+func (t *Topic) hasCapacity() bool {
+	pending := t.pendingBySubscriber()
+	for _, conn := range t.clients {
+		if pending[conn] < subscriberPrefetch {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Topic) pendingBySubscriber() map[net.Conn]int {
+	pending := make(map[net.Conn]int)
+	for _, m := range t.inFlight {
+		if m.owner != nil {
+			pending[m.owner]++
+		}
+	}
+	return pending
+}
+
+// expiryTimer returns a channel that fires at expiry, or a nil channel
+// that never fires when expiry is zero.
+func expiryTimer(expiry time.Time) (<-chan time.Time, func()) {
+	if expiry.IsZero() {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(time.Until(expiry))
+	return timer.C, func() { timer.Stop() }
+}
+
+func (t *Topic) requeueExpired(now time.Time) {
+	for id, pending := range t.inFlight {
+		if now.After(pending.deadline) {
+			t.settle(id, "expired")
+			t.requeue(pending.message)
+		}
+	}
+}
+
+// pop leases the next message from the store, logging storage failures as
+// an empty queue.
+func (t *Topic) pop() *queue.Message {
+	message, err := t.Store.Pop()
+	if err != nil {
+		log.Printf("Failed to pop from topic %s: %v", t.Name, err)
+		return nil
+	}
+	return message
+}
+
+func (t *Topic) requeue(message *queue.Message) {
+	if err := t.Store.Requeue(message); err != nil {
+		log.Printf("Failed to requeue message %s on topic %s: %v", message.ID, t.Name, err)
+	}
+}
+
+// complete settles the in-flight message with id as acked and deletes it
+// from the store. The caller holds mu.
+func (t *Topic) complete(id uuid.UUID) {
+	if pending, ok := t.settle(id, "acked"); ok {
+		t.remove(pending.message)
+	}
+}
+
+// remove deletes a leased message from the store. If that fails, the
+// message stays stored and is delivered again once the store is reopened.
+func (t *Topic) remove(message *queue.Message) {
+	if _, err := t.Store.Remove(message); err != nil {
+		log.Printf("Failed to remove message %s from topic %s: %v", message.ID, t.Name, err)
+	}
+}
+
+func (t *Topic) nextDeadline() time.Time {
+	var next time.Time
+	for _, pending := range t.inFlight {
+		if next.IsZero() || pending.deadline.Before(next) {
+			next = pending.deadline
+		}
+	}
+	return next
+}
+
+func (t *Topic) notify() {
+	close(t.ready)
+	t.ready = make(chan struct{})
+}
+
+func messagePayload(message *queue.Message) map[string]interface{} {
+	payload := map[string]interface{}{
+		"id":       message.ID.String(),
+		"content":  message.Content,
+		"priority": message.Priority,
+	}
+	if len(message.Headers) > 0 {
+		payload["headers"] = message.Headers
+	}
+	return payload
 }
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"QueraMQ/client"
+	"QueraMQ/storage"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// collect returns the deliveries c receives within wait, without acking.
+func collect(c *client.Client, wait time.Duration) []client.Delivery {
+	var got []client.Delivery
+	timeout := time.After(wait)
+	for {
+		select {
+		case delivery := <-c.Deliveries():
+			got = append(got, delivery)
+		case <-timeout:
+			return got
+		}
+	}
+}
+
+func publishN(t *testing.T, c *client.Client, topic string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := c.Publish(topic, fmt.Sprint(i), 1, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// A subscriber that did not ask for acks has messages settled once they are
+// sent, so it is never throttled or sent a message twice.
+func TestSubscribeWithoutAcksSettlesOnDelivery(t *testing.T) {
+	const n = 3 * subscriberPrefetch
+	s := NewServer(freeAddr(t))
+	start(t, s)
+	publishN(t, dial(t, s.Addr), "events", n)
+
+	subscriber := dial(t, s.Addr)
+	if err := subscriber.Subscribe("events", ""); err != nil {
+		t.Fatal(err)
+	}
+	got := collect(subscriber, 500*time.Millisecond)
+	if len(got) != n {
+		t.Fatalf("received %d of %d messages without acking", len(got), n)
+	}
+	if err := subscriber.Ack(got[0].Topic, got[0].ID); err == nil {
+		t.Fatal("acked a message that was already settled")
+	}
+	topic, _ := s.GetTopic("events")
+	if stats := topic.Stats(); stats.InFlight != 0 || stats.Depth != 0 {
+		t.Fatalf("%d messages in flight and %d queued, want none", stats.InFlight, stats.Depth)
+	}
+}
+
+// A subscriber that asked for acks is sent at most subscriberPrefetch
+// messages it has not acked yet.
+func TestSubscribeWithAcksLimitsUnackedMessages(t *testing.T) {
+	s := NewServer(freeAddr(t))
+	start(t, s)
+	publishN(t, dial(t, s.Addr), "jobs", subscriberPrefetch+1)
+
+	subscriber := dial(t, s.Addr)
+	if err := subscriber.SubscribeWithAcks("jobs", ""); err != nil {
+		t.Fatal(err)
+	}
+	got := collect(subscriber, 300*time.Millisecond)
+	if len(got) != subscriberPrefetch {
+		t.Fatalf("received %d unacked messages, want %d", len(got), subscriberPrefetch)
+	}
+	if err := subscriber.Ack(got[0].Topic, got[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if rest := collect(subscriber, 300*time.Millisecond); len(rest) != 1 {
+		t.Fatalf("received %d messages after an ack, want 1", len(rest))
+	}
+}
+
+// A message no subscriber's filter matches stays queued, for a pull or a
+// subscriber that matches it later, without holding up the others.
+func TestUnmatchedMessagesStayQueued(t *testing.T) {
+	s := NewServer(freeAddr(t))
+	start(t, s)
+	subscriber := dial(t, s.Addr)
+	publisher := dial(t, s.Addr)
+
+	if err := subscriber.Subscribe("orders", "region = 'eu'"); err != nil {
+		t.Fatal(err)
+	}
+	for _, region := range []string{"us", "asia", "eu"} {
+		if err := publisher.Publish("orders", "for "+region, 1, map[string]string{"region": region}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := collect(subscriber, 300*time.Millisecond)
+	if len(got) != 1 || got[0].Content != "for eu" {
+		t.Fatalf("subscriber received %v, want only the matching message", got)
+	}
+	topic, _ := s.GetTopic("orders")
+	if stats := topic.Stats(); stats.Filtered != 2 || stats.Depth != 2 {
+		t.Fatalf("filtered %d and queued %d, want 2 of each", stats.Filtered, stats.Depth)
+	}
+
+	late := dial(t, s.Addr)
+	if err := late.Subscribe("orders", "region = 'us'"); err != nil {
+		t.Fatal(err)
+	}
+	if got := collect(late, 300*time.Millisecond); len(got) != 1 || got[0].Content != "for us" {
+		t.Fatalf("late subscriber received %v, want the message queued for it", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if pulled := topic.Pull(ctx, 10); len(pulled) != 1 || pulled[0].Content != "for asia" {
+		t.Fatalf("pulled %v, want the message no subscriber matches", pulled)
+	}
+}
+
+// A message waiting for a full subscriber does not stall the messages
+// behind it that other subscribers can take.
+func TestBlockedMessageDoesNotStallTopic(t *testing.T) {
+	s := NewServer(freeAddr(t))
+	start(t, s)
+	publisher := dial(t, s.Addr)
+	eu := map[string]string{"region": "eu"}
+	us := map[string]string{"region": "us"}
+
+	slow := dial(t, s.Addr)
+	if err := slow.SubscribeWithAcks("orders", "region = 'eu'"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < subscriberPrefetch; i++ {
+		if err := publisher.Publish("orders", fmt.Sprint(i), 1, eu); err != nil {
+			t.Fatal(err)
+		}
+	}
+	held := collect(slow, 300*time.Millisecond)
+	if len(held) != subscriberPrefetch {
+		t.Fatalf("slow subscriber received %d messages, want %d", len(held), subscriberPrefetch)
+	}
+
+	fast := dial(t, s.Addr)
+	if err := fast.Subscribe("orders", "region = 'us'"); err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Publish("orders", "blocked", 0, eu); err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Publish("orders", "behind", 1, us); err != nil {
+		t.Fatal(err)
+	}
+	if got := collect(fast, 300*time.Millisecond); len(got) != 1 || got[0].Content != "behind" {
+		t.Fatalf("fast subscriber received %v, want the message behind the blocked one", got)
+	}
+
+	if err := slow.Ack(held[0].Topic, held[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := collect(slow, 300*time.Millisecond); len(got) != 1 || got[0].Content != "blocked" {
+		t.Fatalf("slow subscriber received %v after an ack, want the blocked message", got)
+	}
+}
+
+// A message handed to a consumer stays in a durable store until it is
+// acked, so a broker that stops before the ack delivers it again.
+func TestUnackedMessagesSurviveRestart(t *testing.T) {
+	cfg := storage.Config{Backend: storage.SegmentBackend, Path: t.TempDir()}
+	open := func() *Topic {
+		t.Helper()
+		store, err := storage.Open(cfg, "jobs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewTopic("jobs", store, nil)
+	}
+
+	topic := open()
+	for _, content := range []string{"acked", "unacked"} {
+		if err := topic.Publish(content, 1, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pulled := topic.Pull(ctx, 2)
+	if len(pulled) != 2 {
+		t.Fatalf("pulled %d messages, want 2", len(pulled))
+	}
+	if topic.Ack([]uuid.UUID{pulled[0].ID}, nil) != 1 {
+		t.Fatal("ack found no message in flight")
+	}
+	topic.Close()
+
+	topic = open()
+	defer topic.Close()
+	got := topic.Pull(ctx, 2)
+	if len(got) != 1 || got[0].Content != pulled[1].Content {
+		t.Fatalf("pulled %v after a restart, want only %q", got, pulled[1].Content)
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"QueraMQ/queue"
+	"QueraMQ/tracing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// traceEnqueue starts the enqueue span of message as a child of the trace
+// context it was published with, and makes the span the parent of the
+// spans that follow by rewriting the message's traceparent header.
+func (t *Topic) traceEnqueue(message *queue.Message, start time.Time) *tracing.Span {
+	if t.tracer == nil {
+		return nil
+	}
+
+	parent, _ := tracing.ParseTraceparent(message.Headers[tracing.TraceparentHeader])
+	span := t.tracer.StartSpan("enqueue "+t.Name, tracing.SpanKindProducer, parent, start)
+	t.messageAttributes(span, message)
+	message.Headers = withTraceparent(message.Headers, span.SpanContext())
+	return span
+}
+
+// traceDelivery records how long message waited in the queue and starts
+// its deliver span, which ends when the message is settled. It returns the
+// message as the consumer should see it, carrying the deliver span's
+// context so the consumer can continue the trace.
+func (t *Topic) traceDelivery(message *queue.Message, consumer string, now time.Time) (*queue.Message, *tracing.Span) {
+	if t.tracer == nil {
+		return message, nil
+	}
+
+	parent, _ := tracing.ParseTraceparent(message.Headers[tracing.TraceparentHeader])
+	wait := t.tracer.StartSpan("wait "+t.Name, tracing.SpanKindInternal, parent, message.EnqueuedAt)
+	t.messageAttributes(wait, message)
+	wait.End(now)
+
+	span := t.tracer.StartSpan("deliver "+t.Name, tracing.SpanKindConsumer, parent, now)
+	t.messageAttributes(span, message)
+	span.SetAttribute("messaging.consumer", consumer)
+
+	delivered := *message
+	delivered.Headers = withTraceparent(message.Headers, span.SpanContext())
+	return &delivered, span
+}
+
+// settle removes an in-flight message and ends its deliver span with
+// outcome. If the subscriber it was pushed to was full, it now has room for
+// one of the messages blocked on it. The caller holds t.mu.
+func (t *Topic) settle(id uuid.UUID, outcome string) (*inFlightMessage, bool) {
+	pending, ok := t.inFlight[id]
+	if !ok {
+		return nil, false
+	}
+	delete(t.inFlight, id)
+	if pending.owner != nil && t.pendingBySubscriber()[pending.owner] == subscriberPrefetch-1 {
+		t.unblock(pending.owner)
+	}
+	pending.span.SetAttribute("queramq.outcome", outcome)
+	pending.span.End(time.Now())
+	return pending, true
+}
+
+func (t *Topic) messageAttributes(span *tracing.Span, message *queue.Message) {
+	span.SetAttribute("messaging.system", "queramq")
+	span.SetAttribute("messaging.destination.name", t.Name)
+	span.SetAttribute("messaging.message.id", message.ID.String())
+}
+
+func withTraceparent(headers map[string]string, sc tracing.SpanContext) map[string]string {
+	copied := make(map[string]string, len(headers)+1)
+	for name, value := range headers {
+		copied[name] = value
+	}
+	copied[tracing.TraceparentHeader] = sc.Traceparent()
+	return copied
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"QueraMQ/tracing"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder is an Exporter that keeps every span by name.
+type recorder struct {
+	mu    sync.Mutex
+	spans map[string]*tracing.Span
+}
+
+func (r *recorder) ExportSpans(service string, spans []*tracing.Span) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, span := range spans {
+		r.spans[strings.Fields(span.Name)[0]] = span
+	}
+	return nil
+}
+
+// A message published with a traceparent is delivered with a traceparent
+// of the same trace, and the broker's spans hang off the publisher's.
+func TestTraceparentPropagatesFromPublishToDelivery(t *testing.T) {
+	const published = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	exporter := &recorder{spans: make(map[string]*tracing.Span)}
+	s := NewServer(freeAddr(t))
+	s.Tracer = tracing.NewTracer("broker", exporter)
+	start(t, s)
+
+	subscriber := dial(t, s.Addr)
+	if err := subscriber.SubscribeWithAcks("orders", ""); err != nil {
+		t.Fatal(err)
+	}
+	headers := map[string]string{tracing.TraceparentHeader: published}
+	if err := dial(t, s.Addr).Publish("orders", "order", 1, headers); err != nil {
+		t.Fatal(err)
+	}
+	delivery := receive(t, subscriber, 1, 5*time.Second)[0]
+	s.Tracer.Close()
+
+	publisher, _ := tracing.ParseTraceparent(published)
+	delivered, ok := tracing.ParseTraceparent(delivery.Headers[tracing.TraceparentHeader])
+	if !ok || delivered.TraceID != publisher.TraceID {
+		t.Fatalf("delivered traceparent %q, want one in trace %x", delivery.Headers[tracing.TraceparentHeader], publisher.TraceID)
+	}
+
+	enqueue, wait, deliver := exporter.spans["enqueue"], exporter.spans["wait"], exporter.spans["deliver"]
+	if enqueue == nil || wait == nil || deliver == nil {
+		t.Fatalf("exported spans %v, want enqueue, wait and deliver", exporter.spans)
+	}
+	tests := []struct {
+		span   *tracing.Span
+		kind   tracing.SpanKind
+		parent tracing.SpanID
+	}{
+		{enqueue, tracing.SpanKindProducer, publisher.SpanID},
+		{wait, tracing.SpanKindInternal, enqueue.Context.SpanID},
+		{deliver, tracing.SpanKindConsumer, enqueue.Context.SpanID},
+	}
+	for _, tt := range tests {
+		if tt.span.Kind != tt.kind || tt.span.Parent != tt.parent || tt.span.Context.TraceID != publisher.TraceID {
+			t.Errorf("span %q has kind %d and parent %x in trace %x, want kind %d and parent %x",
+				tt.span.Name, tt.span.Kind, tt.span.Parent, tt.span.Context.TraceID, tt.kind, tt.parent)
+		}
+	}
+	if delivered.SpanID != deliver.Context.SpanID {
+		t.Errorf("delivered span id %x, want the deliver span %x", delivered.SpanID, deliver.Context.SpanID)
+	}
+	if outcome := deliver.Attributes["queramq.outcome"]; outcome != "acked" {
+		t.Errorf("deliver span outcome %q, want acked", outcome)
+	}
+}
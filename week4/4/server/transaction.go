@@ -0,0 +1,159 @@
+package server
+
+import (
+	"QueraMQ/queue"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// maxStagedOperations bounds the memory a single open transaction may use.
+const maxStagedOperations = 10000
+
+// transaction collects the publishes and acks a connection makes between
+// begin and commit. Nothing is visible to other clients until commit, and
+// everything is dropped on rollback or disconnect.
+type transaction struct {
+	publishes []stagedPublish
+	acks      []stagedAck
+}
+
+type stagedPublish struct {
+	topic   *Topic
+	message *queue.Message
+}
+
+// stagedAck is an ack of a message in flight to owner, nil for a pulled
+// message.
+type stagedAck struct {
+	topic *Topic
+	id    uuid.UUID
+	owner net.Conn
+}
+
+func (tx *transaction) full() bool {
+	return len(tx.publishes)+len(tx.acks) >= maxStagedOperations
+}
+
+// topics returns every topic the transaction touches, sorted by name so
+// that concurrent commits always lock them in the same order.
+func (tx *transaction) topics() []*Topic {
+	seen := make(map[*Topic]bool)
+	var topics []*Topic
+	add := func(t *Topic) {
+		if !seen[t] {
+			seen[t] = true
+			topics = append(topics, t)
+		}
+	}
+	for _, p := range tx.publishes {
+		add(p.topic)
+	}
+	for _, a := range tx.acks {
+		add(a.topic)
+	}
+	sort.Slice(topics, func(i, j int) bool { return topics[i].Name < topics[j].Name })
+	return topics
+}
+
+// commit applies a transaction while holding the locks of every topic it
+// touches, so consumers see either all of its effects or none of them. It
+// fails without applying anything if a staged ack's message is no longer
+// in flight to the connection that staged it, for example because its ack
+// deadline passed. A storage error part way through removes the publishes
+// already stored, so that none of them take effect either.
+func (tx *transaction) commit() error {
+	topics := tx.topics()
+	for _, t := range topics {
+		t.mu.Lock()
+	}
+	defer func() {
+		for _, t := range topics {
+			t.notify()
+			t.mu.Unlock()
+		}
+	}()
+
+	for _, a := range tx.acks {
+		if pending, ok := a.topic.inFlight[a.id]; !ok || pending.owner != a.owner {
+			return fmt.Errorf("message %s is no longer in flight on topic %s", a.id, a.topic.Name)
+		}
+	}
+
+	now := time.Now()
+	for i, p := range tx.publishes {
+		p.message.EnqueuedAt = now
+		span := p.topic.traceEnqueue(p.message, now)
+		err := p.topic.Store.Push(p.message)
+		span.End(time.Now())
+		if err != nil {
+			unpush(tx.publishes[:i])
+			return fmt.Errorf("failed to store message on topic %s: %w", p.topic.Name, err)
+		}
+	}
+	for _, a := range tx.acks {
+		a.topic.complete(a.id)
+	}
+	for _, p := range tx.publishes {
+		p.topic.fanOut(p.message)
+	}
+	return nil
+}
+
+// unpush removes the publishes a failed commit already stored. The caller
+// holds the locks of their topics, so no consumer has seen them.
+func unpush(publishes []stagedPublish) {
+	for _, p := range publishes {
+		if _, err := p.topic.Store.Remove(p.message); err != nil {
+			log.Printf("Failed to roll back message %s on topic %s: %v", p.message.ID, p.topic.Name, err)
+		}
+	}
+}
+
+func (s *Server) handleBegin(tx **transaction, encoder *json.Encoder) {
+	if *tx != nil {
+		s.sendError(encoder, "transaction already in progress")
+		return
+	}
+	*tx = &transaction{}
+
+	response := map[string]interface{}{"status": "ok"}
+	encoder.Encode(response)
+}
+
+func (s *Server) handleCommit(tx **transaction, encoder *json.Encoder) {
+	if *tx == nil {
+		s.sendError(encoder, "no transaction in progress")
+		return
+	}
+	committed := *tx
+	*tx = nil
+
+	if err := committed.commit(); err != nil {
+		s.sendError(encoder, "commit failed: "+err.Error())
+		return
+	}
+
+	response := map[string]interface{}{
+		"status":    "ok",
+		"published": len(committed.publishes),
+		"acked":     len(committed.acks),
+	}
+	encoder.Encode(response)
+}
+
+func (s *Server) handleRollback(tx **transaction, encoder *json.Encoder) {
+	if *tx == nil {
+		s.sendError(encoder, "no transaction in progress")
+		return
+	}
+	*tx = nil
+
+	response := map[string]interface{}{"status": "ok"}
+	encoder.Encode(response)
+}
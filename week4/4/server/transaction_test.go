@@ -0,0 +1,92 @@
+package server
+
+import (
+	"QueraMQ/client"
+	"QueraMQ/queue"
+	"QueraMQ/storage"
+	"errors"
+	"testing"
+	"time"
+)
+
+// failingStore is a store whose disk is full.
+type failingStore struct {
+	storage.Store
+}
+
+func (failingStore) Push(*queue.Message) error {
+	return errors.New("no space left on device")
+}
+
+// A commit that fails to store one publish must not leave the others
+// queued.
+func TestCommitIsAtomicOnStorageError(t *testing.T) {
+	s := NewServer(freeAddr(t))
+	start(t, s)
+	kept, err := s.GetTopic("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken, err := s.GetTopic("invoices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken.mu.Lock()
+	broken.Store = failingStore{broken.Store}
+	broken.mu.Unlock()
+
+	c := dial(t, s.Addr)
+	if err := c.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	for _, topic := range []string{"orders", "invoices", "orders"} {
+		if err := c.Publish(topic, "x", 0, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Commit(); err == nil {
+		t.Fatal("commit succeeded with a failing store")
+	}
+	if depth := kept.Depth(); depth != 0 {
+		t.Fatalf("%d messages of the failed commit are queued", depth)
+	}
+}
+
+// Only the subscriber a message was pushed to may ack it.
+func TestAckRequiresOwner(t *testing.T) {
+	s := NewServer(freeAddr(t))
+	start(t, s)
+
+	owner := dial(t, s.Addr)
+	if err := owner.SubscribeWithAcks("jobs", ""); err != nil {
+		t.Fatal(err)
+	}
+	other := dial(t, s.Addr)
+	if err := other.Publish("jobs", "work", 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var delivery client.Delivery
+	select {
+	case delivery = <-owner.Deliveries():
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delivery")
+	}
+
+	if err := other.Ack(delivery.Topic, delivery.ID); err == nil {
+		t.Fatal("another connection acked the message")
+	}
+	if err := other.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Ack(delivery.Topic, delivery.ID); err == nil {
+		t.Fatal("another connection staged an ack of the message")
+	}
+	if err := other.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := owner.Ack(delivery.Topic, delivery.ID); err != nil {
+		t.Fatal(err)
+	}
+}
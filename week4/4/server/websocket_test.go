@@ -0,0 +1,210 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// wsClient speaks just enough WebSocket to drive the broker: it masks the
+// frames it sends and reads the unmasked frames the broker answers with.
+type wsClient struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func startWithWebSocket(t *testing.T) *Server {
+	t.Helper()
+	s := NewServer(freeAddr(t))
+	s.HTTPAddr = freeAddr(t)
+	start(t, s)
+	waitListening(t, s.HTTPAddr)
+	return s
+}
+
+// dialWebSocket upgrades a connection to /ws and fails the test unless the
+// broker accepts the handshake.
+func dialWebSocket(t *testing.T, addr string) *wsClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	const key = "dGhlIHNhbXBsZSBub25jZQ=="
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", addr, key)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake answered %s", resp.Status)
+	}
+	// The accept value for this key is the one worked out in RFC 6455.
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Sec-WebSocket-Accept %q", accept)
+	}
+	return &wsClient{Conn: conn, br: br}
+}
+
+func (c *wsClient) writeFrame(t *testing.T, opcode byte, payload []byte) {
+	t.Helper()
+	mask := [4]byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, 0x80|byte(len(payload)))
+	default:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := c.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *wsClient) readFrame(t *testing.T) (byte, []byte) {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	if header[1]&0x80 != 0 {
+		t.Fatal("broker sent a masked frame")
+	}
+	length := int(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(c.br, ext[:])
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(c.br, ext[:])
+		length = int(binary.BigEndian.Uint64(ext[:]))
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[0] & 0x0f, payload
+}
+
+func (c *wsClient) send(t *testing.T, request map[string]interface{}) {
+	t.Helper()
+	data, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.writeFrame(t, wsOpText, append(data, '\n'))
+}
+
+// next returns the next JSON line the broker sent as a text frame.
+func (c *wsClient) next(t *testing.T) map[string]interface{} {
+	t.Helper()
+	opcode, payload := c.readFrame(t)
+	if opcode != wsOpText {
+		t.Fatalf("got opcode %d, want a text frame", opcode)
+	}
+	var line map[string]interface{}
+	if err := json.Unmarshal(payload, &line); err != nil {
+		t.Fatal(err)
+	}
+	return line
+}
+
+func TestWebSocketHandshakeRejectsBadUpgrades(t *testing.T) {
+	s := startWithWebSocket(t)
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    int
+	}{
+		{"plain request", map[string]string{}, http.StatusBadRequest},
+		{"missing key", map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "13"}, http.StatusBadRequest},
+		{"old version", map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "8", "Sec-WebSocket-Key": "a2V5"}, http.StatusUpgradeRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "http://"+s.HTTPAddr+"/ws", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.want)
+			}
+			if tt.want == http.StatusUpgradeRequired && resp.Header.Get("Sec-WebSocket-Version") != "13" {
+				t.Fatal("426 response does not name the supported version")
+			}
+		})
+	}
+}
+
+// A WebSocket client publishes and subscribes with the same JSON requests
+// as a TCP client, one request or response per text frame.
+func TestWebSocketPublishSubscribe(t *testing.T) {
+	s := startWithWebSocket(t)
+	subscriber := dialWebSocket(t, s.HTTPAddr)
+	publisher := dialWebSocket(t, s.HTTPAddr)
+
+	subscriber.send(t, map[string]interface{}{"action": "subscribe", "topic": "chat"})
+	if response := subscriber.next(t); response["status"] != "ok" {
+		t.Fatalf("subscribe response %v", response)
+	}
+	// A request split across frames is read as one stream.
+	request, _ := json.Marshal(map[string]interface{}{
+		"action":  "publish",
+		"message": map[string]interface{}{"topic": "chat", "content": "hello", "priority": 1},
+	})
+	half := len(request) / 2
+	publisher.writeFrame(t, wsOpText, request[:half])
+	publisher.writeFrame(t, wsOpText, append(request[half:], '\n'))
+	if response := publisher.next(t); response["status"] != "ok" {
+		t.Fatalf("publish response %v", response)
+	}
+
+	delivery := subscriber.next(t)
+	message, _ := delivery["message"].(map[string]interface{})
+	if delivery["action"] != "message" || delivery["topic"] != "chat" || message["content"] != "hello" {
+		t.Fatalf("delivery %v, want hello on chat", delivery)
+	}
+}
+
+func TestWebSocketControlFrames(t *testing.T) {
+	s := startWithWebSocket(t)
+	c := dialWebSocket(t, s.HTTPAddr)
+
+	c.writeFrame(t, wsOpPing, []byte("are you there"))
+	if opcode, payload := c.readFrame(t); opcode != wsOpPong || !bytes.Equal(payload, []byte("are you there")) {
+		t.Fatalf("ping answered with opcode %d and %q, want a pong echoing it", opcode, payload)
+	}
+
+	status := binary.BigEndian.AppendUint16(nil, 1000)
+	c.writeFrame(t, wsOpClose, status)
+	if opcode, _ := c.readFrame(t); opcode != wsOpClose {
+		t.Fatalf("close answered with opcode %d", opcode)
+	}
+}
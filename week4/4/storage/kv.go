@@ -0,0 +1,303 @@
+package storage
+
+import (
+	"QueraMQ/queue"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	messagesBucket = []byte("messages")
+	enqueuedBucket = []byte("enqueued")
+	leasedBucket   = []byte("leased")
+	metaBucket     = []byte("meta")
+	agingKey       = []byte("aging")
+)
+
+// rankVersion is stored with the aging interval and bumped whenever
+// AgingPolicy.Rank changes, so that init re-keys messages ranked the old
+// way.
+const rankVersion = 2
+
+type kvValue struct {
+	ID         uuid.UUID         `json:"id"`
+	Content    string            `json:"content"`
+	Priority   int               `json:"priority"`
+	EnqueuedAt time.Time         `json:"enqueued_at"`
+	Headers    map[string]string `json:"headers,omitempty"`
+}
+
+// KVStore keeps messages in an embedded bbolt database. Keys sort by
+// AgingPolicy.Rank and then by insertion order, so the first key is always
+// the next message to pop. A second bucket indexes messages by enqueue time.
+// Popping moves a message to a third bucket, keyed by ID, that holds its
+// old key followed by its value; opening the store moves them back.
+type KVStore struct {
+	db    *bolt.DB
+	aging queue.AgingPolicy
+}
+
+func OpenKVStore(path string, aging queue.AgingPolicy) (*KVStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &KVStore{db: db, aging: aging}
+	if err := db.Update(s.init); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// init creates the buckets, queues the messages still leased when the
+// store was last closed and re-keys stored messages when the aging policy,
+// or the way it ranks messages, differs from the one they were written
+// with.
+func (s *KVStore) init(tx *bolt.Tx) error {
+	for _, name := range [][]byte{messagesBucket, enqueuedBucket, leasedBucket, metaBucket} {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+
+	var leased [][]byte
+	err := tx.Bucket(leasedBucket).ForEach(func(id, _ []byte) error {
+		leased = append(leased, append([]byte(nil), id...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range leased {
+		if _, err := s.unlease(tx, id); err != nil {
+			return err
+		}
+	}
+
+	meta := tx.Bucket(metaBucket)
+	interval := append(binary.BigEndian.AppendUint64(nil, uint64(s.aging.Interval)), rankVersion)
+	if stored := meta.Get(agingKey); stored != nil && !bytes.Equal(stored, interval) {
+		messages := tx.Bucket(messagesBucket)
+		var rekeyed [][2][]byte
+		err := messages.ForEach(func(key, data []byte) error {
+			var value kvValue
+			if err := json.Unmarshal(data, &value); err != nil {
+				return err
+			}
+			seq := binary.BigEndian.Uint64(key[8:])
+			rekeyed = append(rekeyed, [2][]byte{s.messageKey(value, seq), append([]byte(nil), data...)})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := tx.DeleteBucket(messagesBucket); err != nil {
+			return err
+		}
+		messages, err = tx.CreateBucketIfNotExists(messagesBucket)
+		if err != nil {
+			return err
+		}
+		for _, kv := range rekeyed {
+			if err := messages.Put(kv[0], kv[1]); err != nil {
+				return err
+			}
+		}
+	}
+	return meta.Put(agingKey, interval)
+}
+
+func (s *KVStore) Push(message *queue.Message) error {
+	if message.EnqueuedAt.IsZero() {
+		message.EnqueuedAt = time.Now()
+	}
+	value := kvValue{
+		ID:         message.ID,
+		Content:    message.Content,
+		Priority:   message.Priority,
+		EnqueuedAt: message.EnqueuedAt,
+		Headers:    message.Headers,
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		messages := tx.Bucket(messagesBucket)
+		seq, err := messages.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := s.messageKey(value, seq)
+		if err := messages.Put(key, data); err != nil {
+			return err
+		}
+		return tx.Bucket(enqueuedBucket).Put(enqueuedKey(value.EnqueuedAt, seq), value.ID[:])
+	})
+}
+
+func (s *KVStore) Pop() (*queue.Message, error) {
+	var message *queue.Message
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		messages := tx.Bucket(messagesBucket)
+		key, data := messages.Cursor().First()
+		if key == nil {
+			return nil
+		}
+		key, data = append([]byte(nil), key...), append([]byte(nil), data...)
+
+		var value kvValue
+		if err := json.Unmarshal(data, &value); err != nil {
+			return err
+		}
+		message = &queue.Message{
+			ID:         value.ID,
+			Content:    value.Content,
+			Priority:   value.Priority,
+			EnqueuedAt: value.EnqueuedAt,
+			Headers:    value.Headers,
+		}
+
+		seq := binary.BigEndian.Uint64(key[8:])
+		if err := tx.Bucket(enqueuedBucket).Delete(enqueuedKey(value.EnqueuedAt, seq)); err != nil {
+			return err
+		}
+		if err := messages.Delete(key); err != nil {
+			return err
+		}
+		return tx.Bucket(leasedBucket).Put(value.ID[:], append(key, data...))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func (s *KVStore) Requeue(message *queue.Message) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		_, err := s.unlease(tx, message.ID[:])
+		return err
+	})
+}
+
+// unlease puts the leased message with id back under its old keys and
+// reports whether it was leased.
+func (s *KVStore) unlease(tx *bolt.Tx, id []byte) (bool, error) {
+	leased := tx.Bucket(leasedBucket)
+	stored := leased.Get(id)
+	if stored == nil {
+		return false, nil
+	}
+	key, data := append([]byte(nil), stored[:16]...), append([]byte(nil), stored[16:]...)
+
+	var value kvValue
+	if err := json.Unmarshal(data, &value); err != nil {
+		return false, err
+	}
+	if err := tx.Bucket(messagesBucket).Put(key, data); err != nil {
+		return false, err
+	}
+	seq := binary.BigEndian.Uint64(key[8:])
+	if err := tx.Bucket(enqueuedBucket).Put(enqueuedKey(value.EnqueuedAt, seq), value.ID[:]); err != nil {
+		return false, err
+	}
+	return true, leased.Delete(id)
+}
+
+// Remove deletes a leased message by ID. A queued one is found through the
+// enqueue time index, among the messages enqueued at the same instant, and
+// both of its keys are deleted.
+func (s *KVStore) Remove(message *queue.Message) (bool, error) {
+	removed := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if leased := tx.Bucket(leasedBucket); leased.Get(message.ID[:]) != nil {
+			removed = true
+			return leased.Delete(message.ID[:])
+		}
+
+		enqueued := tx.Bucket(enqueuedBucket)
+		prefix := enqueuedKey(message.EnqueuedAt, 0)[:8]
+		c := enqueued.Cursor()
+		for key, id := c.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, id = c.Next() {
+			if !bytes.Equal(id, message.ID[:]) {
+				continue
+			}
+			seq := binary.BigEndian.Uint64(key[8:])
+			value := kvValue{Priority: message.Priority, EnqueuedAt: message.EnqueuedAt}
+			if err := tx.Bucket(messagesBucket).Delete(s.messageKey(value, seq)); err != nil {
+				return err
+			}
+			removed = true
+			return enqueued.Delete(key)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return removed, nil
+}
+
+func (s *KVStore) Len() int {
+	n := 0
+	s.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(messagesBucket).Stats().KeyN
+		return nil
+	})
+	return n
+}
+
+func (s *KVStore) Oldest() time.Time {
+	var oldest time.Time
+	s.db.View(func(tx *bolt.Tx) error {
+		if key, _ := tx.Bucket(enqueuedBucket).Cursor().First(); key != nil {
+			oldest = time.Unix(0, int64(binary.BigEndian.Uint64(key)^(1<<63)))
+		}
+		return nil
+	})
+	return oldest
+}
+
+func (s *KVStore) Close() error {
+	return s.db.Close()
+}
+
+// messageKey encodes the rank as an order-preserving float followed by seq.
+func (s *KVStore) messageKey(value kvValue, seq uint64) []byte {
+	rank := s.aging.Rank(&queue.Message{Priority: value.Priority, EnqueuedAt: value.EnqueuedAt})
+
+	bits := math.Float64bits(rank)
+	if rank >= 0 {
+		bits ^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, bits)
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
+
+// enqueuedKey flips the sign bit so that times before 1970 still sort first.
+func enqueuedKey(enqueuedAt time.Time, seq uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(enqueuedAt.UnixNano())^(1<<63))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
@@ -0,0 +1,16 @@
+package storage_test
+
+import (
+	"QueraMQ/queue"
+	"QueraMQ/storage"
+	"QueraMQ/storage/storagetest"
+	"path/filepath"
+	"testing"
+)
+
+func TestKVStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "topic.db")
+	storagetest.TestStore(t, func() (storage.Store, error) {
+		return storage.OpenKVStore(path, queue.AgingPolicy{})
+	}, true)
+}
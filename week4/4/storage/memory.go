@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"QueraMQ/queue"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MemoryStore keeps messages in a queue.ConcurrentQueue and loses them when
+// the process exits.
+type MemoryStore struct {
+	q      *queue.ConcurrentQueue
+	mu     sync.Mutex
+	leased map[uuid.UUID]*queue.Message
+}
+
+func NewMemoryStore(aging queue.AgingPolicy) *MemoryStore {
+	return &MemoryStore{q: queue.NewAgingQueue(aging), leased: make(map[uuid.UUID]*queue.Message)}
+}
+
+func (s *MemoryStore) Push(message *queue.Message) error {
+	s.q.Enqueue(message)
+	return nil
+}
+
+func (s *MemoryStore) Pop() (*queue.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	message, ok := s.q.TryPop()
+	if !ok {
+		return nil, nil
+	}
+	s.leased[message.ID] = message
+	return message, nil
+}
+
+func (s *MemoryStore) Requeue(message *queue.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, leased := s.leased[message.ID]; leased {
+		delete(s.leased, message.ID)
+		s.q.Enqueue(message)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Remove(message *queue.Message) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, leased := s.leased[message.ID]; leased {
+		delete(s.leased, message.ID)
+		return true, nil
+	}
+	return s.q.Remove(message.ID), nil
+}
+
+func (s *MemoryStore) Len() int {
+	return s.q.Len()
+}
+
+func (s *MemoryStore) Oldest() time.Time {
+	return s.q.Oldest()
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,14 @@
+package storage_test
+
+import (
+	"QueraMQ/queue"
+	"QueraMQ/storage"
+	"QueraMQ/storage/storagetest"
+	"testing"
+)
+
+func TestMemoryStore(t *testing.T) {
+	storagetest.TestStore(t, func() (storage.Store, error) {
+		return storage.NewMemoryStore(queue.AgingPolicy{}), nil
+	}, false)
+}
@@ -0,0 +1,286 @@
+package storage
+
+import (
+	"QueraMQ/queue"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const defaultSegmentBytes = 4 << 20
+
+// segmentRecord is one line of a segment file. A push record stores a
+// message and a pop record removes the message with the same ID.
+type segmentRecord struct {
+	Op         string            `json:"op"`
+	ID         uuid.UUID         `json:"id"`
+	Content    string            `json:"content,omitempty"`
+	Priority   int               `json:"priority,omitempty"`
+	EnqueuedAt time.Time         `json:"enqueued_at"`
+	Headers    map[string]string `json:"headers,omitempty"`
+}
+
+type segment struct {
+	seq  uint64
+	path string
+	// live counts the pushes in this segment that have not been removed yet.
+	live int
+}
+
+// SegmentStore is an append-only log split into numbered segment files. The
+// queue is rebuilt by replaying the segments on open, and the oldest
+// segments are deleted once every message they hold has been removed.
+// Leases are kept in memory only, so popping writes nothing and a reopened
+// store queues its leased messages again.
+type SegmentStore struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	segments []*segment
+	active   *os.File
+	size     int64
+	q        *queue.ConcurrentQueue
+	location map[uuid.UUID]*segment
+	leased   map[uuid.UUID]*queue.Message
+}
+
+func OpenSegmentStore(dir string, maxBytes int64, aging queue.AgingPolicy) (*SegmentStore, error) {
+	if maxBytes <= 0 {
+		maxBytes = defaultSegmentBytes
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	s := &SegmentStore{
+		dir:      dir,
+		maxBytes: maxBytes,
+		q:        queue.NewAgingQueue(aging),
+		location: make(map[uuid.UUID]*segment),
+		leased:   make(map[uuid.UUID]*queue.Message),
+	}
+
+	seqs, err := s.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	for _, seq := range seqs {
+		seg := &segment{seq: seq, path: s.segmentPath(seq)}
+		s.segments = append(s.segments, seg)
+		if err := s.replay(seg); err != nil {
+			return nil, err
+		}
+	}
+
+	// Always append to a fresh segment so that a record left half-written
+	// by a crash is never followed by new data.
+	var next uint64 = 1
+	if len(seqs) > 0 {
+		next = seqs[len(seqs)-1] + 1
+	}
+	if err := s.openSegment(next); err != nil {
+		return nil, err
+	}
+	s.compact()
+
+	return s, nil
+}
+
+func (s *SegmentStore) Push(message *queue.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if message.EnqueuedAt.IsZero() {
+		message.EnqueuedAt = time.Now()
+	}
+
+	seg := s.segments[len(s.segments)-1]
+	record := segmentRecord{
+		Op:         "push",
+		ID:         message.ID,
+		Content:    message.Content,
+		Priority:   message.Priority,
+		EnqueuedAt: message.EnqueuedAt,
+		Headers:    message.Headers,
+	}
+	if err := s.append(record); err != nil {
+		return err
+	}
+
+	s.apply(record, seg)
+	return nil
+}
+
+func (s *SegmentStore) Pop() (*queue.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	message, ok := s.q.TryPop()
+	if !ok {
+		return nil, nil
+	}
+	s.leased[message.ID] = message
+	return message, nil
+}
+
+func (s *SegmentStore) Requeue(message *queue.Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, leased := s.leased[message.ID]; leased {
+		delete(s.leased, message.ID)
+		s.q.Enqueue(message)
+	}
+	return nil
+}
+
+// Remove appends a pop record for message, which deletes it on replay.
+func (s *SegmentStore) Remove(message *queue.Message) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, queued := s.location[message.ID]; !queued {
+		return false, nil
+	}
+
+	record := segmentRecord{Op: "pop", ID: message.ID}
+	if err := s.append(record); err != nil {
+		return false, err
+	}
+
+	s.apply(record, nil)
+	s.compact()
+	return true, nil
+}
+
+func (s *SegmentStore) Len() int {
+	return s.q.Len()
+}
+
+func (s *SegmentStore) Oldest() time.Time {
+	return s.q.Oldest()
+}
+
+func (s *SegmentStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.active.Close()
+}
+
+func (s *SegmentStore) listSegments() ([]uint64, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var seqs []uint64
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".log")
+		if !ok {
+			continue
+		}
+		seq, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+func (s *SegmentStore) replay(seg *segment) error {
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), int(s.maxBytes)+64*1024)
+	for scanner.Scan() {
+		var record segmentRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// A torn write can only be the last record of a segment.
+			break
+		}
+		s.apply(record, seg)
+	}
+	return scanner.Err()
+}
+
+// apply updates the in-memory queue for a record stored in seg.
+func (s *SegmentStore) apply(record segmentRecord, seg *segment) {
+	if old, exists := s.location[record.ID]; exists {
+		old.live--
+		delete(s.location, record.ID)
+		delete(s.leased, record.ID)
+		s.q.Remove(record.ID)
+	}
+
+	if record.Op == "push" {
+		s.q.Enqueue(&queue.Message{
+			ID:         record.ID,
+			Content:    record.Content,
+			Priority:   record.Priority,
+			EnqueuedAt: record.EnqueuedAt,
+			Headers:    record.Headers,
+		})
+		s.location[record.ID] = seg
+		seg.live++
+	}
+}
+
+func (s *SegmentStore) append(record segmentRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	n, err := s.active.Write(append(data, '\n'))
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	if s.size >= s.maxBytes {
+		s.active.Close()
+		return s.openSegment(s.segments[len(s.segments)-1].seq + 1)
+	}
+	return nil
+}
+
+func (s *SegmentStore) openSegment(seq uint64) error {
+	path := s.segmentPath(seq)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	s.active = f
+	s.size = 0
+	s.segments = append(s.segments, &segment{seq: seq, path: path})
+	return nil
+}
+
+// compact deletes fully consumed segments from the front of the log. Only a
+// prefix may go, since a later segment can hold pops for earlier pushes.
+func (s *SegmentStore) compact() {
+	for len(s.segments) > 1 && s.segments[0].live == 0 {
+		os.Remove(s.segments[0].path)
+		s.segments = s.segments[1:]
+	}
+}
+
+func (s *SegmentStore) segmentPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d.log", seq))
+}
@@ -0,0 +1,24 @@
+package storage_test
+
+import (
+	"QueraMQ/queue"
+	"QueraMQ/storage"
+	"QueraMQ/storage/storagetest"
+	"path/filepath"
+	"testing"
+)
+
+func TestSegmentStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "topic")
+	// Small segments make the suite roll over and compact several of them.
+	storagetest.TestStore(t, func() (storage.Store, error) {
+		return storage.OpenSegmentStore(dir, 256, queue.AgingPolicy{})
+	}, true)
+}
+
+func TestOpenSegmentBackend(t *testing.T) {
+	cfg := storage.Config{Backend: storage.SegmentBackend, Path: t.TempDir()}
+	storagetest.TestStore(t, func() (storage.Store, error) {
+		return storage.Open(cfg, "orders/eu")
+	}, true)
+}
@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"QueraMQ/queue"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"time"
+)
+
+const (
+	MemoryBackend  = "memory"
+	SegmentBackend = "segment"
+	KVBackend      = "kv"
+)
+
+// Store holds the messages of a single topic. A popped message is leased
+// rather than deleted: it leaves the queue but stays stored until it is
+// removed, so that a message handed to a consumer that never acks it is
+// queued again when the store is reopened after a crash.
+type Store interface {
+	// Push stores message under its existing ID.
+	Push(message *queue.Message) error
+	// Pop leases and returns the highest-priority queued message, or nil
+	// when none is queued.
+	Pop() (*queue.Message, error)
+	// Requeue returns a leased message to the queue. A message that is no
+	// longer leased is left alone.
+	Requeue(message *queue.Message) error
+	// Remove deletes message, as it was pushed, whether it is queued or
+	// leased, and reports whether it was still stored. It settles an acked
+	// message and undoes a push that must not take effect.
+	Remove(message *queue.Message) (bool, error)
+	// Len counts the queued messages, leaving out leased ones.
+	Len() int
+	// Oldest returns the enqueue time of the message that has waited
+	// longest, or the zero time when the store is empty.
+	Oldest() time.Time
+	Close() error
+}
+
+// Config selects and configures the backend of a topic. Path is a base
+// directory; each topic keeps its data in its own entry below it.
+type Config struct {
+	Backend      string            `json:"backend"`
+	Path         string            `json:"path"`
+	SegmentBytes int64             `json:"segment_bytes"`
+	Aging        queue.AgingPolicy `json:"aging"`
+}
+
+// Open creates the store for topic as described by cfg.
+func Open(cfg Config, topic string) (Store, error) {
+	switch cfg.Backend {
+	case "", MemoryBackend:
+		return NewMemoryStore(cfg.Aging), nil
+	case SegmentBackend:
+		return OpenSegmentStore(topicPath(cfg, topic), cfg.SegmentBytes, cfg.Aging)
+	case KVBackend:
+		return OpenKVStore(topicPath(cfg, topic)+".db", cfg.Aging)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Backend)
+	}
+}
+
+func topicPath(cfg Config, topic string) string {
+	return filepath.Join(cfg.Path, url.PathEscape(topic))
+}
@@ -0,0 +1,328 @@
+// Package storagetest implements a conformance suite for storage.Store
+// implementations, in the spirit of testing/fstest.
+package storagetest
+
+import (
+	"QueraMQ/queue"
+	"QueraMQ/storage"
+	"fmt"
+	"maps"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TestStore checks that the stores returned by open behave like a
+// storage.Store. The first call to open must return an empty store without
+// an aging policy, since the checks expect strict priority order. When
+// persistent is true, open is called again on the same data after Close to
+// check that queued and leased messages survive a restart.
+func TestStore(t *testing.T, open func() (storage.Store, error), persistent bool) {
+	t.Helper()
+	store, err := open()
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer func() {
+		if store != nil {
+			store.Close()
+		}
+	}()
+
+	checks := []struct {
+		name string
+		run  func(*testing.T, storage.Store)
+	}{
+		{"empty", checkEmpty},
+		{"priority order", checkPriorityOrder},
+		{"requeue", checkRequeue},
+		{"lease", checkLease},
+		{"remove", checkRemove},
+		{"oldest", checkOldest},
+		{"concurrent push", checkConcurrentPush},
+	}
+	for _, check := range checks {
+		// The checks share the store, so later ones cannot run once one
+		// has left it in an unknown state.
+		if !t.Run(check.name, func(t *testing.T) { check.run(t, store) }) {
+			return
+		}
+	}
+
+	if persistent {
+		t.Run("reopen", func(t *testing.T) { checkReopen(t, &store, open) })
+	}
+
+	if store != nil {
+		err := store.Close()
+		store = nil
+		if err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	}
+}
+
+func checkEmpty(t *testing.T, store storage.Store) {
+	t.Helper()
+	if n := store.Len(); n != 0 {
+		t.Fatalf("Len() = %d, want 0", n)
+	}
+	message, err := store.Pop()
+	if err != nil {
+		t.Fatalf("Pop: %v", err)
+	}
+	if message != nil {
+		t.Fatalf("Pop() = %v, want nil", message)
+	}
+}
+
+func checkPriorityOrder(t *testing.T, store storage.Store) {
+	want := []*queue.Message{
+		newMessage("urgent", -5),
+		newMessage("high", 1),
+		newMessage("medium", 3),
+		newMessage("low", 9),
+	}
+	want[1].Headers = map[string]string{"region": "eu", "trace": "abc"}
+	for _, i := range []int{2, 0, 3, 1} {
+		push(t, store, copyMessage(want[i]))
+	}
+
+	if n := store.Len(); n != len(want) {
+		t.Fatalf("Len() = %d, want %d", n, len(want))
+	}
+	expectPops(t, store, want)
+	removeLeased(t, store, want...)
+}
+
+func checkRequeue(t *testing.T, store storage.Store) {
+	message := newMessage("retry", 2)
+	push(t, store, copyMessage(message))
+	popped, err := store.Pop()
+	if err != nil {
+		t.Fatalf("Pop: %v", err)
+	}
+	if err := store.Requeue(popped); err != nil {
+		t.Fatalf("Requeue: %v", err)
+	}
+	expectPops(t, store, []*queue.Message{message})
+	removeLeased(t, store, message)
+}
+
+// checkLease checks that a popped message leaves the queue but can still
+// be removed, and that requeueing it once removed does nothing.
+func checkLease(t *testing.T, store storage.Store) {
+	leased := newMessage("leased", 1)
+	queued := newMessage("queued", 2)
+	push(t, store, copyMessage(leased))
+	push(t, store, copyMessage(queued))
+
+	popped, err := store.Pop()
+	if err != nil {
+		t.Fatalf("Pop: %v", err)
+	}
+	if popped == nil || popped.ID != leased.ID {
+		t.Fatalf("Pop() = %v, want %q", popped, leased.Content)
+	}
+	if n := store.Len(); n != 1 {
+		t.Fatalf("Len() with one message leased = %d, want 1", n)
+	}
+	removeLeased(t, store, leased)
+	if removed, err := store.Remove(copyMessage(leased)); err != nil || removed {
+		t.Fatalf("Remove() of a removed message = %v, %v, want false", removed, err)
+	}
+	if err := store.Requeue(popped); err != nil {
+		t.Fatalf("Requeue: %v", err)
+	}
+	expectPops(t, store, []*queue.Message{queued})
+	removeLeased(t, store, queued)
+}
+
+func checkRemove(t *testing.T, store storage.Store) {
+	// Messages enqueued at the same instant must still be told apart.
+	now := time.Now()
+	messages := []*queue.Message{
+		newMessage("kept", 1),
+		newMessage("removed", 2),
+		newMessage("also kept", 3),
+	}
+	for _, message := range messages {
+		message.EnqueuedAt = now
+		push(t, store, copyMessage(message))
+	}
+
+	for _, want := range []bool{true, false} {
+		removed, err := store.Remove(copyMessage(messages[1]))
+		if err != nil {
+			t.Fatalf("Remove: %v", err)
+		}
+		if removed != want {
+			t.Fatalf("Remove() = %v, want %v", removed, want)
+		}
+	}
+	if n := store.Len(); n != 2 {
+		t.Fatalf("Len() = %d, want 2", n)
+	}
+	expectPops(t, store, []*queue.Message{messages[0], messages[2]})
+	removeLeased(t, store, messages[0], messages[2])
+}
+
+func checkOldest(t *testing.T, store storage.Store) {
+	now := time.Now()
+	want := []*queue.Message{
+		newMessage("recent urgent", 1),
+		newMessage("old", 5),
+	}
+	want[0].EnqueuedAt = now.Add(-time.Minute)
+	want[1].EnqueuedAt = now.Add(-time.Hour)
+
+	for _, message := range want {
+		push(t, store, copyMessage(message))
+	}
+	if oldest := store.Oldest(); !oldest.Equal(want[1].EnqueuedAt) {
+		t.Fatalf("Oldest() = %v, want %v", oldest, want[1].EnqueuedAt)
+	}
+	expectPops(t, store, want)
+	if oldest := store.Oldest(); !oldest.IsZero() {
+		t.Fatalf("Oldest() on empty store = %v, want zero", oldest)
+	}
+	removeLeased(t, store, want...)
+}
+
+func checkConcurrentPush(t *testing.T, store storage.Store) {
+	const workers, perWorker = 8, 25
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				if err := store.Push(newMessage(fmt.Sprintf("%d-%d", w, i), i%5)); err != nil {
+					t.Errorf("Push: %v", err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	if n := store.Len(); n != workers*perWorker {
+		t.Fatalf("Len() = %d, want %d", n, workers*perWorker)
+	}
+
+	seen := make(map[uuid.UUID]bool)
+	var popped []*queue.Message
+	last := -1
+	for {
+		message, err := store.Pop()
+		if err != nil {
+			t.Fatalf("Pop: %v", err)
+		}
+		if message == nil {
+			break
+		}
+		if seen[message.ID] {
+			t.Fatalf("message %s popped twice", message.ID)
+		}
+		if message.Priority < last {
+			t.Fatalf("popped priority %d after %d", message.Priority, last)
+		}
+		seen[message.ID] = true
+		popped = append(popped, message)
+		last = message.Priority
+	}
+	if len(seen) != workers*perWorker {
+		t.Fatalf("popped %d messages, want %d", len(seen), workers*perWorker)
+	}
+	removeLeased(t, store, popped...)
+}
+
+// checkReopen closes *store and replaces it with the store open makes of
+// the same data, or with nil if it could not open one. A message still
+// leased at Close is queued again; a removed one is gone.
+func checkReopen(t *testing.T, store *storage.Store, open func() (storage.Store, error)) {
+	want := []*queue.Message{
+		newMessage("unacked", 0),
+		newMessage("first", 1),
+		newMessage("second", 2),
+	}
+	acked := newMessage("acked", -1)
+	for _, message := range []*queue.Message{want[2], acked, want[1], want[0]} {
+		push(t, *store, copyMessage(message))
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := (*store).Pop(); err != nil {
+			t.Fatalf("Pop: %v", err)
+		}
+	}
+	removeLeased(t, *store, acked)
+	err := (*store).Close()
+	*store = nil
+	if err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if *store, err = open(); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if n := (*store).Len(); n != len(want) {
+		t.Fatalf("Len() after reopen = %d, want %d", n, len(want))
+	}
+	expectPops(t, *store, want)
+}
+
+// removeLeased removes messages, which must have been popped, the way an
+// ack does.
+func removeLeased(t *testing.T, store storage.Store, messages ...*queue.Message) {
+	t.Helper()
+	for _, message := range messages {
+		removed, err := store.Remove(copyMessage(message))
+		if err != nil {
+			t.Fatalf("Remove: %v", err)
+		}
+		if !removed {
+			t.Fatalf("Remove() of leased %q = false, want true", message.Content)
+		}
+	}
+}
+
+func push(t *testing.T, store storage.Store, message *queue.Message) {
+	t.Helper()
+	if err := store.Push(message); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+}
+
+// expectPops pops len(want) messages and then expects the store to be empty.
+func expectPops(t *testing.T, store storage.Store, want []*queue.Message) {
+	t.Helper()
+	for _, w := range want {
+		got, err := store.Pop()
+		if err != nil {
+			t.Fatalf("Pop: %v", err)
+		}
+		if got == nil {
+			t.Fatalf("Pop() = nil, want %q", w.Content)
+		}
+		if got.ID != w.ID || got.Content != w.Content || got.Priority != w.Priority || !got.EnqueuedAt.Equal(w.EnqueuedAt) || !maps.Equal(got.Headers, w.Headers) {
+			t.Fatalf("Pop() = {%s %q %d}, want {%s %q %d}",
+				got.ID, got.Content, got.Priority, w.ID, w.Content, w.Priority)
+		}
+	}
+	checkEmpty(t, store)
+}
+
+func newMessage(content string, priority int) *queue.Message {
+	return &queue.Message{ID: uuid.New(), Content: content, Priority: priority, EnqueuedAt: time.Now()}
+}
+
+func copyMessage(message *queue.Message) *queue.Message {
+	c := *message
+	return &c
+}
@@ -0,0 +1,161 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NewExporter returns the exporter for target: "stdout", or the URL of an
+// OTLP/HTTP traces endpoint.
+func NewExporter(target string) (Exporter, error) {
+	switch {
+	case target == "stdout":
+		return NewWriterExporter(os.Stdout), nil
+	case strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://"):
+		return NewHTTPExporter(target), nil
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", target)
+	}
+}
+
+// WriterExporter writes every batch to w as one line of OTLP/JSON, the
+// body an OTLP/HTTP collector accepts at /v1/traces.
+type WriterExporter struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{w: w}
+}
+
+func (e *WriterExporter) ExportSpans(service string, spans []*Span) error {
+	data, err := EncodeOTLP(service, spans)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.w.Write(append(data, '\n'))
+	return err
+}
+
+// HTTPExporter posts batches to an OTLP/HTTP endpoint such as
+// http://localhost:4318/v1/traces, served by an OpenTelemetry collector or
+// by cmd/tracecollector.
+type HTTPExporter struct {
+	Endpoint string
+	Client   *http.Client
+}
+
+func NewHTTPExporter(endpoint string) *HTTPExporter {
+	return &HTTPExporter{Endpoint: endpoint, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (e *HTTPExporter) ExportSpans(service string, spans []*Span) error {
+	data, err := EncodeOTLP(service, spans)
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.Client.Post(e.Endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// The OTLP/JSON message shapes. IDs are hex strings and 64-bit integers
+// decimal strings, as the JSON encoding of the protocol requires.
+type (
+	OTLPRequest struct {
+		ResourceSpans []OTLPResourceSpans `json:"resourceSpans"`
+	}
+	OTLPResourceSpans struct {
+		Resource   OTLPResource     `json:"resource"`
+		ScopeSpans []OTLPScopeSpans `json:"scopeSpans"`
+	}
+	OTLPResource struct {
+		Attributes []OTLPAttribute `json:"attributes"`
+	}
+	OTLPScopeSpans struct {
+		Scope OTLPScope  `json:"scope"`
+		Spans []OTLPSpan `json:"spans"`
+	}
+	OTLPScope struct {
+		Name string `json:"name"`
+	}
+	OTLPSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              SpanKind        `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []OTLPAttribute `json:"attributes,omitempty"`
+	}
+	OTLPAttribute struct {
+		Key   string    `json:"key"`
+		Value OTLPValue `json:"value"`
+	}
+	OTLPValue struct {
+		StringValue string `json:"stringValue"`
+	}
+)
+
+// EncodeOTLP encodes spans as an OTLP/JSON ExportTraceServiceRequest.
+func EncodeOTLP(service string, spans []*Span) ([]byte, error) {
+	encoded := make([]OTLPSpan, 0, len(spans))
+	for _, span := range spans {
+		s := OTLPSpan{
+			TraceID:           hex.EncodeToString(span.Context.TraceID[:]),
+			SpanID:            hex.EncodeToString(span.Context.SpanID[:]),
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.EndTime.UnixNano(), 10),
+			Attributes:        attributes(span.Attributes),
+		}
+		if span.Parent != (SpanID{}) {
+			s.ParentSpanID = hex.EncodeToString(span.Parent[:])
+		}
+		encoded = append(encoded, s)
+	}
+
+	return json.Marshal(OTLPRequest{ResourceSpans: []OTLPResourceSpans{{
+		Resource:   OTLPResource{Attributes: attributes(map[string]string{"service.name": service})},
+		ScopeSpans: []OTLPScopeSpans{{Scope: OTLPScope{Name: "QueraMQ"}, Spans: encoded}},
+	}}})
+}
+
+func attributes(values map[string]string) []OTLPAttribute {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	attrs := make([]OTLPAttribute, 0, len(keys))
+	for _, key := range keys {
+		attrs = append(attrs, OTLPAttribute{Key: key, Value: OTLPValue{StringValue: values[key]}})
+	}
+	return attrs
+}
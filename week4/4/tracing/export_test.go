@@ -0,0 +1,146 @@
+package tracing_test
+
+import (
+	"QueraMQ/tracing"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func encodedSpans(t *testing.T) (parent tracing.SpanContext, spans []*tracing.Span) {
+	t.Helper()
+	parent, _ = tracing.ParseTraceparent("00-" + traceHex + "-" + spanHex + "-01")
+	start := time.Unix(1700000000, 5)
+	child := &tracing.Span{
+		Name:       "enqueue orders",
+		Kind:       tracing.SpanKindProducer,
+		Context:    tracing.SpanContext{TraceID: parent.TraceID, SpanID: tracing.SpanID{1, 2, 3, 4, 5, 6, 7, 8}},
+		Parent:     parent.SpanID,
+		Start:      start,
+		EndTime:    start.Add(time.Millisecond),
+		Attributes: map[string]string{"messaging.system": "queramq", "messaging.destination.name": "orders"},
+	}
+	root := &tracing.Span{
+		Name:    "root",
+		Kind:    tracing.SpanKindInternal,
+		Context: tracing.SpanContext{TraceID: tracing.TraceID{9}, SpanID: tracing.SpanID{9}},
+		Start:   start,
+		EndTime: start,
+	}
+	return parent, []*tracing.Span{child, root}
+}
+
+func TestEncodeOTLP(t *testing.T) {
+	_, spans := encodedSpans(t)
+	data, err := tracing.EncodeOTLP("broker", spans)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var request tracing.OTLPRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		t.Fatal(err)
+	}
+	if len(request.ResourceSpans) != 1 || len(request.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("got %d resource spans, want one with one scope", len(request.ResourceSpans))
+	}
+	resource := request.ResourceSpans[0]
+	if attrs := resource.Resource.Attributes; len(attrs) != 1 || attrs[0].Key != "service.name" || attrs[0].Value.StringValue != "broker" {
+		t.Errorf("resource attributes %+v, want service.name=broker", attrs)
+	}
+
+	encoded := resource.ScopeSpans[0].Spans
+	if len(encoded) != 2 {
+		t.Fatalf("encoded %d spans, want 2", len(encoded))
+	}
+	child := encoded[0]
+	want := tracing.OTLPSpan{
+		TraceID:           traceHex,
+		SpanID:            "0102030405060708",
+		ParentSpanID:      spanHex,
+		Name:              "enqueue orders",
+		Kind:              tracing.SpanKindProducer,
+		StartTimeUnixNano: "1700000000000000005",
+		EndTimeUnixNano:   "1700000000001000005",
+	}
+	got := child
+	got.Attributes = nil
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("encoded span\n%+v, want\n%+v", got, want)
+	}
+	// Attributes are sorted by key, so the encoding is stable.
+	if len(child.Attributes) != 2 || child.Attributes[0].Key != "messaging.destination.name" || child.Attributes[1].Key != "messaging.system" {
+		t.Errorf("attributes %+v, want them sorted by key", child.Attributes)
+	}
+	if encoded[1].ParentSpanID != "" {
+		t.Errorf("root span has parent %q", encoded[1].ParentSpanID)
+	}
+
+	// 64-bit integers are strings and parentSpanId is left out of roots,
+	// as the OTLP/JSON encoding asks.
+	var raw struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []map[string]interface{}
+			}
+		}
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatal(err)
+	}
+	rawRoot := raw.ResourceSpans[0].ScopeSpans[0].Spans[1]
+	if _, ok := rawRoot["startTimeUnixNano"].(string); !ok {
+		t.Errorf("startTimeUnixNano is %T, want a string", rawRoot["startTimeUnixNano"])
+	}
+	if _, ok := rawRoot["parentSpanId"]; ok {
+		t.Error("root span carries parentSpanId")
+	}
+}
+
+func TestWriterExporterWritesOneLinePerBatch(t *testing.T) {
+	_, spans := encodedSpans(t)
+	var out bytes.Buffer
+	exporter := tracing.NewWriterExporter(&out)
+	for i := 0; i < 2; i++ {
+		if err := exporter.ExportSpans("broker", spans); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lines := bytes.Count(out.Bytes(), []byte("\n")); lines != 2 {
+		t.Fatalf("wrote %d lines, want 2", lines)
+	}
+}
+
+func TestHTTPExporterPostsOTLP(t *testing.T) {
+	received := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %s with Content-Type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		received <- body
+	}))
+	defer collector.Close()
+
+	_, spans := encodedSpans(t)
+	if err := tracing.NewHTTPExporter(collector.URL).ExportSpans("broker", spans); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := tracing.EncodeOTLP("broker", spans)
+	if got := <-received; !bytes.Equal(got, want) {
+		t.Fatalf("collector received %s, want %s", got, want)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	if err := tracing.NewHTTPExporter(failing.URL).ExportSpans("broker", spans); err == nil {
+		t.Fatal("export to a failing collector succeeded")
+	}
+}
@@ -0,0 +1,256 @@
+// Package tracing records spans for messages passing through the broker and
+// exports them in the OpenTelemetry protocol's JSON encoding. Trace context
+// travels with a message in its W3C traceparent header.
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceparentHeader is the message header carrying the W3C trace context.
+const TraceparentHeader = "traceparent"
+
+const (
+	batchSize     = 512
+	batchInterval = time.Second
+	// queueSize bounds the spans waiting for export; spans recorded while
+	// it is full are dropped rather than slowing the broker down.
+	queueSize = 8192
+)
+
+type TraceID [16]byte
+
+type SpanID [8]byte
+
+// SpanContext identifies a span within a trace.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+func (sc SpanContext) Valid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent formats sc as a version 00 traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), flags)
+}
+
+// ParseTraceparent parses a traceparent header value. Versions other than
+// 00 are read the same way, as the specification asks.
+func ParseTraceparent(value string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return SpanContext{}, false
+	}
+
+	var sc SpanContext
+	var flags [1]byte
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return SpanContext{}, false
+	}
+	sc.Sampled = flags[0]&0x01 != 0
+	return sc, sc.Valid()
+}
+
+// SpanKind follows the OpenTelemetry span kinds.
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+	SpanKindProducer SpanKind = 4
+	SpanKindConsumer SpanKind = 5
+)
+
+// Span is one timed operation. A nil *Span ignores every call, so code can
+// trace unconditionally and a nil Tracer turns tracing off.
+type Span struct {
+	Name       string
+	Kind       SpanKind
+	Context    SpanContext
+	Parent     SpanID
+	Start      time.Time
+	EndTime    time.Time
+	Attributes map[string]string
+
+	tracer *Tracer
+	once   sync.Once
+}
+
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.Attributes[key] = value
+}
+
+// SpanContext returns the context to propagate to the span's children, or
+// the zero SpanContext for a nil span.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.Context
+}
+
+// End finishes the span at end and hands it to the exporter. Only the first
+// call has an effect.
+func (s *Span) End(end time.Time) {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() {
+		s.EndTime = end
+		s.tracer.record(s)
+	})
+}
+
+// Exporter sends finished spans to a backend.
+type Exporter interface {
+	ExportSpans(service string, spans []*Span) error
+}
+
+// Tracer creates spans and exports them in batches from a background
+// goroutine.
+type Tracer struct {
+	service  string
+	exporter Exporter
+	queue    chan *Span
+	done     chan struct{}
+	mu       sync.Mutex
+	dropped  int
+	closed   bool
+}
+
+func NewTracer(service string, exporter Exporter) *Tracer {
+	t := &Tracer{
+		service:  service,
+		exporter: exporter,
+		queue:    make(chan *Span, queueSize),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// StartSpan begins a span at start as a child of parent, or as the root of
+// a new trace when parent is not valid.
+func (t *Tracer) StartSpan(name string, kind SpanKind, parent SpanContext, start time.Time) *Span {
+	if t == nil {
+		return nil
+	}
+
+	span := &Span{
+		Name:       name,
+		Kind:       kind,
+		Start:      start,
+		Attributes: make(map[string]string),
+		tracer:     t,
+	}
+	if parent.Valid() {
+		span.Context.TraceID = parent.TraceID
+		span.Context.Sampled = parent.Sampled
+		span.Parent = parent.SpanID
+	} else {
+		rand.Read(span.Context.TraceID[:])
+		span.Context.Sampled = true
+	}
+	rand.Read(span.Context.SpanID[:])
+	return span
+}
+
+// Dropped returns how many spans were dropped because the export queue was
+// full.
+func (t *Tracer) Dropped() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.dropped
+}
+
+// Close exports the spans still queued and stops the tracer. Spans ended
+// afterwards are dropped.
+func (t *Tracer) Close() {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return
+	}
+	t.closed = true
+	close(t.queue)
+	t.mu.Unlock()
+
+	<-t.done
+}
+
+func (t *Tracer) record(span *Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		t.dropped++
+		return
+	}
+	select {
+	case t.queue <- span:
+	default:
+		t.dropped++
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(batchInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.ExportSpans(t.service, batch); err != nil {
+			log.Printf("Failed to export %d span(s): %v", len(batch), err)
+		}
+		batch = make([]*Span, 0, batchSize)
+	}
+
+	for {
+		select {
+		case span, ok := <-t.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) == batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
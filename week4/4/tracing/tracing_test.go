@@ -0,0 +1,145 @@
+package tracing_test
+
+import (
+	"QueraMQ/tracing"
+	"encoding/hex"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	traceHex = "4bf92f3577b34da6a3ce929d0e0e4736"
+	spanHex  = "00f067aa0ba902b7"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		ok      bool
+		sampled bool
+	}{
+		{"sampled", "00-" + traceHex + "-" + spanHex + "-01", true, true},
+		{"not sampled", "00-" + traceHex + "-" + spanHex + "-00", true, false},
+		{"other flags ignored", "00-" + traceHex + "-" + spanHex + "-03", true, true},
+		{"surrounding space", "  00-" + traceHex + "-" + spanHex + "-01 ", true, true},
+		{"future version with more fields", "01-" + traceHex + "-" + spanHex + "-01-extra", true, true},
+		{"version 00 with more fields", "00-" + traceHex + "-" + spanHex + "-01-extra", false, false},
+		{"forbidden version", "ff-" + traceHex + "-" + spanHex + "-01", false, false},
+		{"long version", "000-" + traceHex + "-" + spanHex + "-01", false, false},
+		{"short trace id", "00-" + traceHex[2:] + "-" + spanHex + "-01", false, false},
+		{"short span id", "00-" + traceHex + "-" + spanHex[2:] + "-01", false, false},
+		{"long flags", "00-" + traceHex + "-" + spanHex + "-001", false, false},
+		{"not hex", "00-" + "zz" + traceHex[2:] + "-" + spanHex + "-01", false, false},
+		{"zero trace id", "00-00000000000000000000000000000000-" + spanHex + "-01", false, false},
+		{"zero span id", "00-" + traceHex + "-0000000000000000-01", false, false},
+		{"missing fields", "00-" + traceHex, false, false},
+		{"empty", "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, ok := tracing.ParseTraceparent(tt.value)
+			if ok != tt.ok {
+				t.Fatalf("ParseTraceparent(%q) ok = %v, want %v", tt.value, ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if got := hex.EncodeToString(sc.TraceID[:]); got != traceHex {
+				t.Errorf("trace id %s, want %s", got, traceHex)
+			}
+			if got := hex.EncodeToString(sc.SpanID[:]); got != spanHex {
+				t.Errorf("span id %s, want %s", got, spanHex)
+			}
+			if sc.Sampled != tt.sampled {
+				t.Errorf("sampled %v, want %v", sc.Sampled, tt.sampled)
+			}
+		})
+	}
+}
+
+func TestTraceparentRoundTrip(t *testing.T) {
+	for _, value := range []string{
+		"00-" + traceHex + "-" + spanHex + "-01",
+		"00-" + traceHex + "-" + spanHex + "-00",
+	} {
+		sc, ok := tracing.ParseTraceparent(value)
+		if !ok {
+			t.Fatalf("ParseTraceparent(%q) failed", value)
+		}
+		if got := sc.Traceparent(); got != value {
+			t.Errorf("Traceparent() = %q, want %q", got, value)
+		}
+	}
+}
+
+// recorder is an Exporter that keeps every span it is given.
+type recorder struct {
+	mu    sync.Mutex
+	spans []*tracing.Span
+}
+
+func (r *recorder) ExportSpans(service string, spans []*tracing.Span) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func TestStartSpanContinuesParentTrace(t *testing.T) {
+	exporter := &recorder{}
+	tracer := tracing.NewTracer("test", exporter)
+	parent, _ := tracing.ParseTraceparent("00-" + traceHex + "-" + spanHex + "-00")
+
+	now := time.Now()
+	child := tracer.StartSpan("child", tracing.SpanKindProducer, parent, now)
+	root := tracer.StartSpan("root", tracing.SpanKindInternal, tracing.SpanContext{}, now)
+	child.End(now)
+	child.End(now.Add(time.Second))
+	root.End(now)
+	tracer.Close()
+
+	if child.Context.TraceID != parent.TraceID || child.Parent != parent.SpanID || child.Context.Sampled {
+		t.Errorf("child span %+v does not continue the parent %+v", child.Context, parent)
+	}
+	if child.Context.SpanID == parent.SpanID || !child.Context.Valid() {
+		t.Errorf("child span id %x is not a new valid id", child.Context.SpanID)
+	}
+	if root.Context.TraceID == parent.TraceID || root.Parent != (tracing.SpanID{}) || !root.Context.Sampled {
+		t.Errorf("root span %+v with parent %x, want a new sampled trace", root.Context, root.Parent)
+	}
+	if !child.EndTime.Equal(now) {
+		t.Errorf("second End moved the end time to %v", child.EndTime)
+	}
+	if len(exporter.spans) != 2 {
+		t.Errorf("exported %d spans, want 2", len(exporter.spans))
+	}
+}
+
+// A nil Tracer and the nil spans it starts turn tracing off without the
+// caller checking.
+func TestNilTracerIsANoop(t *testing.T) {
+	var tracer *tracing.Tracer
+	span := tracer.StartSpan("ignored", tracing.SpanKindInternal, tracing.SpanContext{}, time.Now())
+	if span != nil {
+		t.Fatalf("nil tracer started %v", span)
+	}
+	span.SetAttribute("key", "value")
+	span.End(time.Now())
+	if sc := span.SpanContext(); sc.Valid() {
+		t.Fatalf("nil span has context %+v", sc)
+	}
+}
+
+func TestSpansEndedAfterCloseAreDropped(t *testing.T) {
+	exporter := &recorder{}
+	tracer := tracing.NewTracer("test", exporter)
+	span := tracer.StartSpan("late", tracing.SpanKindInternal, tracing.SpanContext{}, time.Now())
+	tracer.Close()
+	span.End(time.Now())
+
+	if tracer.Dropped() != 1 || len(exporter.spans) != 0 {
+		t.Fatalf("dropped %d and exported %d spans, want 1 and 0", tracer.Dropped(), len(exporter.spans))
+	}
+}